@@ -11,13 +11,33 @@ trap '
   fi
 ' CHLD
 
-# Background the mock-proxy ICAP protocol server.
+# SSL bump is opt in. A CA is used if one has been mounted at
+# /etc/squid/ssl_cert/ca.pem or given with CA_FILE, and SSL_BUMP=true asks
+# mock-proxy to generate one there if there isn't one already.
+if [ -z "${CA_FILE:-}" ]; then
+  if [ -f /etc/squid/ssl_cert/ca.pem ] || [ "${SSL_BUMP:-}" = "true" ]; then
+    export CA_FILE=/etc/squid/ssl_cert/ca.pem
+  fi
+fi
+
+# Background the mock-proxy ICAP protocol server. It loads the CA from
+# CA_FILE, if set, or generates one there.
 /mock-proxy & PIDS+=("$!")
 
+# Give mock-proxy a moment to generate the CA, if it needs to.
+if [ -n "${CA_FILE:-}" ]; then
+  for _ in $(seq 1 50); do
+    [ -f "$CA_FILE" ] && break
+    sleep 0.1
+  done
+fi
+
 # Start squid in non-daemon mode, but bash backgrounded. Only use SSL bump if
-# an SSL cert has been mounted at /etc/squid/ssl_cert.
-if [ -f /etc/squid/ssl_cert/ca.pem ]; then
-  squid -f /etc/squid/squid-ssl.conf -N & PIDS+=($!)
+# there is a CA, and it hasn't been turned off with SSL_BUMP=false. The SSL
+# config is pointed at CA_FILE, as it may not be the default.
+if [ -n "${CA_FILE:-}" ] && [ -f "$CA_FILE" ] && [ "${SSL_BUMP:-}" != "false" ]; then
+  sed "s|cert=[^ ]*|cert=$CA_FILE|" /etc/squid/squid-ssl.conf > /etc/squid/squid-ssl-ca.conf
+  squid -f /etc/squid/squid-ssl-ca.conf -N & PIDS+=($!)
 else
   squid -f /etc/squid/squid.conf -N & PIDS+=($!)
 fi
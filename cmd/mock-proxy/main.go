@@ -2,8 +2,11 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/go-hclog"
 
@@ -28,15 +31,82 @@ func inner() error {
 		options = append(options, mock.WithAPIPort(port))
 	}
 
+	if portString := os.Getenv("ICAP_PORT"); portString != "" {
+		port, err := strconv.Atoi(portString)
+		if err != nil {
+			return fmt.Errorf("invalid ICAP_PORT: %w", err)
+		}
+		options = append(options, mock.WithICAPPort(port))
+	}
+
+	if portString := os.Getenv("PROXY_PORT"); portString != "" {
+		port, err := strconv.Atoi(portString)
+		if err != nil {
+			return fmt.Errorf("invalid PROXY_PORT: %w", err)
+		}
+		options = append(options, mock.WithProxyPort(port))
+	}
+
+	if intervalString := os.Getenv("RELOAD_INTERVAL"); intervalString != "" {
+		interval, err := time.ParseDuration(intervalString)
+		if err != nil {
+			return fmt.Errorf("invalid RELOAD_INTERVAL: %w", err)
+		}
+		options = append(options, mock.WithReloadInterval(interval))
+	}
+
+	if mode := os.Getenv("MODE"); mode != "" {
+		options = append(options, mock.WithMode(mock.Mode(mode)))
+	}
+
+	// Unmatched requests can be denied entirely, or only for some hosts,
+	// given as a comma separated list in DENIED_HOSTS.
+	if policy := os.Getenv("UNMATCHED_POLICY"); policy != "" {
+		var hosts []string
+		if hostsString := os.Getenv("DENIED_HOSTS"); hostsString != "" {
+			for _, host := range strings.Split(hostsString, ",") {
+				hosts = append(hosts, strings.TrimSpace(host))
+			}
+		}
+		options = append(options, mock.WithUnmatchedPolicy(mock.UnmatchedPolicy(policy), hosts...))
+	}
+
+	statusString, body := os.Getenv("DENIED_STATUS"), os.Getenv("DENIED_BODY")
+	if statusString != "" || body != "" {
+		status := http.StatusForbidden
+		if statusString != "" {
+			var err error
+			status, err = strconv.Atoi(statusString)
+			if err != nil {
+				return fmt.Errorf("invalid DENIED_STATUS: %w", err)
+			}
+		}
+		options = append(options, mock.WithDeniedResponse(status, body))
+	}
+
 	logLevel := "INFO"
 	if envLog := os.Getenv("LOG_LEVEL"); envLog != "" {
 		logLevel = envLog
 	}
 
-	options = append(options, mock.WithLogger(hclog.New(&hclog.LoggerOptions{
+	logger := hclog.New(&hclog.LoggerOptions{
 		Name:  "mock-proxy",
 		Level: hclog.LevelFromString(logLevel),
-	})))
+	})
+	options = append(options, mock.WithLogger(logger))
+
+	// The CA is loaded from CA_FILE, or generated and written there on first
+	// start, and is served by the API for clients to trust.
+	if caFile := os.Getenv("CA_FILE"); caFile != "" {
+		ca, created, err := mock.LoadOrCreateCA(caFile)
+		if err != nil {
+			return fmt.Errorf("invalid CA_FILE: %w", err)
+		}
+		if created {
+			logger.Info("generated a new CA", "path", caFile)
+		}
+		options = append(options, mock.WithCA(ca))
+	}
 
 	m, err := mock.NewMockServer(options...)
 	if err != nil {
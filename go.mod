@@ -7,6 +7,7 @@ require (
 	github.com/hashicorp/go-hclog v0.12.2
 	github.com/hashicorp/hcl2 v0.0.0-20191002203319-fb75b3253c80
 	github.com/stretchr/testify v1.4.0
+	github.com/zclconf/go-cty v1.0.0
 	gopkg.in/src-d/go-billy.v4 v4.3.2
 	gopkg.in/src-d/go-git.v4 v4.13.1
 )
@@ -0,0 +1,476 @@
+// Package client is a Go client for the mock-proxy API server, for use by
+// tests that drive mock-proxy.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/mock-proxy/pkg/mock"
+)
+
+var (
+	// ErrNotFound is wrapped by an APIError for a 404 response, such as when
+	// no runtime route has a given ID.
+	ErrNotFound = errors.New("not found")
+
+	// ErrConflict is wrapped by an APIError for a 409 response, such as when
+	// adding a route with an ID that is already in use.
+	ErrConflict = errors.New("conflict")
+)
+
+// APIError is returned when the API server responds with an unexpected status
+// code. It wraps ErrNotFound or ErrConflict where appropriate, so it can be
+// checked with errors.Is.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("mock-proxy API error %d: %s", e.StatusCode, e.Message)
+}
+
+// Unwrap returns the sentinel error for the status code, if there is one.
+func (e *APIError) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusConflict:
+		return ErrConflict
+	default:
+		return nil
+	}
+}
+
+// Variable is a single variable substitution. Scope and Name are empty for
+// global variables.
+type Variable struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Scope string `json:"scope,omitempty"`
+	Name  string `json:"name,omitempty"`
+}
+
+// Option is a configuration option for passing to the Client constructor.
+type Option func(*Client) error
+
+// Client drives a mock-proxy API server.
+type Client struct {
+	baseURL      *url.URL
+	httpClient   *http.Client
+	pollInterval time.Duration
+}
+
+// NewClient is a creator for a new Client, talking to the API server at
+// address, such as "http://squid.proxy". It makes use of functional options to
+// provide additional configuration on top of the defaults.
+func NewClient(address string, options ...Option) (*Client, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mock-proxy address %s: %w", address, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid mock-proxy address %s: requires a scheme and host", address)
+	}
+
+	c := &Client{
+		baseURL:      u,
+		httpClient:   &http.Client{Timeout: 30 * time.Second},
+		pollInterval: 100 * time.Millisecond,
+	}
+
+	for _, o := range options {
+		if err := o(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// WithHTTPClient is a functional option that changes the http.Client used to
+// reach the API server.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) error {
+		if httpClient == nil {
+			return fmt.Errorf("cannot call WithHTTPClient with nil Client")
+		}
+		c.httpClient = httpClient
+		return nil
+	}
+}
+
+// WithPollInterval is a functional option that changes how often WaitReady
+// checks whether the API server is up.
+func WithPollInterval(interval time.Duration) Option {
+	return func(c *Client) error {
+		if interval <= 0 {
+			return fmt.Errorf("poll interval must be positive")
+		}
+		c.pollInterval = interval
+		return nil
+	}
+}
+
+// WaitReady blocks until the API server responds, or the context is done.
+func (c *Client) WaitReady(ctx context.Context) error {
+	ticker := time.NewTicker(c.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		err := c.do(ctx, http.MethodGet, "/health", nil, "", nil)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("mock-proxy was not ready: %w", err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// Variables returns the current global variable substitutions.
+func (c *Client) Variables(ctx context.Context) ([]Variable, error) {
+	return c.ScopedVariables(ctx, mock.VariableScope{})
+}
+
+// ScopedVariables returns the variable substitutions set in a scope.
+func (c *Client) ScopedVariables(ctx context.Context, scope mock.VariableScope) ([]Variable, error) {
+	return c.variables(ctx, variablesPath(scope, nil))
+}
+
+// AllVariables returns the variable substitutions set in every scope,
+// including the global scope.
+func (c *Client) AllVariables(ctx context.Context) ([]Variable, error) {
+	return c.variables(ctx, "/substitution-variables?scope=all")
+}
+
+func (c *Client) variables(ctx context.Context, path string) ([]Variable, error) {
+	vars := []Variable{}
+	if err := c.do(ctx, http.MethodGet, path, nil, "", &vars); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+// SetVariable adds a global variable substitution, replacing any existing
+// value for the key.
+func (c *Client) SetVariable(ctx context.Context, key, value string) error {
+	return c.SetScopedVariable(ctx, mock.VariableScope{}, key, value)
+}
+
+// SetScopedVariable adds a variable substitution to a scope, replacing any
+// existing value for the key in that scope.
+func (c *Client) SetScopedVariable(ctx context.Context, scope mock.VariableScope, key, value string) error {
+	fields := [][2]string{{"key", key}, {"value", value}}
+	if scope.Kind != "" {
+		fields = append(fields, [2]string{"scope", scope.Kind}, [2]string{"name", scope.Name})
+	}
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for _, field := range fields {
+		if err := mw.WriteField(field[0], field[1]); err != nil {
+			return err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	return c.do(ctx, http.MethodPost, "/substitution-variables", body,
+		mw.FormDataContentType(), nil)
+}
+
+// DeleteVariable removes the global variable substitution for a key.
+func (c *Client) DeleteVariable(ctx context.Context, key string) error {
+	return c.DeleteScopedVariable(ctx, mock.VariableScope{}, key)
+}
+
+// DeleteScopedVariable removes the variable substitution for a key from a
+// scope.
+func (c *Client) DeleteScopedVariable(ctx context.Context, scope mock.VariableScope, key string) error {
+	return c.do(ctx, http.MethodDelete,
+		variablesPath(scope, url.Values{"key": {key}}), nil, "", nil)
+}
+
+// DeleteVariables removes every variable substitution from a scope.
+func (c *Client) DeleteVariables(ctx context.Context, scope mock.VariableScope) error {
+	return c.do(ctx, http.MethodDelete, variablesPath(scope, nil), nil, "", nil)
+}
+
+// ReplaceVariables replaces every variable substitution in a scope with vars.
+// Variables without a Scope of their own are set in the scope.
+func (c *Client) ReplaceVariables(ctx context.Context, scope mock.VariableScope, vars []Variable) error {
+	if vars == nil {
+		vars = []Variable{}
+	}
+	return c.doJSON(ctx, http.MethodPut, variablesPath(scope, nil), vars, nil)
+}
+
+// ResetVariables restores the variable substitutions mock-proxy was started
+// with, removing every scoped variable.
+func (c *Client) ResetVariables(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/substitution-variables/reset", nil, "", nil)
+}
+
+// Routes returns every route currently in use, from both the routes file and
+// the runtime routes.
+func (c *Client) Routes(ctx context.Context) (mock.RouteConfig, error) {
+	rc := mock.RouteConfig{}
+	if err := c.do(ctx, http.MethodGet, "/routes", nil, "", &rc); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+// Route returns the route with a given ID.
+func (c *Client) Route(ctx context.Context, id string) (*mock.Route, error) {
+	route := &mock.Route{}
+	if err := c.do(ctx, http.MethodGet, routePath(id), nil, "", route); err != nil {
+		return nil, err
+	}
+	return route, nil
+}
+
+// AddRoute adds a runtime route, and returns it as added, including its
+// generated ID if it was added without one.
+func (c *Client) AddRoute(ctx context.Context, route *mock.Route) (*mock.Route, error) {
+	added := &mock.Route{}
+	if err := c.doJSON(ctx, http.MethodPost, "/routes", route, added); err != nil {
+		return nil, err
+	}
+	return added, nil
+}
+
+// ReplaceRoute adds or replaces the runtime route with the ID of route.
+func (c *Client) ReplaceRoute(ctx context.Context, route *mock.Route) (*mock.Route, error) {
+	if route.ID == "" {
+		return nil, fmt.Errorf("cannot replace a route without an ID")
+	}
+
+	replaced := &mock.Route{}
+	if err := c.doJSON(ctx, http.MethodPut, routePath(route.ID), route, replaced); err != nil {
+		return nil, err
+	}
+	return replaced, nil
+}
+
+// DeleteRoute removes the runtime route with a given ID.
+func (c *Client) DeleteRoute(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, routePath(id), nil, "", nil)
+}
+
+// ResetRoutes removes every runtime route.
+func (c *Client) ResetRoutes(ctx context.Context) error {
+	return c.do(ctx, http.MethodDelete, "/routes", nil, "", nil)
+}
+
+// Reload reloads the routes file.
+func (c *Client) Reload(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/reload", nil, "", nil)
+}
+
+// Requests returns the journalled requests selected by a JournalFilter,
+// oldest first.
+func (c *Client) Requests(ctx context.Context, f mock.JournalFilter) ([]*mock.JournalEntry, error) {
+	q := url.Values{}
+	for k, v := range map[string]string{
+		"host": f.Host, "path": f.Path, "method": f.Method, "route": f.Route,
+	} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+
+	path := "/requests"
+	if len(q) != 0 {
+		path += "?" + q.Encode()
+	}
+
+	entries := []*mock.JournalEntry{}
+	if err := c.do(ctx, http.MethodGet, path, nil, "", &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ResetRequests empties the request journal.
+func (c *Client) ResetRequests(ctx context.Context) error {
+	return c.do(ctx, http.MethodDelete, "/requests", nil, "", nil)
+}
+
+// Scenarios returns the current state of every scenario.
+func (c *Client) Scenarios(ctx context.Context) (map[string]string, error) {
+	states := map[string]string{}
+	if err := c.do(ctx, http.MethodGet, "/scenarios", nil, "", &states); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// SetScenarioState moves a scenario to a new state.
+func (c *Client) SetScenarioState(ctx context.Context, name, state string) error {
+	return c.doJSON(ctx, http.MethodPut, scenarioPath(name),
+		map[string]string{"state": state}, nil)
+}
+
+// ResetScenarios returns one scenario, or every scenario if name is empty, to
+// its starting state, and restarts the response sequences of its routes.
+func (c *Client) ResetScenarios(ctx context.Context, name string) error {
+	path := "/scenarios"
+	if name != "" {
+		path = scenarioPath(name)
+	}
+	return c.do(ctx, http.MethodDelete, path, nil, "", nil)
+}
+
+// Faults returns the runtime fault configuration.
+func (c *Client) Faults(ctx context.Context) (*mock.FaultState, error) {
+	state := &mock.FaultState{}
+	if err := c.do(ctx, http.MethodGet, "/faults", nil, "", state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// SetFaultsEnabled enables or disables every fault.
+func (c *Client) SetFaultsEnabled(ctx context.Context, enabled bool) error {
+	return c.doJSON(ctx, http.MethodPut, "/faults",
+		map[string]bool{"enabled": enabled}, nil)
+}
+
+// SetRouteFault overrides the fault of the route with a given ID. An empty
+// fault stops the route injecting any faults.
+func (c *Client) SetRouteFault(ctx context.Context, id string, fault *mock.Fault) error {
+	return c.doJSON(ctx, http.MethodPut, faultPath(id), fault, nil)
+}
+
+// DeleteRouteFault removes the override of the fault of the route with a given
+// ID.
+func (c *Client) DeleteRouteFault(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, faultPath(id), nil, "", nil)
+}
+
+// ResetFaults removes every fault override, and enables faults.
+func (c *Client) ResetFaults(ctx context.Context) error {
+	return c.do(ctx, http.MethodDelete, "/faults", nil, "", nil)
+}
+
+// Reset returns mock-proxy to a clean state between tests, by removing every
+// runtime route, emptying the request journal, resetting every scenario and
+// resetting faults. Variable substitutions are left as they are.
+func (c *Client) Reset(ctx context.Context) error {
+	for _, reset := range []func(context.Context) error{
+		c.ResetRoutes,
+		c.ResetRequests,
+		func(ctx context.Context) error { return c.ResetScenarios(ctx, "") },
+		c.ResetFaults,
+	} {
+		if err := reset(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// doJSON sends a value as a JSON request body, and decodes any response into
+// out.
+func (c *Client) doJSON(ctx context.Context, method, path string, in, out interface{}) error {
+	js, err := json.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("error encoding request: %w", err)
+	}
+	return c.do(ctx, method, path, bytes.NewReader(js), "application/json", out)
+}
+
+// do sends a request to the API server, returning an APIError for any status
+// code other than a 2xx, and otherwise decoding the response into out, unless
+// it is nil.
+func (c *Client) do(
+	ctx context.Context,
+	method, path string,
+	body io.Reader,
+	contentType string,
+	out interface{},
+) error {
+	ref, err := url.Parse(path)
+	if err != nil {
+		return fmt.Errorf("error building request URL: %w", err)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL.ResolveReference(ref).String(), body)
+	if err != nil {
+		return fmt.Errorf("error building request: %w", err)
+	}
+	req = req.WithContext(ctx)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling mock-proxy: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return &APIError{
+			StatusCode: resp.StatusCode,
+			Message:    strings.TrimSpace(string(msg)),
+		}
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("error decoding response: %w", err)
+	}
+	return nil
+}
+
+// variablesPath returns the API path of the variable substitutions in a
+// scope, with any other query parameters.
+func variablesPath(scope mock.VariableScope, q url.Values) string {
+	if q == nil {
+		q = url.Values{}
+	}
+	if scope.Kind != "" {
+		q.Set("scope", scope.Kind)
+		q.Set("name", scope.Name)
+	}
+	if len(q) == 0 {
+		return "/substitution-variables"
+	}
+	return "/substitution-variables?" + q.Encode()
+}
+
+// routePath returns the API path of a single runtime route.
+func routePath(id string) string {
+	return "/routes/" + url.PathEscape(id)
+}
+
+// scenarioPath returns the API path of a single scenario.
+func scenarioPath(name string) string {
+	return "/scenarios/" + url.PathEscape(name)
+}
+
+// faultPath returns the API path of the fault override of a single route.
+func faultPath(id string) string {
+	return "/faults/" + url.PathEscape(id)
+}
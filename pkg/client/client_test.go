@@ -0,0 +1,253 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/mock-proxy/pkg/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestClient starts the API server of a MockServer, and returns a Client
+// for it, along with a function that stops the server.
+func newTestClient(t *testing.T) (*Client, *mock.MockServer, func()) {
+	ms, err := mock.NewMockServer(mock.WithMockRoot("testdata/"))
+	require.Nil(t, err)
+
+	server := httptest.NewServer(ms.APIHandler())
+
+	c, err := NewClient(server.URL)
+	require.Nil(t, err)
+
+	require.Nil(t, c.WaitReady(context.Background()))
+	return c, ms, server.Close
+}
+
+func TestNewClient(t *testing.T) {
+	tcs := []struct {
+		name    string
+		address string
+		options []Option
+		wantErr string
+	}{
+		{name: "valid", address: "http://squid.proxy"},
+		{name: "no scheme", address: "squid.proxy", wantErr: "requires a scheme and host"},
+		{
+			name:    "nil http client",
+			address: "http://squid.proxy",
+			options: []Option{WithHTTPClient(nil)},
+			wantErr: "nil Client",
+		},
+		{
+			name:    "zero poll interval",
+			address: "http://squid.proxy",
+			options: []Option{WithPollInterval(0)},
+			wantErr: "must be positive",
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := NewClient(tc.address, tc.options...)
+			if tc.wantErr == "" {
+				assert.Nil(t, err)
+			} else {
+				require.NotNil(t, err)
+				assert.Contains(t, err.Error(), tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestClientWaitReady(t *testing.T) {
+	t.Parallel()
+
+	// Nothing is listening, so the client is never ready.
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	c, err := NewClient(server.URL, WithPollInterval(10*time.Millisecond))
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.NotNil(t, c.WaitReady(ctx))
+}
+
+func TestClientVariables(t *testing.T) {
+	t.Parallel()
+
+	c, _, stop := newTestClient(t)
+	defer stop()
+	ctx := context.Background()
+
+	require.Nil(t, c.SetVariable(ctx, "name", "world"))
+	vars, err := c.Variables(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, []Variable{{Key: "name", Value: "world"}}, vars)
+
+	host := mock.VariableScope{Kind: mock.ScopeHost, Name: "example.com"}
+	require.Nil(t, c.SetScopedVariable(ctx, host, "name", "example"))
+	vars, err = c.ScopedVariables(ctx, host)
+	require.Nil(t, err)
+	assert.Equal(t, []Variable{{Key: "name", Value: "example", Scope: "host", Name: "example.com"}}, vars)
+
+	vars, err = c.AllVariables(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, []Variable{
+		{Key: "name", Value: "world"},
+		{Key: "name", Value: "example", Scope: "host", Name: "example.com"},
+	}, vars)
+
+	require.Nil(t, c.DeleteScopedVariable(ctx, host, "name"))
+	vars, err = c.ScopedVariables(ctx, host)
+	require.Nil(t, err)
+	assert.Empty(t, vars)
+
+	require.Nil(t, c.DeleteVariable(ctx, "name"))
+	vars, err = c.Variables(ctx)
+	require.Nil(t, err)
+	assert.Empty(t, vars)
+}
+
+func TestClientBulkVariables(t *testing.T) {
+	t.Parallel()
+
+	c, _, stop := newTestClient(t)
+	defer stop()
+	ctx := context.Background()
+
+	client := mock.VariableScope{Kind: mock.ScopeClient, Name: "suite-a"}
+	require.Nil(t, c.SetVariable(ctx, "stale", "value"))
+	require.Nil(t, c.ReplaceVariables(ctx, mock.VariableScope{}, []Variable{
+		{Key: "name", Value: "world"},
+		{Key: "org", Value: "hashicorp"},
+	}))
+	require.Nil(t, c.ReplaceVariables(ctx, client, []Variable{{Key: "name", Value: "suite-a"}}))
+
+	vars, err := c.AllVariables(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, []Variable{
+		{Key: "name", Value: "world"},
+		{Key: "org", Value: "hashicorp"},
+		{Key: "name", Value: "suite-a", Scope: "client", Name: "suite-a"},
+	}, vars)
+
+	require.Nil(t, c.DeleteVariables(ctx, mock.VariableScope{}))
+	vars, err = c.AllVariables(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, []Variable{{Key: "name", Value: "suite-a", Scope: "client", Name: "suite-a"}}, vars)
+
+	require.Nil(t, c.ResetVariables(ctx))
+	vars, err = c.AllVariables(ctx)
+	require.Nil(t, err)
+	assert.Empty(t, vars)
+}
+
+func TestClientRoutes(t *testing.T) {
+	t.Parallel()
+
+	c, _, stop := newTestClient(t)
+	defer stop()
+	ctx := context.Background()
+
+	body := "I'm a teapot"
+	added, err := c.AddRoute(ctx, &mock.Route{
+		ID: "teapot", Host: "example.com", Path: "/teapot", Type: "http", Body: &body,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, "teapot", added.ID)
+
+	_, err = c.AddRoute(ctx, added)
+	assert.True(t, errors.Is(err, ErrConflict))
+	var apiErr *APIError
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusConflict, apiErr.StatusCode)
+
+	generated, err := c.AddRoute(ctx, &mock.Route{Host: "example.com", Path: "/pot", Type: "http"})
+	require.Nil(t, err)
+	assert.NotEmpty(t, generated.ID)
+
+	added.Path = "/kettle"
+	replaced, err := c.ReplaceRoute(ctx, added)
+	require.Nil(t, err)
+	assert.Equal(t, "/kettle", replaced.Path)
+
+	got, err := c.Route(ctx, "teapot")
+	require.Nil(t, err)
+	assert.Equal(t, "/kettle", got.Path)
+
+	rc, err := c.Routes(ctx)
+	require.Nil(t, err)
+	assert.Len(t, rc, 4)
+
+	require.Nil(t, c.DeleteRoute(ctx, "teapot"))
+	_, err = c.Route(ctx, "teapot")
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	require.Nil(t, c.ResetRoutes(ctx))
+	rc, err = c.Routes(ctx)
+	require.Nil(t, err)
+	assert.Len(t, rc, 2)
+
+	require.Nil(t, c.Reload(ctx))
+}
+
+func TestClientRequestsAndScenarios(t *testing.T) {
+	t.Parallel()
+
+	c, ms, stop := newTestClient(t)
+	defer stop()
+	ctx := context.Background()
+
+	require.Nil(t, ms.AddRoute(&mock.Route{ID: "a", Host: "example.com", Path: "/a", Type: "http"}))
+
+	entries, err := c.Requests(ctx, mock.JournalFilter{Host: "example.com"})
+	require.Nil(t, err)
+	assert.Empty(t, entries)
+
+	require.Nil(t, c.SetScenarioState(ctx, "orders", "ordered"))
+	states, err := c.Scenarios(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, map[string]string{"orders": "ordered"}, states)
+
+	require.Nil(t, c.Reset(ctx))
+	states, err = c.Scenarios(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, map[string]string{"orders": mock.ScenarioStarted}, states)
+	assert.Empty(t, ms.Requests(mock.JournalFilter{}))
+	assert.Len(t, ms.Routes(), 2)
+}
+
+func TestClientFaults(t *testing.T) {
+	t.Parallel()
+
+	c, ms, stop := newTestClient(t)
+	defer stop()
+	ctx := context.Background()
+
+	require.Nil(t, ms.AddRoute(&mock.Route{ID: "a", Host: "example.com", Path: "/a", Type: "http"}))
+
+	require.Nil(t, c.SetRouteFault(ctx, "a", &mock.Fault{Latency: "1s"}))
+	err := c.SetRouteFault(ctx, "missing", &mock.Fault{})
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	require.Nil(t, c.SetFaultsEnabled(ctx, false))
+	state, err := c.Faults(ctx)
+	require.Nil(t, err)
+	assert.False(t, state.Enabled)
+	require.Contains(t, state.Routes, "a")
+	assert.Equal(t, "1s", state.Routes["a"].Latency)
+
+	require.Nil(t, c.DeleteRouteFault(ctx, "a"))
+	require.Nil(t, c.Reset(ctx))
+	assert.Equal(t, mock.FaultState{Enabled: true, Routes: map[string]*mock.Fault{}}, ms.Faults())
+}
@@ -0,0 +1,14 @@
+route {
+    host = "example.com"
+    path = "/simple"
+    type = "http"
+}
+
+route {
+    host     = "example.com"
+    path     = "/orders"
+    type     = "http"
+    method   = "POST"
+    body     = "{}"
+    scenario = "orders"
+}
@@ -0,0 +1,212 @@
+package mock
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// caValidity is how long a generated CA is valid for.
+const caValidity = 365 * 24 * time.Hour
+
+// GenerateCA creates a new self signed CA, suitable for WithCA.
+func GenerateCA() (tls.Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error generating CA key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error generating CA serial number: %w", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"HashiCorp"},
+			CommonName:   "mock-proxy CA",
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error signing CA certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error parsing CA certificate: %w", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// LoadCA reads a CA from a PEM file holding both its certificate and private
+// key, which is the format Squid's SSL Bump also uses.
+func LoadCA(path string) (tls.Certificate, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error reading CA file: %w", err)
+	}
+
+	var certPEM, keyPEM []byte
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+
+		switch {
+		case block.Type == "CERTIFICATE":
+			certPEM = append(certPEM, pem.EncodeToMemory(block)...)
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			keyPEM = pem.EncodeToMemory(block)
+		}
+	}
+
+	ca, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error parsing CA file %s: %w", path, err)
+	}
+	return ca, nil
+}
+
+// LoadOrCreateCA reads a CA from a PEM file, as LoadCA. If the file doesn't
+// exist, a new CA is generated and written to it, along with a DER encoded
+// copy of the certificate alone, with a .crt extension, for clients to trust.
+func LoadOrCreateCA(path string) (tls.Certificate, bool, error) {
+	if _, err := os.Stat(path); err == nil {
+		ca, err := LoadCA(path)
+		return ca, false, err
+	} else if !os.IsNotExist(err) {
+		return tls.Certificate{}, false, fmt.Errorf("error reading CA file: %w", err)
+	}
+
+	ca, err := GenerateCA()
+	if err != nil {
+		return tls.Certificate{}, false, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(ca.PrivateKey)
+	if err != nil {
+		return tls.Certificate{}, false, fmt.Errorf("error encoding CA key: %w", err)
+	}
+	b := &bytes.Buffer{}
+	_ = pem.Encode(b, &pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	_ = pem.Encode(b, &pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]})
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return tls.Certificate{}, false, fmt.Errorf("error creating CA directory: %w", err)
+	}
+	if err := writeFileAtomic(path, b.Bytes(), 0600); err != nil {
+		return tls.Certificate{}, false, fmt.Errorf("error writing CA file: %w", err)
+	}
+
+	crtPath := strings.TrimSuffix(path, filepath.Ext(path)) + ".crt"
+	if err := writeFileAtomic(crtPath, ca.Certificate[0], 0644); err != nil {
+		return tls.Certificate{}, false, fmt.Errorf("error writing CA certificate: %w", err)
+	}
+
+	return ca, true, nil
+}
+
+// writeFileAtomic writes a file by renaming a temporary file into place, so
+// that other processes never see it partially written.
+func writeFileAtomic(path string, b []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// certCache holds the leaf certificates minted for each host, so that they
+// are only minted once, until they are close to expiring.
+type certCache struct {
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+// newCertCache creates an empty certCache.
+func newCertCache() *certCache {
+	return &certCache{certs: map[string]*tls.Certificate{}}
+}
+
+// get returns the cached certificate for a host, or mints a new one if there
+// is none, or the cached certificate expires within the hour.
+func (c *certCache) get(
+	host string,
+	mint func(host string) (*tls.Certificate, error),
+) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cert, ok := c.certs[host]; ok && time.Now().Add(time.Hour).Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+
+	cert, err := mint(host)
+	if err != nil {
+		return nil, err
+	}
+	c.certs[host] = cert
+	return cert, nil
+}
+
+// caHandler serves the CA certificate, but never its key, so that clients can
+// fetch and trust it.
+//   GET /ca.pem) Returns the certificate PEM encoded.
+//   GET /ca.crt) Returns the certificate DER encoded.
+//     curl -o /usr/local/share/ca-certificates/mock-proxy.crt squid.proxy/ca.pem
+func (ms *MockServer) caHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ms.ca == nil {
+		http.Error(w, "no CA is configured", http.StatusNotFound)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/ca.pem":
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: ms.ca.Certificate[0]})
+	default:
+		w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+		_, _ = w.Write(ms.ca.Certificate[0])
+	}
+}
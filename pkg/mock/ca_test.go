@@ -0,0 +1,116 @@
+package mock
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadOrCreateCA(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "mock-proxy-ca")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ssl_cert", "ca.pem")
+
+	created, ok, err := LoadOrCreateCA(path)
+	require.Nil(t, err)
+	assert.True(t, ok)
+	assert.True(t, created.Leaf.IsCA)
+
+	// The key is kept private, and a DER copy of the certificate is written
+	// alongside it.
+	info, err := os.Stat(path)
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	der, err := ioutil.ReadFile(filepath.Join(dir, "ssl_cert", "ca.crt"))
+	require.Nil(t, err)
+	assert.Equal(t, created.Certificate[0], der)
+
+	loaded, ok, err := LoadOrCreateCA(path)
+	require.Nil(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, created.Certificate, loaded.Certificate)
+
+	_, err = NewMockServer(WithMockRoot("testdata/"), WithCA(loaded))
+	assert.Nil(t, err)
+}
+
+func TestLoadCAInvalid(t *testing.T) {
+	t.Parallel()
+
+	_, err := LoadCA("testdata/routes.hcl")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "error parsing CA file")
+}
+
+func TestCertCache(t *testing.T) {
+	t.Parallel()
+
+	ms, err := NewMockServer(WithMockRoot("testdata/"), WithCA(newTestCA(t)))
+	require.Nil(t, err)
+
+	first, err := ms.certs.get("example.com", ms.leafCertificate)
+	require.Nil(t, err)
+	second, err := ms.certs.get("example.com", ms.leafCertificate)
+	require.Nil(t, err)
+	assert.Same(t, first, second)
+
+	other, err := ms.certs.get("example.org", ms.leafCertificate)
+	require.Nil(t, err)
+	assert.True(t, first != other)
+	assert.Equal(t, []string{"example.org"}, other.Leaf.DNSNames)
+
+	// Leaf certificates never outlive the CA, so those of a CA that expires
+	// within the hour are minted again rather than served from the cache.
+	expiring, err := NewMockServer(WithMockRoot("testdata/"),
+		WithCA(newTestCAValidFor(t, 30*time.Minute)))
+	require.Nil(t, err)
+
+	first, err = expiring.certs.get("example.com", expiring.leafCertificate)
+	require.Nil(t, err)
+	assert.True(t, first.Leaf.NotAfter.Before(time.Now().Add(time.Hour)))
+	second, err = expiring.certs.get("example.com", expiring.leafCertificate)
+	require.Nil(t, err)
+	assert.True(t, first != second)
+}
+
+func TestMockServerCAHandler(t *testing.T) {
+	t.Parallel()
+
+	ca := newTestCA(t)
+	ms, err := NewMockServer(WithMockRoot("testdata/"), WithCA(ca))
+	require.Nil(t, err)
+
+	resp := doAPI(t, ms.caHandler, http.MethodGet, "/ca.pem", "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	block, rest := pem.Decode(resp.Body.Bytes())
+	require.NotNil(t, block)
+	assert.Equal(t, "CERTIFICATE", block.Type)
+	assert.Equal(t, ca.Certificate[0], block.Bytes)
+	assert.Empty(t, rest)
+
+	resp = doAPI(t, ms.caHandler, http.MethodGet, "/ca.crt", "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	cert, err := x509.ParseCertificate(resp.Body.Bytes())
+	require.Nil(t, err)
+	assert.True(t, cert.IsCA)
+
+	resp = doAPI(t, ms.caHandler, http.MethodPost, "/ca.pem", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.Code)
+
+	noCA, err := NewMockServer(WithMockRoot("testdata/"))
+	require.Nil(t, err)
+	resp = doAPI(t, noCA.caHandler, http.MethodGet, "/ca.pem", "")
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
@@ -0,0 +1,125 @@
+package mock
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMockServerConcurrentState hammers the API and the mock handler at the
+// same time, and is most useful with the race detector, as in go test -race.
+func TestMockServerConcurrentState(t *testing.T) {
+	t.Parallel()
+
+	ms, err := NewMockServer(
+		WithMockRoot("testdata/"),
+		WithDefaultVariables(
+			&VariableSubstitution{key: "a", value: "0"},
+			&VariableSubstitution{key: "b", value: "0"},
+		),
+	)
+	require.Nil(t, err)
+	require.Nil(t, ms.AddRoute(&Route{
+		ID:   "pair",
+		Host: "example.com",
+		Path: "/pair/:name",
+		Type: "http",
+		Body: strPtr("{{ .a }}-{{ .b }} {{ .name }}"),
+	}))
+	api := ms.APIHandler()
+
+	do := func(handler http.Handler, method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	const (
+		workers    = 4
+		iterations = 100
+	)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		w := w
+		wg.Add(4)
+
+		// Variables are replaced as a pair, so a mock must never see the a
+		// of one pair with the b of another.
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				v := fmt.Sprintf("%d", w*iterations+i)
+				res := do(api, http.MethodPut, "/substitution-variables",
+					fmt.Sprintf(`[{"key": "a", "value": %q}, {"key": "b", "value": %q}]`, v, v))
+				assert.Equal(t, http.StatusNoContent, res.Code, res.Body.String())
+
+				res = do(api, http.MethodPut, "/substitution-variables?scope=client&name=other",
+					fmt.Sprintf(`[{"key": "a", "value": "x%s"}, {"key": "b", "value": "y%s"}]`, v, v))
+				assert.Equal(t, http.StatusNoContent, res.Code, res.Body.String())
+				do(api, http.MethodDelete, "/substitution-variables?scope=all", "")
+				do(api, http.MethodPost, "/substitution-variables/reset", "")
+				do(api, http.MethodGet, "/substitution-variables?scope=all", "")
+			}
+		}()
+
+		// Runtime routes, faults and scenarios change underneath the
+		// requests.
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				id := fmt.Sprintf("extra-%d-%d", w, i)
+				res := do(api, http.MethodPut, "/routes/"+id,
+					fmt.Sprintf(`{"host": "example.com", "path": "/extra/%d", "type": "http", "body": "hi"}`, i))
+				assert.Equal(t, http.StatusOK, res.Code, res.Body.String())
+				do(api, http.MethodGet, "/routes", "")
+				do(api, http.MethodPut, "/faults/pair", `{}`)
+				do(api, http.MethodDelete, "/faults/pair", "")
+				do(api, http.MethodPut, "/scenarios/orders", `{"state": "ordered"}`)
+				do(api, http.MethodDelete, "/scenarios", "")
+				do(api, http.MethodDelete, "/routes/"+id, "")
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				do(api, http.MethodGet, "/requests", "")
+				if i%10 == 0 {
+					do(api, http.MethodDelete, "/requests", "")
+				}
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				name := fmt.Sprintf("w%d", w)
+				res := do(http.HandlerFunc(ms.mockHandler), http.MethodGet,
+					"http://example.com/pair/"+name, "")
+				if !assert.Equal(t, http.StatusOK, res.Code, res.Body.String()) {
+					continue
+				}
+
+				// Between clearing and resetting the variables, both are
+				// missing, and left in the response as they are.
+				pair := strings.TrimSuffix(res.Body.String(), " "+name)
+				if pair == "{{.a}}-{{.b}}" {
+					continue
+				}
+				parts := strings.SplitN(pair, "-", 2)
+				if assert.Len(t, parts, 2, pair) {
+					assert.Equal(t, parts[0], parts[1], "variables from different updates were mixed")
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
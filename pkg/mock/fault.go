@@ -0,0 +1,443 @@
+package mock
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The faults a Fault can inject instead of, or into, a mock response, as
+// recorded in the request journal.
+const (
+	FaultError    = "error"
+	FaultReset    = "reset"
+	FaultTruncate = "truncate"
+	FaultHang     = "hang"
+)
+
+// Fault makes the mock responses of a Route slow or unreliable, to test how
+// clients cope with flaky upstreams. Every response is delayed by Latency, plus
+// a random extra delay of up to Jitter, and its body is throttled to Bandwidth
+// bytes per second. ErrorRate is the probability of responding with
+// ErrorStatus, 503 by default, instead of the mock. Abort is one of "reset",
+// which resets the connection without responding, "truncate", which closes
+// the connection half way through the body, or "hang", which never responds.
+// Aborts happen with probability AbortRate, or always if it is zero. Over
+// ICAP, Squid holds the connection to the client, so a reset is answered with
+// a Squid error page instead, and a truncate ends the body early.
+//   fault {
+//     latency    = "200ms"
+//     jitter     = "100ms"
+//     error_rate = 0.25
+//   }
+type Fault struct {
+	Latency     string  `hcl:"latency,optional" json:"latency,omitempty"`
+	Jitter      string  `hcl:"jitter,optional" json:"jitter,omitempty"`
+	Bandwidth   int     `hcl:"bandwidth,optional" json:"bandwidth,omitempty"`
+	ErrorRate   float64 `hcl:"error_rate,optional" json:"error_rate,omitempty"`
+	ErrorStatus int     `hcl:"error_status,optional" json:"error_status,omitempty"`
+	Abort       string  `hcl:"abort,optional" json:"abort,omitempty"`
+	AbortRate   float64 `hcl:"abort_rate,optional" json:"abort_rate,omitempty"`
+
+	// latency and jitter are the parsed forms of Latency and Jitter, set by
+	// Validate.
+	latency time.Duration
+	jitter  time.Duration
+}
+
+// Validate checks that a Fault is well formed, and parses its durations.
+func (f *Fault) Validate() error {
+	var err error
+	if f.latency, err = parseFaultDuration(f.Latency); err != nil {
+		return fmt.Errorf("invalid fault latency: %w", err)
+	}
+	if f.jitter, err = parseFaultDuration(f.Jitter); err != nil {
+		return fmt.Errorf("invalid fault jitter: %w", err)
+	}
+
+	if f.Bandwidth < 0 {
+		return fmt.Errorf("fault bandwidth cannot be negative")
+	}
+	if f.ErrorRate < 0 || f.ErrorRate > 1 {
+		return fmt.Errorf("fault error_rate must be between 0 and 1")
+	}
+	if f.ErrorStatus != 0 && (f.ErrorStatus < 100 || f.ErrorStatus > 599) {
+		return fmt.Errorf("invalid fault error_status %d", f.ErrorStatus)
+	}
+
+	switch f.Abort {
+	case "", FaultReset, FaultTruncate, FaultHang:
+	default:
+		return fmt.Errorf("unknown fault abort %q", f.Abort)
+	}
+	if f.AbortRate < 0 || f.AbortRate > 1 {
+		return fmt.Errorf("fault abort_rate must be between 0 and 1")
+	}
+	if f.AbortRate != 0 && f.Abort == "" {
+		return fmt.Errorf("fault abort_rate requires an abort")
+	}
+
+	return nil
+}
+
+// parseFaultDuration parses an optional, non negative duration.
+func parseFaultDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("duration cannot be negative")
+	}
+	return d, nil
+}
+
+// roll decides which fault, if any, to inject into a single response.
+func (f *Fault) roll() string {
+	if f.Abort != "" && (f.AbortRate == 0 || rand.Float64() < f.AbortRate) {
+		return f.Abort
+	}
+	if f.ErrorRate > 0 && rand.Float64() < f.ErrorRate {
+		return FaultError
+	}
+	return ""
+}
+
+// delay waits for the latency of a Fault, returning false if the request was
+// cancelled first.
+func (f *Fault) delay(ctx context.Context) bool {
+	d := f.latency
+	if f.jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(f.jitter)))
+	}
+	if d == 0 {
+		return true
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// injectFault injects a Fault into the mock response to a request. It returns
+// the kind of fault injected, and false if the fault has replaced the mock
+// response entirely. Otherwise, the mock response should be written to the
+// returned faultWriter, if there is one, and then finish called on it.
+func injectFault(w http.ResponseWriter, r *http.Request, f *Fault) (string, *faultWriter, bool) {
+	kind := f.roll()
+	if !f.delay(r.Context()) {
+		return kind, nil, false
+	}
+
+	switch kind {
+	case FaultHang:
+		<-r.Context().Done()
+		return kind, nil, false
+	case FaultError:
+		status := f.ErrorStatus
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, "mock-proxy: injected fault", status)
+		return kind, nil, false
+	case "":
+		if f.Bandwidth == 0 {
+			return kind, nil, true
+		}
+	}
+
+	return kind, &faultWriter{ResponseWriter: w, ctx: r.Context(), fault: f, kind: kind}, true
+}
+
+// faultWriter is an http.ResponseWriter that buffers a mock response, so that
+// finish can then throttle, truncate or reset it.
+type faultWriter struct {
+	http.ResponseWriter
+	ctx   context.Context
+	fault *Fault
+	kind  string
+
+	status int
+	body   []byte
+}
+
+func (fw *faultWriter) WriteHeader(code int) {
+	if fw.status == 0 {
+		fw.status = code
+	}
+}
+
+func (fw *faultWriter) Write(p []byte) (int, error) {
+	if fw.status == 0 {
+		fw.status = http.StatusOK
+	}
+	fw.body = append(fw.body, p...)
+	return len(p), nil
+}
+
+// finish sends the buffered mock response, with the fault applied.
+func (fw *faultWriter) finish() {
+	if fw.kind == FaultReset {
+		abortResponse(fw.ResponseWriter, true)
+		return
+	}
+
+	body := fw.body
+	if fw.kind == FaultTruncate {
+		body = body[:len(body)/2]
+	}
+
+	if fw.status == 0 {
+		fw.status = http.StatusOK
+	}
+	fw.Header().Set("Content-Length", strconv.Itoa(len(fw.body)))
+	fw.ResponseWriter.WriteHeader(fw.status)
+	if err := fw.throttle(body); err != nil {
+		return
+	}
+
+	if fw.kind == FaultTruncate {
+		abortResponse(fw.ResponseWriter, false)
+	}
+}
+
+// throttle writes a body at the bandwidth of the Fault, if it has one.
+func (fw *faultWriter) throttle(body []byte) error {
+	if fw.fault.Bandwidth == 0 {
+		_, err := fw.ResponseWriter.Write(body)
+		return err
+	}
+
+	// Write a tenth of a second's worth of the body at a time.
+	chunk := fw.fault.Bandwidth / 10
+	if chunk == 0 {
+		chunk = 1
+	}
+	interval := time.Duration(chunk) * time.Second / time.Duration(fw.fault.Bandwidth)
+
+	for len(body) > 0 {
+		n := chunk
+		if n > len(body) {
+			n = len(body)
+		}
+		if _, err := fw.ResponseWriter.Write(body[:n]); err != nil {
+			return err
+		}
+		if f, ok := fw.ResponseWriter.(http.Flusher); ok {
+			f.Flush()
+		}
+		body = body[n:]
+
+		if len(body) > 0 {
+			select {
+			case <-time.After(interval):
+			case <-fw.ctx.Done():
+				return fw.ctx.Err()
+			}
+		}
+	}
+	return nil
+}
+
+// aborter is implemented by ResponseWriters that can abort a response
+// without a connection to hijack, such as when serving a mock over ICAP.
+type aborter interface {
+	abort(reset bool) error
+}
+
+// abortResponse closes the connection a response is being written to, after
+// sending whatever has been written so far. A reset discards any unsent data,
+// and makes the client see a connection reset rather than a clean close.
+func abortResponse(w http.ResponseWriter, reset bool) {
+	if f, ok := w.(http.Flusher); ok && !reset {
+		f.Flush()
+	}
+
+	if hj, ok := w.(http.Hijacker); ok {
+		if conn, _, err := hj.Hijack(); err == nil {
+			if tcpConn, ok := conn.(*net.TCPConn); ok && reset {
+				_ = tcpConn.SetLinger(0)
+			}
+			conn.Close()
+			return
+		}
+	}
+	if a, ok := w.(aborter); ok {
+		if err := a.abort(reset); err == nil {
+			return
+		}
+	}
+
+	// Without any other way to close the connection, aborting the handler
+	// is the only way left.
+	panic(http.ErrAbortHandler)
+}
+
+// faults holds the runtime fault configuration, which can disable every
+// Fault, or override the Fault of a Route.
+type faults struct {
+	mu       sync.RWMutex
+	disabled bool
+	routes   map[string]*Fault
+}
+
+// newFaults creates an enabled faults with no overrides.
+func newFaults() *faults {
+	return &faults{routes: map[string]*Fault{}}
+}
+
+// FaultState is the runtime fault configuration. Routes maps the ID of a Route
+// to the Fault that overrides the one in its definition.
+type FaultState struct {
+	Enabled bool              `json:"enabled"`
+	Routes  map[string]*Fault `json:"routes"`
+}
+
+// routeFault returns the Fault to inject into the mock responses of a Route,
+// if any.
+func (ms *MockServer) routeFault(route *Route) *Fault {
+	ms.faults.mu.RLock()
+	defer ms.faults.mu.RUnlock()
+
+	if ms.faults.disabled {
+		return nil
+	}
+	if f, ok := ms.faults.routes[route.ID]; ok && route.ID != "" {
+		return f
+	}
+	return route.Fault
+}
+
+// Faults returns the runtime fault configuration.
+func (ms *MockServer) Faults() FaultState {
+	ms.faults.mu.RLock()
+	defer ms.faults.mu.RUnlock()
+
+	state := FaultState{Enabled: !ms.faults.disabled, Routes: map[string]*Fault{}}
+	for id, f := range ms.faults.routes {
+		state.Routes[id] = f
+	}
+	return state
+}
+
+// SetFaultsEnabled enables or disables every Fault, without forgetting them.
+func (ms *MockServer) SetFaultsEnabled(enabled bool) {
+	ms.faults.mu.Lock()
+	defer ms.faults.mu.Unlock()
+
+	ms.faults.disabled = !enabled
+}
+
+// SetRouteFault overrides the Fault of the Route with a given ID, which may be
+// from either the routes file or added at runtime. An empty Fault stops the
+// Route injecting any faults.
+func (ms *MockServer) SetRouteFault(id string, f *Fault) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+
+	found := false
+	for _, route := range ms.Routes() {
+		if route.ID == id {
+			found = true
+			break
+		}
+	}
+	if !found || id == "" {
+		return fmt.Errorf("%w: %s", ErrRouteNotFound, id)
+	}
+
+	ms.faults.mu.Lock()
+	defer ms.faults.mu.Unlock()
+
+	ms.faults.routes[id] = f
+	return nil
+}
+
+// DeleteRouteFault removes the override of the Fault of the Route with a given
+// ID, so that it injects the faults in its definition again.
+func (ms *MockServer) DeleteRouteFault(id string) {
+	ms.faults.mu.Lock()
+	defer ms.faults.mu.Unlock()
+
+	delete(ms.faults.routes, id)
+}
+
+// ResetFaults removes every override, and enables faults again.
+func (ms *MockServer) ResetFaults() {
+	ms.faults.mu.Lock()
+	defer ms.faults.mu.Unlock()
+
+	ms.faults.disabled = false
+	ms.faults.routes = map[string]*Fault{}
+}
+
+// faultsHandler manages faults at runtime.
+//   GET /faults) Returns whether faults are enabled, and every override.
+//   PUT /faults) Enables or disables every fault.
+//     curl -X PUT squid.proxy/faults --data '{"enabled": false}'
+//   DELETE /faults) Removes every override and enables faults.
+//   PUT /faults/{id}) Overrides the fault of the route with the given ID.
+//     curl -X PUT squid.proxy/faults/repos --data '{"error_rate": 0.5}'
+//   DELETE /faults/{id}) Removes the override of the route with the given ID.
+func (ms *MockServer) faultsHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/faults"), "/")
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, ms.Faults())
+	case id == "" && r.Method == http.MethodPut:
+		toggle := struct {
+			Enabled *bool `json:"enabled"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&toggle); err != nil {
+			http.Error(w, fmt.Sprintf("error parsing faults: %s", err.Error()),
+				http.StatusBadRequest)
+			return
+		}
+		if toggle.Enabled == nil {
+			http.Error(w, "enabled must be supplied", http.StatusBadRequest)
+			return
+		}
+
+		ms.SetFaultsEnabled(*toggle.Enabled)
+		writeJSON(w, http.StatusOK, ms.Faults())
+	case id == "" && r.Method == http.MethodDelete:
+		ms.ResetFaults()
+		w.WriteHeader(http.StatusNoContent)
+	case id != "" && r.Method == http.MethodPut:
+		f := &Fault{}
+		if err := json.NewDecoder(r.Body).Decode(f); err != nil {
+			http.Error(w, fmt.Sprintf("error parsing fault: %s", err.Error()),
+				http.StatusBadRequest)
+			return
+		}
+
+		if err := ms.SetRouteFault(id, f); err != nil {
+			writeRouteError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, f)
+	case id != "" && r.Method == http.MethodDelete:
+		ms.DeleteRouteFault(id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
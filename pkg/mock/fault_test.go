@@ -0,0 +1,285 @@
+package mock
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-icap/icap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultValidate(t *testing.T) {
+	tcs := []struct {
+		name    string
+		fault   *Fault
+		wantErr string
+	}{
+		{name: "empty", fault: &Fault{}},
+		{name: "every fault", fault: &Fault{
+			Latency: "1s", Jitter: "500ms", Bandwidth: 1024, ErrorRate: 0.5,
+			ErrorStatus: 502, Abort: FaultTruncate, AbortRate: 0.1,
+		}},
+		{name: "invalid latency", fault: &Fault{Latency: "soon"}, wantErr: "invalid fault latency"},
+		{name: "negative jitter", fault: &Fault{Jitter: "-1s"}, wantErr: "invalid fault jitter"},
+		{name: "negative bandwidth", fault: &Fault{Bandwidth: -1}, wantErr: "bandwidth cannot be negative"},
+		{name: "error rate too high", fault: &Fault{ErrorRate: 2}, wantErr: "error_rate must be between 0 and 1"},
+		{name: "invalid error status", fault: &Fault{ErrorRate: 1, ErrorStatus: 1000}, wantErr: "invalid fault error_status"},
+		{name: "unknown abort", fault: &Fault{Abort: "explode"}, wantErr: "unknown fault abort"},
+		{name: "abort rate without abort", fault: &Fault{AbortRate: 0.5}, wantErr: "requires an abort"},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := tc.fault.Validate()
+			if tc.wantErr != "" {
+				require.NotNil(t, err)
+				assert.Contains(t, err.Error(), tc.wantErr)
+				return
+			}
+			assert.Nil(t, err)
+		})
+	}
+}
+
+func TestParseRoutesFault(t *testing.T) {
+	t.Parallel()
+
+	root := newReloadRoot(t, `
+route {
+  host = "example.com"
+  path = "/flaky"
+  type = "http"
+
+  fault {
+    latency    = "200ms"
+    error_rate = 0.25
+    abort      = "reset"
+    abort_rate = 0.1
+  }
+}
+`)
+
+	rc, err := ParseRoutes(filepath.Join(root, "routes.hcl"))
+	require.Nil(t, err)
+	require.Len(t, rc, 1)
+	require.NotNil(t, rc[0].Fault)
+	assert.Equal(t, 200*time.Millisecond, rc[0].Fault.latency)
+	assert.Equal(t, 0.25, rc[0].Fault.ErrorRate)
+	assert.Equal(t, FaultReset, rc[0].Fault.Abort)
+}
+
+func TestProxyServerFaults(t *testing.T) {
+	body := "Hello, World!\n"
+
+	tcs := []struct {
+		name        string
+		fault       *Fault
+		wantCode    int
+		wantBody    string
+		wantErr     bool
+		wantFault   string
+		minDuration time.Duration
+	}{
+		{
+			name:        "latency",
+			fault:       &Fault{Latency: "100ms", Jitter: "50ms"},
+			wantCode:    http.StatusOK,
+			wantBody:    body,
+			minDuration: 100 * time.Millisecond,
+		},
+		{
+			name:        "bandwidth",
+			fault:       &Fault{Bandwidth: 50},
+			wantCode:    http.StatusOK,
+			wantBody:    body,
+			minDuration: 200 * time.Millisecond,
+		},
+		{
+			name:      "error",
+			fault:     &Fault{ErrorRate: 1, ErrorStatus: http.StatusBadGateway},
+			wantCode:  http.StatusBadGateway,
+			wantBody:  "mock-proxy: injected fault\n",
+			wantFault: FaultError,
+		},
+		{
+			name:      "reset",
+			fault:     &Fault{Abort: FaultReset},
+			wantErr:   true,
+			wantFault: FaultReset,
+		},
+		{
+			name:      "truncate",
+			fault:     &Fault{Abort: FaultTruncate},
+			wantErr:   true,
+			wantFault: FaultTruncate,
+		},
+		{
+			name:      "hang",
+			fault:     &Fault{Abort: FaultHang},
+			wantErr:   true,
+			wantFault: FaultHang,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ps, err := NewProxyServer(WithMockRoot("testdata/"))
+			require.Nil(t, err)
+			defer ps.Close()
+
+			require.Nil(t, ps.AddRoute(&Route{
+				ID:    "flaky",
+				Host:  "flaky.example.com",
+				Path:  "/hello",
+				Type:  "http",
+				Body:  strPtr(body),
+				Fault: tc.fault,
+			}))
+
+			client := ps.Client()
+			client.Timeout = time.Second
+
+			start := time.Now()
+			resp, err := client.Get("http://flaky.example.com/hello")
+			if err == nil {
+				var b []byte
+				b, err = ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err == nil {
+					assert.Equal(t, tc.wantCode, resp.StatusCode)
+					assert.Equal(t, tc.wantBody, string(b))
+				}
+			}
+
+			if tc.wantErr {
+				assert.NotNil(t, err)
+			} else {
+				require.Nil(t, err)
+				assert.True(t, time.Since(start) >= tc.minDuration, time.Since(start))
+			}
+
+			// Wait for the journal, as an aborted response may still be
+			// finishing.
+			require.Eventually(t, func() bool {
+				return len(ps.Requests(JournalFilter{})) == 1
+			}, 2*time.Second, 10*time.Millisecond)
+			assert.Equal(t, tc.wantFault, ps.Requests(JournalFilter{})[0].Fault)
+		})
+	}
+}
+
+func TestMockServerInterceptionFaultAbort(t *testing.T) {
+	body := "Hello, World!\n"
+
+	tcs := []struct {
+		name     string
+		abort    string
+		wantCode int
+		wantBody string
+	}{
+		{name: "reset", abort: FaultReset, wantCode: http.StatusInternalServerError},
+		{name: "truncate", abort: FaultTruncate, wantCode: http.StatusOK, wantBody: body[:len(body)/2]},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ms, err := NewMockServer(WithMockRoot("testdata/"))
+			require.Nil(t, err)
+			require.Nil(t, ms.AddRoute(&Route{
+				Host:  "flaky.example.com",
+				Path:  "/hello",
+				Type:  "http",
+				Body:  strPtr(body),
+				Fault: &Fault{Abort: tc.abort},
+			}))
+
+			req, err := http.NewRequest(http.MethodGet, "http://flaky.example.com/hello", nil)
+			require.Nil(t, err)
+
+			// There is no connection to hijack over ICAP, which must not
+			// panic.
+			recorder := newICAPRecorder()
+			require.NotPanics(t, func() {
+				ms.interception(recorder, &icap.Request{Method: "REQMOD", Request: req})
+			})
+			assert.Equal(t, tc.wantCode, recorder.code)
+			assert.Equal(t, tc.wantBody, recorder.body.String())
+		})
+	}
+}
+
+func TestMockServerFaultsHandler(t *testing.T) {
+	t.Parallel()
+
+	ms, err := NewMockServer(WithMockRoot("testdata/"))
+	require.Nil(t, err)
+	require.Nil(t, ms.AddRoute(&Route{
+		ID:    "flaky",
+		Host:  "flaky.example.com",
+		Path:  "/hello",
+		Type:  "http",
+		Body:  strPtr("Hello, World!\n"),
+		Fault: &Fault{ErrorRate: 1},
+	}))
+
+	serve := func() int {
+		return doAPI(t, ms.mockHandler, http.MethodGet, "http://flaky.example.com/hello", "").Code
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, serve())
+
+	// Faults can be disabled, and enabled again.
+	res := doAPI(t, ms.faultsHandler, http.MethodPut, "/faults", `{"enabled": false}`)
+	require.Equal(t, http.StatusOK, res.Code, res.Body.String())
+	assert.Equal(t, http.StatusOK, serve())
+	res = doAPI(t, ms.faultsHandler, http.MethodPut, "/faults", `{"enabled": true}`)
+	require.Equal(t, http.StatusOK, res.Code, res.Body.String())
+	assert.Equal(t, http.StatusServiceUnavailable, serve())
+
+	// The fault of a route can be overridden.
+	res = doAPI(t, ms.faultsHandler, http.MethodPut, "/faults/flaky", `{"error_rate": 1, "error_status": 429}`)
+	require.Equal(t, http.StatusOK, res.Code, res.Body.String())
+	assert.Equal(t, http.StatusTooManyRequests, serve())
+
+	res = doAPI(t, ms.faultsHandler, http.MethodGet, "/faults", "")
+	require.Equal(t, http.StatusOK, res.Code)
+	state := FaultState{}
+	require.Nil(t, json.Unmarshal(res.Body.Bytes(), &state))
+	assert.True(t, state.Enabled)
+	require.Contains(t, state.Routes, "flaky")
+	assert.Equal(t, 429, state.Routes["flaky"].ErrorStatus)
+
+	res = doAPI(t, ms.faultsHandler, http.MethodPut, "/faults/flaky", `{}`)
+	require.Equal(t, http.StatusOK, res.Code, res.Body.String())
+	assert.Equal(t, http.StatusOK, serve())
+
+	// Removing the override restores the fault of the route.
+	res = doAPI(t, ms.faultsHandler, http.MethodDelete, "/faults/flaky", "")
+	require.Equal(t, http.StatusNoContent, res.Code)
+	assert.Equal(t, http.StatusServiceUnavailable, serve())
+
+	// Errors.
+	res = doAPI(t, ms.faultsHandler, http.MethodPut, "/faults/missing", `{}`)
+	assert.Equal(t, http.StatusNotFound, res.Code)
+	res = doAPI(t, ms.faultsHandler, http.MethodPut, "/faults/flaky", `{"abort": "explode"}`)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	res = doAPI(t, ms.faultsHandler, http.MethodPut, "/faults", `{}`)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+
+	res = doAPI(t, ms.faultsHandler, http.MethodDelete, "/faults", "")
+	require.Equal(t, http.StatusNoContent, res.Code)
+	assert.Equal(t, FaultState{Enabled: true, Routes: map[string]*Fault{}}, ms.Faults())
+}
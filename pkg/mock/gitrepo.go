@@ -0,0 +1,586 @@
+package mock
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	gopath "path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hclparse"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	gitmemory "gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+// repoFileName is the file in the directory of a git mock that describes the
+// history of the repository built from it. It isn't part of any commit.
+const repoFileName = "repo.hcl"
+
+// defaultGitSignature is the author, committer and date of built commits,
+// unless the repo file says otherwise. It is fixed, so the hashes of built
+// commits only depend on the mock files.
+var defaultGitSignature = object.Signature{
+	Name:  "mock-proxy",
+	Email: "mock-proxy@example.com",
+	When:  time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC),
+}
+
+// defaultGitBranch is the branch of a built repository without branches, and
+// its HEAD.
+const defaultGitBranch = "main"
+
+// signaturePattern matches a git signature, like "Jane Doe <jane@example.com>".
+var signaturePattern = regexp.MustCompile(`\A\s*(.*?)\s*<([^<>]*)>\s*\z`)
+
+// repoHCL describes the history of a git mock repository, in a repo file.
+//   head = "main"
+//
+//   commit "initial" {
+//     message = "Initial commit"
+//     files   = "v1"
+//   }
+//
+//   commit "release" {
+//     message = "Release 1.0.0"
+//     author  = "Jane Doe <jane@example.com>"
+//     date    = "2021-06-01T12:00:00Z"
+//     remove  = ["TODO.md"]
+//
+//     file "CHANGELOG.md" {
+//       content = "## 1.0.0\n"
+//     }
+//   }
+//
+//   branch "main" {
+//     commit = "release"
+//   }
+//
+//   tag "v1.0.0" {
+//     commit  = "release"
+//     message = "Release 1.0.0"
+//   }
+type repoHCL struct {
+	Head     string       `hcl:"head,optional"`
+	Commits  []*commitHCL `hcl:"commit,block"`
+	Branches []*branchHCL `hcl:"branch,block"`
+	Tags     []*gitTagHCL `hcl:"tag,block"`
+}
+
+// commitHCL describes a commit. Its files are those of its first parent, then
+// the files in the Files directory, which is relative to and inside of the
+// directory of the repo file, then the File blocks, less the Remove paths.
+// Its parents are the commit before it, unless Parents says otherwise.
+type commitHCL struct {
+	ID      string     `hcl:"id,label"`
+	Message string     `hcl:"message"`
+	Author  string     `hcl:"author,optional"`
+	Date    string     `hcl:"date,optional"`
+	Parents *[]string  `hcl:"parents,optional"`
+	Files   string     `hcl:"files,optional"`
+	File    []*fileHCL `hcl:"file,block"`
+	Remove  []string   `hcl:"remove,optional"`
+}
+
+// fileHCL is a file of a commit, given inline.
+type fileHCL struct {
+	Path       string `hcl:"path,label"`
+	Content    string `hcl:"content"`
+	Executable bool   `hcl:"executable,optional"`
+}
+
+// branchHCL points a branch at a commit.
+type branchHCL struct {
+	Name   string `hcl:"name,label"`
+	Commit string `hcl:"commit"`
+}
+
+// gitTagHCL points a tag at a commit. Tags with a message are annotated.
+type gitTagHCL struct {
+	Name    string `hcl:"name,label"`
+	Commit  string `hcl:"commit"`
+	Message string `hcl:"message,optional"`
+}
+
+// gitRepo returns the in-memory repository of a git Route, at the path given
+// by ParseURL, when it is built from a plain directory, building and caching
+// it the first time it is needed. It returns nil when the Route's repository
+// is a git repository on disk.
+func (ms *MockServer) gitRepo(path string) (*gitmemory.Storage, error) {
+	ms.mu.RLock()
+	repo, ok := ms.gitRepos[path]
+	ms.mu.RUnlock()
+	if ok {
+		return repo, nil
+	}
+
+	repo, err := buildGitRepo(ms.mockFilesRoot, path)
+	if err != nil {
+		return nil, err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if existing, ok := ms.gitRepos[path]; ok {
+		return existing, nil
+	}
+	ms.gitRepos[path] = repo
+	return repo, nil
+}
+
+// buildGitRepos builds the repositories of the git Routes in a RouteConfig,
+// keyed by their path, so that mistakes in git mocks are found when the
+// routes file is loaded rather than when the repositories are cloned.
+func (ms *MockServer) buildGitRepos(rc RouteConfig) (map[string]*gitmemory.Storage, error) {
+	repos := map[string]*gitmemory.Storage{}
+	for _, route := range rc {
+		if route.Type != "git" {
+			continue
+		}
+
+		path, _, err := route.ParseURL(&url.URL{Path: route.Path})
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := repos[path]; ok {
+			continue
+		}
+
+		repo, err := buildGitRepo(ms.mockFilesRoot, path)
+		if err != nil {
+			return nil, fmt.Errorf("error building git repo for route %s%s: %w",
+				route.Host, route.Path, err)
+		}
+		repos[path] = repo
+	}
+	return repos, nil
+}
+
+// buildGitRepo builds a repository, at a path given by ParseURL, from the
+// plain directory holding it in the mock file directory. A directory with a
+// repo file gets the history it describes, and any other directory gets a
+// single commit of its files on main. It returns nil if there is a git
+// repository on disk instead, or no directory at all.
+func buildGitRepo(mockRoot, path string) (*gitmemory.Storage, error) {
+	gitDir := filepath.Join(mockRoot, filepath.FromSlash(path))
+	if _, err := os.Stat(gitDir); err == nil {
+		return nil, nil
+	}
+	dir := filepath.Dir(gitDir)
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return nil, nil
+	}
+	// The files of commits are checked to be inside of dir once symbolic
+	// links are followed, so dir is too.
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading repo directory: %w", err)
+	}
+
+	repo := &repoHCL{
+		Commits: []*commitHCL{{ID: "initial", Message: "Initial commit", Files: "."}},
+	}
+	if _, err := os.Stat(filepath.Join(dir, repoFileName)); err == nil {
+		if repo, err = parseRepo(filepath.Join(dir, repoFileName)); err != nil {
+			return nil, err
+		}
+	}
+
+	rb := &repoBuilder{
+		dir:     dir,
+		sto:     gitmemory.NewStorage(),
+		commits: map[string]plumbing.Hash{},
+		files:   map[string]map[string]gitFile{},
+		dates:   map[string]time.Time{},
+	}
+	if err := rb.build(repo); err != nil {
+		return nil, err
+	}
+	return rb.sto, nil
+}
+
+// parseRepo parses a repo file, using HCL2.
+func parseRepo(inFile string) (*repoHCL, error) {
+	src, err := ioutil.ReadFile(inFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading repo file: %w", err)
+	}
+
+	srcHCL, diag := hclparse.NewParser().ParseHCL(src, inFile)
+	if diag.HasErrors() {
+		return nil, fmt.Errorf("error parsing repo file: %w", diag)
+	}
+
+	repo := &repoHCL{}
+	if diag := gohcl.DecodeBody(srcHCL.Body, nil, repo); diag.HasErrors() {
+		return nil, fmt.Errorf("error decoding repo file: %w", diag)
+	}
+	return repo, nil
+}
+
+// gitFile is a file of a built commit.
+type gitFile struct {
+	mode    filemode.FileMode
+	content []byte
+}
+
+// repoBuilder builds an in-memory repository from a repo file.
+type repoBuilder struct {
+	dir string
+	sto *gitmemory.Storage
+
+	// commits, files and dates hold the hash, files and date of each commit
+	// built so far, by ID.
+	commits map[string]plumbing.Hash
+	files   map[string]map[string]gitFile
+	dates   map[string]time.Time
+}
+
+// build builds the commits, branches and tags of a repo file, in order.
+func (rb *repoBuilder) build(repo *repoHCL) error {
+	if len(repo.Commits) == 0 {
+		return fmt.Errorf("repo requires a commit")
+	}
+
+	previous := ""
+	for _, c := range repo.Commits {
+		if _, ok := rb.commits[c.ID]; ok {
+			return fmt.Errorf("duplicate commit %q", c.ID)
+		}
+		if err := rb.commit(c, previous); err != nil {
+			return fmt.Errorf("error building commit %q: %w", c.ID, err)
+		}
+		previous = c.ID
+	}
+
+	branches := repo.Branches
+	if len(branches) == 0 {
+		branches = []*branchHCL{{Name: defaultGitBranch, Commit: previous}}
+	}
+	names := make([]string, 0, len(branches))
+	for _, b := range branches {
+		h, ok := rb.commits[b.Commit]
+		if !ok {
+			return fmt.Errorf("branch %q points at unknown commit %q", b.Name, b.Commit)
+		}
+		if err := rb.sto.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName(b.Name), h)); err != nil {
+			return err
+		}
+		names = append(names, b.Name)
+	}
+
+	for _, t := range repo.Tags {
+		if err := rb.tag(t); err != nil {
+			return fmt.Errorf("error building tag %q: %w", t.Name, err)
+		}
+	}
+
+	// HEAD is main when there is a main branch, and otherwise the first
+	// branch in name order.
+	head := repo.Head
+	if head == "" {
+		sort.Strings(names)
+		head = names[0]
+		for _, name := range names {
+			if name == defaultGitBranch {
+				head = name
+			}
+		}
+	}
+	if _, err := rb.sto.Reference(plumbing.NewBranchReferenceName(head)); err != nil {
+		return fmt.Errorf("head %q isn't a branch", head)
+	}
+	return rb.sto.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.NewBranchReferenceName(head)))
+}
+
+// commit builds a commit, which follows the previous commit unless it says
+// otherwise.
+func (rb *repoBuilder) commit(c *commitHCL, previous string) error {
+	parents := []string{}
+	switch {
+	case c.Parents != nil:
+		parents = *c.Parents
+	case previous != "":
+		parents = []string{previous}
+	}
+
+	commit := &object.Commit{
+		Author:  defaultGitSignature,
+		Message: c.Message,
+	}
+	files := map[string]gitFile{}
+	for i, parent := range parents {
+		h, ok := rb.commits[parent]
+		if !ok {
+			return fmt.Errorf("unknown parent %q", parent)
+		}
+		commit.ParentHashes = append(commit.ParentHashes, h)
+		if i == 0 {
+			for path, f := range rb.files[parent] {
+				files[path] = f
+			}
+			commit.Author.When = rb.dates[parent]
+		}
+	}
+
+	if c.Author != "" {
+		m := signaturePattern.FindStringSubmatch(c.Author)
+		if m == nil {
+			return fmt.Errorf("invalid author %q, want \"Name <email>\"", c.Author)
+		}
+		commit.Author.Name, commit.Author.Email = m[1], m[2]
+	}
+	if c.Date != "" {
+		date, err := time.Parse(time.RFC3339, c.Date)
+		if err != nil {
+			return fmt.Errorf("invalid date %q: %w", c.Date, err)
+		}
+		commit.Author.When = date
+	}
+	commit.Committer = commit.Author
+
+	if c.Files != "" {
+		dir, err := rb.filesDir(c.Files)
+		if err != nil {
+			return err
+		}
+		if err := readFiles(dir, rb.dir, files); err != nil {
+			return err
+		}
+	}
+	for _, f := range c.File {
+		path, err := cleanRepoPath(f.Path)
+		if err != nil {
+			return err
+		}
+		mode := filemode.Regular
+		if f.Executable {
+			mode = filemode.Executable
+		}
+		files[path] = gitFile{mode: mode, content: []byte(f.Content)}
+	}
+	for _, p := range c.Remove {
+		path, err := cleanRepoPath(p)
+		if err != nil {
+			return err
+		}
+		removed := false
+		for name := range files {
+			if name == path || strings.HasPrefix(name, path+"/") {
+				delete(files, name)
+				removed = true
+			}
+		}
+		if !removed {
+			return fmt.Errorf("can't remove missing file %q", p)
+		}
+	}
+
+	var err error
+	if commit.TreeHash, err = rb.tree(files, ""); err != nil {
+		return err
+	}
+	h, err := rb.store(commit)
+	if err != nil {
+		return err
+	}
+
+	rb.commits[c.ID] = h
+	rb.files[c.ID] = files
+	rb.dates[c.ID] = commit.Committer.When
+	return nil
+}
+
+// filesDir returns the directory of the files of a commit, which must be
+// inside the directory of the repo file, even once symbolic links are
+// followed, so that a repo file can't serve anything else on disk.
+func (rb *repoBuilder) filesDir(files string) (string, error) {
+	if files != "." {
+		if _, err := cleanRepoPath(files); err != nil {
+			return "", fmt.Errorf("invalid files directory %q", files)
+		}
+	}
+
+	dir, err := filepath.EvalSymlinks(filepath.Join(rb.dir, filepath.FromSlash(files)))
+	if err != nil {
+		return "", fmt.Errorf("error reading files: %w", err)
+	}
+	if dir != rb.dir && !strings.HasPrefix(dir, rb.dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid files directory %q, it is outside of the repo", files)
+	}
+	return dir, nil
+}
+
+// tag builds a tag, which is annotated when it has a message. The tagger is
+// the committer of the tagged commit.
+func (rb *repoBuilder) tag(t *gitTagHCL) error {
+	h, ok := rb.commits[t.Commit]
+	if !ok {
+		return fmt.Errorf("unknown commit %q", t.Commit)
+	}
+
+	if t.Message != "" {
+		c, err := object.GetCommit(rb.sto, h)
+		if err != nil {
+			return err
+		}
+		tag := &object.Tag{
+			Name:       t.Name,
+			Tagger:     c.Committer,
+			Message:    t.Message,
+			TargetType: plumbing.CommitObject,
+			Target:     h,
+		}
+		if h, err = rb.store(tag); err != nil {
+			return err
+		}
+	}
+	return rb.sto.SetReference(plumbing.NewHashReference(plumbing.NewTagReferenceName(t.Name), h))
+}
+
+// tree builds the tree of the files at a path, after the trees in it.
+func (rb *repoBuilder) tree(files map[string]gitFile, path string) (plumbing.Hash, error) {
+	tree := &object.Tree{}
+	subtrees := map[string]map[string]gitFile{}
+	for name, f := range files {
+		if i := strings.IndexByte(name, '/'); i >= 0 {
+			dir := name[:i]
+			if subtrees[dir] == nil {
+				subtrees[dir] = map[string]gitFile{}
+			}
+			subtrees[dir][name[i+1:]] = f
+			continue
+		}
+
+		h, err := rb.blob(f.content)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		tree.Entries = append(tree.Entries, object.TreeEntry{Name: name, Mode: f.mode, Hash: h})
+	}
+
+	for dir, subtree := range subtrees {
+		if _, ok := files[dir]; ok {
+			return plumbing.ZeroHash, fmt.Errorf("%q is both a file and a directory", gopath.Join(path, dir))
+		}
+		h, err := rb.tree(subtree, gopath.Join(path, dir))
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		tree.Entries = append(tree.Entries, object.TreeEntry{Name: dir, Mode: filemode.Dir, Hash: h})
+	}
+
+	// git sorts the entries of a tree as if the names of trees ended in a
+	// slash.
+	sortName := func(e object.TreeEntry) string {
+		if e.Mode == filemode.Dir {
+			return e.Name + "/"
+		}
+		return e.Name
+	}
+	sort.Slice(tree.Entries, func(i, j int) bool {
+		return sortName(tree.Entries[i]) < sortName(tree.Entries[j])
+	})
+	return rb.store(tree)
+}
+
+// blob stores the content of a file.
+func (rb *repoBuilder) blob(content []byte) (plumbing.Hash, error) {
+	blob := rb.sto.NewEncodedObject()
+	blob.SetType(plumbing.BlobObject)
+	w, err := blob.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if _, err := w.Write(content); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if err := w.Close(); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return rb.sto.SetEncodedObject(blob)
+}
+
+// store encodes a built commit, tag or tree into the repository.
+func (rb *repoBuilder) store(o interface {
+	Encode(plumbing.EncodedObject) error
+}) (plumbing.Hash, error) {
+	obj := rb.sto.NewEncodedObject()
+	if err := o.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return rb.sto.SetEncodedObject(obj)
+}
+
+// readFiles reads the files in a directory into files, by their path in the
+// directory, leaving out git directories and the repo file of the repository
+// in repoDir. Symbolic links are read as links, and empty directories are
+// left out, like git does.
+func readFiles(dir, repoDir string, files map[string]gitFile) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("error reading files: %w", err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("error reading files: %s isn't a directory", dir)
+	}
+
+	repoFile := filepath.Join(repoDir, repoFileName)
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("error reading files: %w", err)
+		}
+		if fi.Name() == ".git" {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if path == repoFile {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return fmt.Errorf("error reading %s: %w", name, err)
+			}
+			files[name] = gitFile{mode: filemode.Symlink, content: []byte(filepath.ToSlash(target))}
+		case fi.Mode().IsRegular():
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("error reading %s: %w", name, err)
+			}
+			mode := filemode.Regular
+			if fi.Mode()&0111 != 0 {
+				mode = filemode.Executable
+			}
+			files[name] = gitFile{mode: mode, content: content}
+		}
+		return nil
+	})
+}
+
+// cleanRepoPath checks that the path of a file in a repo file is a relative
+// path within the repository, returning it cleaned.
+func cleanRepoPath(p string) (string, error) {
+	path := gopath.Clean(p)
+	if path == "." || gopath.IsAbs(path) || path == ".." || strings.HasPrefix(path, "../") {
+		return "", fmt.Errorf("invalid file path %q", p)
+	}
+	return path, nil
+}
@@ -0,0 +1,404 @@
+package mock
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeMockFiles writes files, by path, into a directory.
+func writeMockFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+}
+
+const builtRepoRoutes = `
+route {
+  host = "example.com"
+  path = "/repo"
+  type = "git"
+}
+`
+
+func TestProxyServerBuiltGitRepo(t *testing.T) {
+	t.Parallel()
+	requireGit(t)
+
+	root := newReloadRoot(t, builtRepoRoutes)
+	repo := filepath.Join(root, "git", "example.com", "repo")
+	writeMockFiles(t, repo, map[string]string{
+		"README.md":     "# mock\n",
+		"docs/index.md": "# docs\n",
+		"bin/build":     "#!/bin/sh\n",
+	})
+	require.Nil(t, os.Chmod(filepath.Join(repo, "bin", "build"), 0755))
+	require.Nil(t, os.MkdirAll(filepath.Join(repo, "empty"), 0755))
+
+	ps, err := NewProxyServer(WithMockRoot(root))
+	require.Nil(t, err)
+	defer ps.Close()
+
+	tmp := newReloadRoot(t, "")
+	clone := func(version, name string) string {
+		dir := filepath.Join(tmp, name)
+		mustGit(t, tmp, "-c", "protocol.version="+version, "-c", "http.proxy="+ps.URL,
+			"clone", "-q", "http://example.com/repo", dir)
+		return dir
+	}
+
+	dir := clone("0", "v0")
+	mustGit(t, dir, "fsck", "--strict")
+	assert.Equal(t, "main", mustGit(t, dir, "rev-parse", "--abbrev-ref", "HEAD"))
+	assert.Equal(t, "mock-proxy <mock-proxy@example.com> Initial commit",
+		mustGit(t, dir, "log", "--format=%an <%ae> %s"))
+	assert.Equal(t, "README.md\nbin/build\ndocs/index.md", mustGit(t, dir, "ls-tree", "-r", "--name-only", "HEAD"))
+	assert.Contains(t, mustGit(t, dir, "ls-tree", "HEAD", "bin/build"), "100755 blob")
+	assert.Contains(t, mustGit(t, dir, "ls-tree", "HEAD", "README.md"), "100644 blob")
+	_, err = os.Stat(filepath.Join(dir, "empty"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Built commits only depend on the mock files.
+	ps2, err := NewProxyServer(WithMockRoot(root))
+	require.Nil(t, err)
+	defer ps2.Close()
+	dir2 := filepath.Join(tmp, "other")
+	mustGit(t, tmp, "-c", "http.proxy="+ps2.URL, "clone", "-q", "http://example.com/repo", dir2)
+	assert.Equal(t, mustGit(t, dir, "rev-parse", "HEAD"), mustGit(t, dir2, "rev-parse", "HEAD"))
+
+	// Changes to the mock files are picked up by a reload.
+	writeMockFiles(t, repo, map[string]string{"README.md": "# mock 2\n"})
+	assert.Equal(t, "# mock", mustGit(t, clone("2", "before"), "show", "HEAD:README.md"))
+	require.Nil(t, ps.Reload())
+	assert.Equal(t, "# mock 2", mustGit(t, clone("2", "after"), "show", "HEAD:README.md"))
+}
+
+func TestProxyServerBuiltGitRepoHistory(t *testing.T) {
+	t.Parallel()
+	requireGit(t)
+
+	root := newReloadRoot(t, "")
+	repo := filepath.Join(root, "git", "example.com", "repo")
+	writeMockFiles(t, repo, map[string]string{
+		"v1/README.md": "# mock\n",
+		"v1/TODO.md":   "- release\n",
+		"repo.hcl": `
+head = "develop"
+
+commit "initial" {
+  message = "Initial commit"
+  files   = "v1"
+}
+
+commit "release" {
+  message = "Release 1.0.0"
+  author  = "Jane Doe <jane@example.com>"
+  date    = "2021-06-01T12:00:00Z"
+  remove  = ["TODO.md"]
+
+  file "CHANGELOG.md" {
+    content = "## 1.0.0\n"
+  }
+}
+
+commit "feature" {
+  message = "Add a feature"
+  parents = ["initial"]
+
+  file "bin/feature" {
+    content    = "#!/bin/sh\n"
+    executable = true
+  }
+}
+
+commit "merge" {
+  message = "Merge feature"
+  parents = ["release", "feature"]
+
+  file "bin/feature" {
+    content    = "#!/bin/sh\n"
+    executable = true
+  }
+}
+
+branch "main" {
+  commit = "release"
+}
+
+branch "develop" {
+  commit = "merge"
+}
+
+tag "v0.1.0" {
+  commit = "initial"
+}
+
+tag "v1.0.0" {
+  commit  = "release"
+  message = "Release 1.0.0"
+}
+`,
+	})
+
+	ps, err := NewProxyServer(WithMockRoot(root))
+	require.Nil(t, err)
+	defer ps.Close()
+	require.Nil(t, ps.AddRoute(&Route{Host: "example.com", Path: "/repo", Type: "git"}))
+
+	tmp := newReloadRoot(t, "")
+	dir := filepath.Join(tmp, "clone")
+	mustGit(t, tmp, "-c", "http.proxy="+ps.URL, "clone", "-q", "http://example.com/repo", dir)
+	mustGit(t, dir, "fsck", "--strict")
+
+	assert.Equal(t, "develop", mustGit(t, dir, "rev-parse", "--abbrev-ref", "HEAD"))
+	assert.Equal(t, "origin/develop\norigin/main", mustGit(t, dir, "branch", "-r", "--format=%(refname:short)", "--list", "origin/[dm]*"))
+	assert.Equal(t, "4", mustGit(t, dir, "rev-list", "--count", "HEAD"))
+	assert.Equal(t, "v1.0.0-2-g"+mustGit(t, dir, "rev-parse", "--short=7", "HEAD"), mustGit(t, dir, "describe", "--abbrev=7"))
+	assert.Equal(t, "v0.1.0", mustGit(t, dir, "describe", "--tags", "origin/main~1"))
+
+	assert.Equal(t, "Jane Doe <jane@example.com> 2021-06-01T12:00:00+00:00 Release 1.0.0",
+		mustGit(t, dir, "log", "-1", "--format=%an <%ae> %cI %s", "origin/main"))
+	assert.Equal(t, "CHANGELOG.md\nREADME.md", mustGit(t, dir, "ls-tree", "--name-only", "origin/main"))
+	assert.Contains(t, mustGit(t, dir, "ls-tree", "HEAD", "bin/feature"), "100755 blob")
+	assert.FileExists(t, filepath.Join(dir, "CHANGELOG.md"))
+}
+
+func TestMockServerBuiltGitRepoErrors(t *testing.T) {
+	tcs := []struct {
+		name    string
+		files   map[string]string
+		links   map[string]string
+		wantErr string
+	}{
+		{
+			name:    "invalid HCL",
+			files:   map[string]string{"repo.hcl": `commit "initial" {`},
+			wantErr: "error parsing repo file",
+		},
+		{
+			name:    "no commits",
+			files:   map[string]string{"repo.hcl": `head = "main"`},
+			wantErr: "repo requires a commit",
+		},
+		{
+			name: "duplicate commit",
+			files: map[string]string{"repo.hcl": `
+commit "initial" { message = "one" }
+commit "initial" { message = "two" }
+`},
+			wantErr: `duplicate commit "initial"`,
+		},
+		{
+			name: "unknown parent",
+			files: map[string]string{"repo.hcl": `
+commit "initial" {
+  message = "one"
+  parents = ["missing"]
+}
+`},
+			wantErr: `unknown parent "missing"`,
+		},
+		{
+			name: "invalid author",
+			files: map[string]string{"repo.hcl": `
+commit "initial" {
+  message = "one"
+  author  = "Jane"
+}
+`},
+			wantErr: `invalid author "Jane"`,
+		},
+		{
+			name: "invalid date",
+			files: map[string]string{"repo.hcl": `
+commit "initial" {
+  message = "one"
+  date    = "yesterday"
+}
+`},
+			wantErr: `invalid date "yesterday"`,
+		},
+		{
+			name: "missing files",
+			files: map[string]string{"repo.hcl": `
+commit "initial" {
+  message = "one"
+  files   = "v1"
+}
+`},
+			wantErr: "error reading files",
+		},
+		{
+			name: "file outside the repo",
+			files: map[string]string{"repo.hcl": `
+commit "initial" {
+  message = "one"
+  file "../escape" { content = "" }
+}
+`},
+			wantErr: `invalid file path "../escape"`,
+		},
+		{
+			name: "files outside the repo",
+			files: map[string]string{"repo.hcl": `
+commit "initial" {
+  message = "one"
+  files   = "../../.."
+}
+`},
+			wantErr: `invalid files directory "../../.."`,
+		},
+		{
+			name: "absolute files",
+			files: map[string]string{"repo.hcl": `
+commit "initial" {
+  message = "one"
+  files   = "/etc"
+}
+`},
+			wantErr: `invalid files directory "/etc"`,
+		},
+		{
+			name: "files linked outside the repo",
+			files: map[string]string{"repo.hcl": `
+commit "initial" {
+  message = "one"
+  files   = "linked"
+}
+`},
+			links:   map[string]string{"linked": "../.."},
+			wantErr: `invalid files directory "linked", it is outside of the repo`,
+		},
+		{
+			name: "remove missing file",
+			files: map[string]string{"repo.hcl": `
+commit "initial" {
+  message = "one"
+  remove  = ["README.md"]
+}
+`},
+			wantErr: `can't remove missing file "README.md"`,
+		},
+		{
+			name: "file and directory",
+			files: map[string]string{
+				"v1/docs": "",
+				"repo.hcl": `
+commit "initial" {
+  message = "one"
+  files   = "v1"
+  file "docs/index.md" { content = "" }
+}
+`,
+			},
+			wantErr: `"docs" is both a file and a directory`,
+		},
+		{
+			name: "unknown branch commit",
+			files: map[string]string{"repo.hcl": `
+commit "initial" { message = "one" }
+branch "main" { commit = "missing" }
+`},
+			wantErr: `branch "main" points at unknown commit "missing"`,
+		},
+		{
+			name: "unknown tag commit",
+			files: map[string]string{"repo.hcl": `
+commit "initial" { message = "one" }
+tag "v1.0.0" { commit = "missing" }
+`},
+			wantErr: `error building tag "v1.0.0": unknown commit "missing"`,
+		},
+		{
+			name: "unknown head",
+			files: map[string]string{"repo.hcl": `
+head = "develop"
+commit "initial" { message = "one" }
+`},
+			wantErr: `head "develop" isn't a branch`,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			root := newReloadRoot(t, builtRepoRoutes)
+			repo := filepath.Join(root, "git", "example.com", "repo")
+			writeMockFiles(t, repo, tc.files)
+			for name, target := range tc.links {
+				require.Nil(t, os.Symlink(target, filepath.Join(repo, name)))
+			}
+
+			_, err := NewMockServer(WithMockRoot(root))
+			require.NotNil(t, err)
+			assert.Contains(t, err.Error(), "invalid git mock: error building git repo for route example.com/repo")
+			assert.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
+
+func TestMockServerReloadBuiltGitRepo(t *testing.T) {
+	root := newReloadRoot(t, builtRepoRoutes)
+	repo := filepath.Join(root, "git", "example.com", "repo")
+	writeMockFiles(t, repo, map[string]string{"README.md": "# mock\n"})
+
+	ms, err := NewMockServer(WithMockRoot(root))
+	require.Nil(t, err)
+	built, err := ms.gitRepo("/git/example.com/repo/.git")
+	require.Nil(t, err)
+	require.NotNil(t, built)
+
+	// A broken git mock keeps the current routes and repositories.
+	writeMockFiles(t, repo, map[string]string{"repo.hcl": `head = "main"`})
+	err = ms.Reload()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "repo requires a commit")
+	kept, err := ms.gitRepo("/git/example.com/repo/.git")
+	require.Nil(t, err)
+	assert.True(t, built == kept)
+
+	require.Nil(t, os.Remove(filepath.Join(repo, "repo.hcl")))
+	require.Nil(t, ms.Reload())
+	rebuilt, err := ms.gitRepo("/git/example.com/repo/.git")
+	require.Nil(t, err)
+	assert.False(t, built == rebuilt)
+}
+
+func TestProxyServerBuiltGitRepoPush(t *testing.T) {
+	t.Parallel()
+	requireGit(t)
+
+	root := newReloadRoot(t, `
+route {
+  host = "example.com"
+  path = "/repo"
+  type = "git"
+  push = "apply"
+}
+`)
+	writeMockFiles(t, filepath.Join(root, "git", "example.com", "repo"), map[string]string{"README.md": "# mock\n"})
+
+	ps, err := NewProxyServer(WithMockRoot(root))
+	require.Nil(t, err)
+	defer ps.Close()
+
+	url := "http://example.com/repo"
+	dir := cloneAndCommit(t, ps, url)
+	mustGit(t, dir, "-c", "http.proxy="+ps.URL, "push", "-q", "origin", "main")
+
+	// Applied pushes last until the repository is built again.
+	out := mustGit(t, dir, "-c", "http.proxy="+ps.URL, "ls-remote", url, "refs/heads/main")
+	assert.Contains(t, out, mustGit(t, dir, "rev-parse", "HEAD"))
+
+	require.Nil(t, ps.Reload())
+	out = mustGit(t, dir, "-c", "http.proxy="+ps.URL, "ls-remote", url, "refs/heads/main")
+	assert.Contains(t, out, mustGit(t, dir, "rev-parse", "HEAD~1"))
+}
@@ -0,0 +1,336 @@
+package mock
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	gopath "path"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	gittransport "gopkg.in/src-d/go-git.v4/plumbing/transport"
+	gitserver "gopkg.in/src-d/go-git.v4/plumbing/transport/server"
+	gitmemory "gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+// gitLoader returns the loader of the repository of a git Route, at the path
+// given by ParseURL, which is either built from a plain directory or a git
+// repository on disk. The repository of a templated Route is rendered from its
+// template repository for each request, with the path parameters in
+// localTransformers and the variables of the request.
+func (ms *MockServer) gitLoader(
+	r *http.Request,
+	route *Route,
+	path string,
+	localTransformers []Transformer,
+) (gitserver.Loader, error) {
+	ep := gitEndpoint(path)
+	repo, err := ms.gitRepo(path)
+	if err != nil {
+		return nil, fmt.Errorf("error building git repo: %w", err)
+	}
+
+	var loader gitserver.Loader
+	if repo != nil {
+		ms.logger.Info("using git repo built from mock files", "path", path)
+		loader = gitserver.MapLoader{ep.String(): repo}
+	} else {
+		mockFS := ms.mockFS()
+		loader = gitserver.NewFilesystemLoader(mockFS)
+
+		fs, _ := mockFS.Chroot(ep.Path)
+		ms.logger.Info("attempting to load local git repo", "filepath", fmt.Sprintf("%+v", fs.Root()))
+	}
+
+	if len(localTransformers) == 0 {
+		return loader, nil
+	}
+
+	src, err := loader.Load(ep)
+	if err != nil {
+		return nil, fmt.Errorf("error loading template git repo: %w", err)
+	}
+
+	vars := ms.requestVariables(r, route)
+	for _, t := range localTransformers {
+		if vs, ok := t.(*VariableSubstitution); ok {
+			vars[vs.key] = vs.value
+		}
+	}
+
+	ms.logger.Info("rendering templated git repo", "variables", len(vars))
+	dst, unrendered, err := renderRepo(src, vars)
+	if err != nil {
+		return nil, err
+	}
+	if len(unrendered) != 0 {
+		ms.logger.Warn("copied files that failed to render from templated git repo",
+			"files", strings.Join(unrendered, ", "))
+	}
+	return gitserver.MapLoader{ep.String(): dst}, nil
+}
+
+// gitEndpoint returns the endpoint of the repository of a git Route, at the
+// path given by ParseURL. go-git would parse the path of a templated Route,
+// such as /git/github.com/:org/:repo/.git, as an scp-like address.
+func gitEndpoint(path string) *gittransport.Endpoint {
+	return &gittransport.Endpoint{Protocol: "file", Path: path}
+}
+
+// repoRenderer renders a template repository into a new repository. Every
+// object is rewritten, as the hashes of the objects it refers to change, and
+// the contents of text files, commit messages, tag messages, and the names and
+// emails of authors, committers and taggers are rendered as mock templates.
+//
+// The hashes of the rendered objects only depend on the template and the
+// variables, so a clone, which takes several requests, sees the same
+// repository in each, as long as the templates don't use functions like now
+// or uuid.
+type repoRenderer struct {
+	src  storer.Storer
+	dst  *gitmemory.Storage
+	vars map[string]string
+
+	// rendered maps the hashes of the template's objects to the hashes of
+	// the rendered objects.
+	rendered map[plumbing.Hash]plumbing.Hash
+
+	// unrendered holds the paths of the text files that failed to render,
+	// and were copied as they are.
+	unrendered []string
+}
+
+// renderRepo renders a template repository with variables into a new
+// in-memory repository, with the same references. It also returns the paths
+// of the text files that failed to render, and were copied as they are.
+func renderRepo(src storer.Storer, vars map[string]string) (*gitmemory.Storage, []string, error) {
+	rr := &repoRenderer{
+		src:      src,
+		dst:      gitmemory.NewStorage(),
+		vars:     vars,
+		rendered: map[plumbing.Hash]plumbing.Hash{},
+	}
+
+	refs, err := src.IterReferences()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading references: %w", err)
+	}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return rr.dst.SetReference(ref)
+		}
+
+		h, err := rr.object(ref.Hash(), ref.Name().String())
+		if err != nil {
+			return fmt.Errorf("error rendering %s: %w", ref.Name(), err)
+		}
+		return rr.dst.SetReference(plumbing.NewHashReference(ref.Name(), h))
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := rr.dst.Reference(plumbing.HEAD); err == plumbing.ErrReferenceNotFound {
+		head, err := src.Reference(plumbing.HEAD)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading HEAD: %w", err)
+		}
+		if err := rr.dst.SetReference(head); err != nil {
+			return nil, nil, err
+		}
+	}
+	return rr.dst, rr.unrendered, nil
+}
+
+// render renders content from the template repository as a mock template.
+// Unlike mocks, a lookup of a missing key, such as {{ .Values.image }} in a Helm
+// chart, is an error rather than "<no value>", so that content which isn't
+// meant for mock-proxy isn't silently mangled.
+func (rr *repoRenderer) render(name string, content []byte) ([]byte, error) {
+	tmpl, err := compileTemplate(name, content)
+	if err != nil {
+		return nil, err
+	}
+	return executeTemplate(tmpl.Option("missingkey=error"), rr.vars, nil)
+}
+
+// text renders a string from the template repository.
+func (rr *repoRenderer) text(name, s string) (string, error) {
+	b, err := rr.render(name, []byte(s))
+	if err != nil {
+		return "", fmt.Errorf("error rendering %s: %w", name, err)
+	}
+	return string(b), nil
+}
+
+// signature renders the name and email of a signature.
+func (rr *repoRenderer) signature(name string, sig object.Signature) (object.Signature, error) {
+	var err error
+	if sig.Name, err = rr.text(name+" name", sig.Name); err != nil {
+		return sig, err
+	}
+	sig.Email, err = rr.text(name+" email", sig.Email)
+	return sig, err
+}
+
+// object renders an object, returning the hash of the rendered object. The
+// name of an object, such as the path of a file, is used in errors. Objects
+// are only rendered once.
+func (rr *repoRenderer) object(h plumbing.Hash, name string) (plumbing.Hash, error) {
+	if rendered, ok := rr.rendered[h]; ok {
+		return rendered, nil
+	}
+
+	o, err := rr.src.EncodedObject(plumbing.AnyObject, h)
+	if err != nil {
+		return h, fmt.Errorf("error reading object %s: %w", h, err)
+	}
+
+	switch o.Type() {
+	case plumbing.CommitObject:
+		h, err = rr.commit(o)
+	case plumbing.TagObject:
+		h, err = rr.tag(o)
+	case plumbing.TreeObject:
+		h, err = rr.tree(o, name)
+	default:
+		h, err = rr.blob(o, name)
+	}
+	if err != nil {
+		return h, err
+	}
+
+	rr.rendered[o.Hash()] = h
+	return h, nil
+}
+
+// commit renders a commit, after its tree and parents. Signatures are dropped,
+// as they no longer match.
+func (rr *repoRenderer) commit(o plumbing.EncodedObject) (plumbing.Hash, error) {
+	c, err := object.DecodeCommit(rr.src, o)
+	if err != nil {
+		return o.Hash(), fmt.Errorf("error reading commit %s: %w", o.Hash(), err)
+	}
+
+	rendered := &object.Commit{ParentHashes: make([]plumbing.Hash, 0, len(c.ParentHashes))}
+	if rendered.TreeHash, err = rr.object(c.TreeHash, ""); err != nil {
+		return o.Hash(), err
+	}
+	for _, parent := range c.ParentHashes {
+		h, err := rr.object(parent, parent.String())
+		if err != nil {
+			return o.Hash(), err
+		}
+		rendered.ParentHashes = append(rendered.ParentHashes, h)
+	}
+
+	name := fmt.Sprintf("commit %s", o.Hash())
+	if rendered.Author, err = rr.signature(name+" author", c.Author); err != nil {
+		return o.Hash(), err
+	}
+	if rendered.Committer, err = rr.signature(name+" committer", c.Committer); err != nil {
+		return o.Hash(), err
+	}
+	if rendered.Message, err = rr.text(name+" message", c.Message); err != nil {
+		return o.Hash(), err
+	}
+	return rr.store(rendered)
+}
+
+// tag renders an annotated tag, after its target. Signatures are dropped, as
+// they no longer match.
+func (rr *repoRenderer) tag(o plumbing.EncodedObject) (plumbing.Hash, error) {
+	t, err := object.DecodeTag(rr.src, o)
+	if err != nil {
+		return o.Hash(), fmt.Errorf("error reading tag %s: %w", o.Hash(), err)
+	}
+
+	rendered := &object.Tag{Name: t.Name, TargetType: t.TargetType}
+	if rendered.Target, err = rr.object(t.Target, t.Target.String()); err != nil {
+		return o.Hash(), err
+	}
+
+	name := fmt.Sprintf("tag %s", t.Name)
+	if rendered.Tagger, err = rr.signature(name+" tagger", t.Tagger); err != nil {
+		return o.Hash(), err
+	}
+	if rendered.Message, err = rr.text(name+" message", t.Message); err != nil {
+		return o.Hash(), err
+	}
+	return rr.store(rendered)
+}
+
+// tree renders a tree at a path, after the files and trees in it, leaving
+// submodules alone.
+func (rr *repoRenderer) tree(o plumbing.EncodedObject, path string) (plumbing.Hash, error) {
+	t, err := object.DecodeTree(rr.src, o)
+	if err != nil {
+		return o.Hash(), fmt.Errorf("error reading tree %s: %w", o.Hash(), err)
+	}
+
+	rendered := &object.Tree{Entries: make([]object.TreeEntry, 0, len(t.Entries))}
+	for _, entry := range t.Entries {
+		if entry.Mode != filemode.Submodule {
+			if entry.Hash, err = rr.object(entry.Hash, gopath.Join(path, entry.Name)); err != nil {
+				return o.Hash(), err
+			}
+		}
+		rendered.Entries = append(rendered.Entries, entry)
+	}
+	return rr.store(rendered)
+}
+
+// blob renders a file as a mock template, unless it is binary or isn't a valid
+// mock template, in which case it is copied as it is.
+func (rr *repoRenderer) blob(o plumbing.EncodedObject, path string) (plumbing.Hash, error) {
+	r, err := o.Reader()
+	if err != nil {
+		return o.Hash(), fmt.Errorf("error reading %s: %w", path, err)
+	}
+	defer r.Close()
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return o.Hash(), fmt.Errorf("error reading %s: %w", path, err)
+	}
+
+	// Like git, treat content with a NUL byte in it as binary. Files often
+	// hold {{ }} that isn't meant for mock-proxy, like the expressions of
+	// GitHub Actions workflows or Helm charts, so files that fail to render
+	// are copied as they are too.
+	if !bytes.Contains(content, []byte{0}) {
+		if rendered, err := rr.render(path, content); err == nil {
+			content = rendered
+		} else {
+			rr.unrendered = append(rr.unrendered, path)
+		}
+	}
+
+	blob := rr.dst.NewEncodedObject()
+	blob.SetType(plumbing.BlobObject)
+	w, err := blob.Writer()
+	if err != nil {
+		return o.Hash(), err
+	}
+	if _, err := w.Write(content); err != nil {
+		return o.Hash(), err
+	}
+	if err := w.Close(); err != nil {
+		return o.Hash(), err
+	}
+	return rr.dst.SetEncodedObject(blob)
+}
+
+// store encodes a rendered commit, tag or tree into the rendered repository.
+func (rr *repoRenderer) store(o interface {
+	Encode(plumbing.EncodedObject) error
+}) (plumbing.Hash, error) {
+	obj := rr.dst.NewEncodedObject()
+	if err := o.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return rr.dst.SetEncodedObject(obj)
+}
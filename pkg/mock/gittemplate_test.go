@@ -0,0 +1,99 @@
+package mock
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyServerTemplatedGitRepo(t *testing.T) {
+	t.Parallel()
+
+	workflow := "on: push\njobs:\n  build:\n    steps:\n      - run: echo ${{ github.sha }}\n"
+	chart := "image: {{ .Values.image }}\n"
+
+	root, gitDir := newMockRepo(t, "example.com", "/:org/:repo")
+	work := filepath.Dir(gitDir)
+	commitFile(t, work, "README.md", "# {{ .org }}/{{ .repo }}\n\n{{ .greeting }}, {{ .missing }}\n")
+	require.Nil(t, ioutil.WriteFile(filepath.Join(work, "logo.bin"), []byte("\x00{{ .org }}"), 0644))
+	writeMockFiles(t, work, map[string]string{
+		".github/workflows/ci.yml": workflow,
+		"chart/templates/app.yaml": chart,
+	})
+	mustGit(t, work, "add", "logo.bin", ".github", "chart")
+	mustGit(t, work, "commit", "-q", "-m", "Release {{ .repo }}", "--author", "{{ .org }} bot <bot@{{ .org }}.example.com>")
+	mustGit(t, work, "tag", "-a", "v1.0.0", "-m", "{{ .repo }} 1.0.0")
+
+	ps, err := NewProxyServer(
+		WithMockRoot(root),
+		WithDefaultVariables(&VariableSubstitution{key: "greeting", value: "Hello"}),
+	)
+	require.Nil(t, err)
+	defer ps.Close()
+	require.Nil(t, ps.AddRoute(&Route{Host: "example.com", Path: "/:org/:repo", Type: "git"}))
+
+	tmp := newReloadRoot(t, "")
+	clone := func(version, repo string) string {
+		dir := filepath.Join(tmp, version, repo)
+		mustGit(t, tmp, "-c", "protocol.version="+version, "-c", "http.proxy="+ps.URL,
+			"clone", "-q", "http://example.com/"+repo, dir)
+		return dir
+	}
+
+	for _, version := range []string{"0", "2"} {
+		t.Run("protocol v"+version, func(t *testing.T) {
+			dir := clone(version, "hashicorp/mock-proxy")
+			mustGit(t, dir, "fsck", "--strict")
+
+			readme, err := ioutil.ReadFile(filepath.Join(dir, "README.md"))
+			require.Nil(t, err)
+			assert.Equal(t, "# hashicorp/mock-proxy\n\nHello, {{.missing}}\n", string(readme))
+
+			logo, err := ioutil.ReadFile(filepath.Join(dir, "logo.bin"))
+			require.Nil(t, err)
+			assert.Equal(t, "\x00{{ .org }}", string(logo))
+
+			// Files that aren't valid mock templates are copied as they are.
+			ci, err := ioutil.ReadFile(filepath.Join(dir, ".github", "workflows", "ci.yml"))
+			require.Nil(t, err)
+			assert.Equal(t, workflow, string(ci))
+			app, err := ioutil.ReadFile(filepath.Join(dir, "chart", "templates", "app.yaml"))
+			require.Nil(t, err)
+			assert.Equal(t, chart, string(app))
+
+			assert.Equal(t, "hashicorp bot <bot@hashicorp.example.com> Release mock-proxy",
+				mustGit(t, dir, "log", "-1", "--format=%an <%ae> %s"))
+			assert.Equal(t, "mock-proxy 1.0.0", mustGit(t, dir, "tag", "-l", "--format=%(contents:subject)", "v1.0.0"))
+			assert.Equal(t, "3", mustGit(t, dir, "rev-list", "--count", "HEAD"))
+		})
+	}
+
+	// The same repo is rendered the same way every time, but other repos
+	// differ.
+	first := mustGit(t, clone("0", "hashicorp/terraform"), "rev-parse", "HEAD")
+	assert.Equal(t, first, mustGit(t, clone("2", "hashicorp/terraform"), "rev-parse", "HEAD"))
+	assert.NotEqual(t, first, mustGit(t, clone("2", "hashicorp/vault"), "rev-parse", "HEAD"))
+}
+
+func TestMockServerTemplatedGitRepoErrors(t *testing.T) {
+	root, gitDir := newMockRepo(t, "example.com", "/:org/:repo")
+	mustGit(t, filepath.Dir(gitDir), "commit", "-q", "--allow-empty", "-m", "Release {{ .repo")
+
+	ms, err := NewMockServer(WithMockRoot(root))
+	require.Nil(t, err)
+	require.Nil(t, ms.AddRoute(&Route{Host: "example.com", Path: "/:org/:repo", Type: "git"}))
+
+	req := httptest.NewRequest(http.MethodGet,
+		"http://example.com/hashicorp/mock-proxy/info/refs?service=git-upload-pack", nil)
+	recorder := httptest.NewRecorder()
+	ms.mockHandler(recorder, req)
+
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "failed loading git repo")
+	assert.Contains(t, recorder.Body.String(), "message")
+}
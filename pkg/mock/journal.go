@@ -0,0 +1,221 @@
+package mock
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JournalEntry is a record of a single request that reached mock-proxy, and
+// how it was handled.
+type JournalEntry struct {
+	Time    time.Time   `json:"time"`
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Host    string      `json:"host"`
+	Path    string      `json:"path"`
+	Headers http.Header `json:"headers"`
+	Body    string      `json:"body"`
+
+	// Route is the Route that matched the request, if any.
+	Route *Route `json:"route,omitempty"`
+
+	// Status is the status code of the mocked response. Passthrough requests
+	// were allowed through to their upstream, so have no Status. Denied
+	// requests matched no Route, and were failed by the UnmatchedPolicy.
+	Status      int  `json:"status,omitempty"`
+	Passthrough bool `json:"passthrough,omitempty"`
+	Denied      bool `json:"denied,omitempty"`
+
+	// Fault is the kind of fault injected into the mocked response, if any.
+	Fault string `json:"fault,omitempty"`
+}
+
+// JournalFilter selects JournalEntries. Empty fields match every entry.
+type JournalFilter struct {
+	Host   string
+	Path   string
+	Method string
+
+	// Route matches either the ID or the path of the matched Route.
+	Route string
+}
+
+// match says if a JournalEntry is selected by a JournalFilter.
+func (f JournalFilter) match(e *JournalEntry) bool {
+	if f.Host != "" && f.Host != e.Host {
+		return false
+	}
+	if f.Path != "" && f.Path != e.Path {
+		return false
+	}
+	if f.Method != "" && !strings.EqualFold(f.Method, e.Method) {
+		return false
+	}
+	if f.Route != "" {
+		if e.Route == nil || (e.Route.ID != f.Route && e.Route.Path != f.Route) {
+			return false
+		}
+	}
+	return true
+}
+
+// journal is a bounded, in memory record of requests. Once full, the oldest
+// entries are discarded to make room for new ones.
+type journal struct {
+	mu      sync.Mutex
+	size    int
+	entries []*JournalEntry
+}
+
+// newJournal creates a journal holding at most size entries.
+func newJournal(size int) *journal {
+	return &journal{size: size, entries: []*JournalEntry{}}
+}
+
+// newJournalEntry creates a JournalEntry for a request. Reading the body
+// replaces it, so that it can still be read when handling the request.
+func newJournalEntry(r *http.Request, withBody bool) *JournalEntry {
+	host := r.URL.Host
+	if host == "" {
+		host = r.Host
+	}
+
+	entry := &JournalEntry{
+		Time:    time.Now().UTC(),
+		Method:  r.Method,
+		URL:     r.URL.String(),
+		Host:    host,
+		Path:    r.URL.Path,
+		Headers: r.Header.Clone(),
+	}
+
+	if withBody {
+		if body, err := readBody(r); err == nil {
+			entry.Body = string(body)
+		}
+	}
+
+	return entry
+}
+
+// add records a JournalEntry, discarding the oldest entry if the journal is
+// full.
+func (j *journal) add(e *JournalEntry) {
+	if j.size <= 0 {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if len(j.entries) >= j.size {
+		j.entries = append(j.entries[:0:0], j.entries[len(j.entries)-j.size+1:]...)
+	}
+	j.entries = append(j.entries, e)
+}
+
+// find returns the entries selected by a JournalFilter, oldest first.
+func (j *journal) find(f JournalFilter) []*JournalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	found := []*JournalEntry{}
+	for _, e := range j.entries {
+		if f.match(e) {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+// reset removes every entry.
+func (j *journal) reset() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.entries = []*JournalEntry{}
+}
+
+// statusWriter is an http.ResponseWriter that remembers the status code of
+// the response written to it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+// Flush, Hijack and abort pass through to the underlying http.ResponseWriter,
+// which injecting faults requires.
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	return hj.Hijack()
+}
+
+func (sw *statusWriter) abort(reset bool) error {
+	a, ok := sw.ResponseWriter.(aborter)
+	if !ok {
+		return fmt.Errorf("response writer does not support aborting")
+	}
+	return a.abort(reset)
+}
+
+// Requests returns the journalled requests selected by a JournalFilter, oldest
+// first.
+func (ms *MockServer) Requests(f JournalFilter) []*JournalEntry {
+	return ms.journal.find(f)
+}
+
+// ResetRequests empties the request journal.
+func (ms *MockServer) ResetRequests() {
+	ms.journal.reset()
+}
+
+// requestsHandler can receive a GET or DELETE request.
+//   GET) Returns a JSON list of journalled requests, optionally filtered by
+//        the host, path, method and route query parameters.
+//          curl squid.proxy/requests?host=api.github.com&route=/orgs/:org/repos
+//   DELETE) Empties the journal.
+func (ms *MockServer) requestsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		writeJSON(w, http.StatusOK, ms.Requests(JournalFilter{
+			Host:   q.Get("host"),
+			Path:   q.Get("path"),
+			Method: q.Get("method"),
+			Route:  q.Get("route"),
+		}))
+	case http.MethodDelete:
+		ms.ResetRequests()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,143 @@
+package mock
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-icap/icap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournalBounded(t *testing.T) {
+	t.Parallel()
+
+	j := newJournal(3)
+	for i := 0; i < 5; i++ {
+		j.add(&JournalEntry{Path: fmt.Sprintf("/%d", i)})
+	}
+
+	got := []string{}
+	for _, e := range j.find(JournalFilter{}) {
+		got = append(got, e.Path)
+	}
+	assert.Equal(t, []string{"/2", "/3", "/4"}, got)
+
+	j.reset()
+	assert.Empty(t, j.find(JournalFilter{}))
+}
+
+func TestJournalFilter(t *testing.T) {
+	entry := &JournalEntry{
+		Host:   "api.github.com",
+		Path:   "/orgs/hashicorp/repos",
+		Method: http.MethodGet,
+		Route:  &Route{ID: "repos", Path: "/orgs/:org/repos"},
+	}
+
+	tcs := []struct {
+		name   string
+		filter JournalFilter
+		want   bool
+	}{
+		{name: "empty", filter: JournalFilter{}, want: true},
+		{name: "host", filter: JournalFilter{Host: "api.github.com"}, want: true},
+		{name: "host miss", filter: JournalFilter{Host: "github.com"}, want: false},
+		{name: "path", filter: JournalFilter{Path: "/orgs/hashicorp/repos"}, want: true},
+		{name: "method", filter: JournalFilter{Method: "get"}, want: true},
+		{name: "method miss", filter: JournalFilter{Method: "POST"}, want: false},
+		{name: "route id", filter: JournalFilter{Route: "repos"}, want: true},
+		{name: "route path", filter: JournalFilter{Route: "/orgs/:org/repos"}, want: true},
+		{name: "route miss", filter: JournalFilter{Route: "/orgs/:org"}, want: false},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, tc.want, tc.filter.match(entry))
+		})
+	}
+}
+
+func TestMockServerJournalsRequests(t *testing.T) {
+	t.Parallel()
+
+	ms, err := NewMockServer(WithMockRoot("testdata/"), WithJournalSize(10))
+	require.Nil(t, err)
+
+	// A mocked request, which can still be read after journalling.
+	req, err := http.NewRequest(http.MethodPost, "http://example.com/graphql",
+		strings.NewReader(`{"operationName": "GetViewer"}`))
+	require.Nil(t, err)
+	req.Header.Set("X-Request-Id", "1")
+	recorder := httptest.NewRecorder()
+	ms.mockHandler(recorder, req)
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	// An unmatched request.
+	req, err = http.NewRequest(http.MethodGet, "http://example.com/missing", nil)
+	require.Nil(t, err)
+	ms.mockHandler(httptest.NewRecorder(), req)
+
+	// A request allowed through by ICAP.
+	req, err = http.NewRequest(http.MethodGet, "http://upstream.com/real", nil)
+	require.Nil(t, err)
+	ms.interception(newICAPRecorder(), &icap.Request{Method: "REQMOD", Request: req})
+
+	got := ms.Requests(JournalFilter{})
+	require.Len(t, got, 3)
+
+	assert.Equal(t, http.MethodPost, got[0].Method)
+	assert.Equal(t, "example.com", got[0].Host)
+	assert.Equal(t, "/graphql", got[0].Path)
+	assert.Equal(t, "1", got[0].Headers.Get("X-Request-Id"))
+	assert.Equal(t, `{"operationName": "GetViewer"}`, got[0].Body)
+	assert.Equal(t, "example.com/graphql/viewer.mock", got[0].Route.File)
+	assert.Equal(t, http.StatusOK, got[0].Status)
+
+	assert.Nil(t, got[1].Route)
+	assert.Equal(t, http.StatusInternalServerError, got[1].Status)
+
+	assert.Equal(t, "upstream.com", got[2].Host)
+	assert.True(t, got[2].Passthrough)
+	assert.Equal(t, 0, got[2].Status)
+}
+
+func TestMockServerRequestsHandler(t *testing.T) {
+	t.Parallel()
+
+	ms, err := NewMockServer(WithMockRoot("testdata/"))
+	require.Nil(t, err)
+
+	for _, u := range []string{
+		"http://example.com/simple",
+		"http://example.com/users/russell",
+		"http://example.com/users/barry",
+	} {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		require.Nil(t, err)
+		ms.mockHandler(httptest.NewRecorder(), req)
+	}
+
+	res := doAPI(t, ms.requestsHandler, http.MethodGet, "/requests?route=/users/:name", "")
+	require.Equal(t, http.StatusOK, res.Code)
+	var got []*JournalEntry
+	require.Nil(t, json.Unmarshal(res.Body.Bytes(), &got))
+	require.Len(t, got, 2)
+	assert.Equal(t, "/users/russell", got[0].Path)
+	assert.Equal(t, "/users/barry", got[1].Path)
+
+	res = doAPI(t, ms.requestsHandler, http.MethodGet, "/requests?path=/simple", "")
+	require.Nil(t, json.Unmarshal(res.Body.Bytes(), &got))
+	assert.Len(t, got, 1)
+
+	res = doAPI(t, ms.requestsHandler, http.MethodDelete, "/requests", "")
+	assert.Equal(t, http.StatusNoContent, res.Code)
+	assert.Empty(t, ms.Requests(JournalFilter{}))
+}
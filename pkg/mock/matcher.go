@@ -0,0 +1,187 @@
+package mock
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The supported kinds of Matcher, used as the label of a `match` block.
+const (
+	MatchHeader = "header"
+	MatchQuery  = "query"
+	MatchJSON   = "json"
+	MatchBody   = "body"
+)
+
+// Matcher is an additional constraint on a Route, checked against a part of
+// the request other than its host, path and method. A Matcher with neither
+// Equals nor Regex only checks that the header, query parameter or JSON value
+// is present.
+//   match "header" { name = "X-GitHub-Event", equals = "push" }
+//   match "query"  { name = "page", regex = "^[0-9]+$" }
+//   match "json"   { path = "$.operationName", equals = "GetRepository" }
+//   match "body"   { regex = "mutation\\s+CreateIssue" }
+type Matcher struct {
+	Kind   string  `hcl:"kind,label" json:"kind"`
+	Name   string  `hcl:"name,optional" json:"name,omitempty"`
+	Path   string  `hcl:"path,optional" json:"path,omitempty"`
+	Equals *string `hcl:"equals,optional" json:"equals,omitempty"`
+	Regex  string  `hcl:"regex,optional" json:"regex,omitempty"`
+
+	// regex is the compiled form of Regex, set by Validate.
+	regex *regexp.Regexp
+}
+
+// Validate checks that a Matcher is well formed, and compiles its regular
+// expression.
+func (m *Matcher) Validate() error {
+	switch m.Kind {
+	case MatchHeader, MatchQuery:
+		if m.Name == "" {
+			return fmt.Errorf("%s matcher requires a name", m.Kind)
+		}
+	case MatchJSON:
+		if m.Path == "" {
+			return fmt.Errorf("%s matcher requires a path", m.Kind)
+		}
+	case MatchBody:
+		if m.Equals == nil && m.Regex == "" {
+			return fmt.Errorf("%s matcher requires equals or regex", m.Kind)
+		}
+	default:
+		return fmt.Errorf("unknown matcher kind %q", m.Kind)
+	}
+
+	if m.Regex != "" {
+		re, err := regexp.Compile(m.Regex)
+		if err != nil {
+			return fmt.Errorf("invalid %s matcher regex: %w", m.Kind, err)
+		}
+		m.regex = re
+	}
+
+	return nil
+}
+
+// needsBody says if a Matcher inspects the request body.
+func (m *Matcher) needsBody() bool {
+	return m.Kind == MatchJSON || m.Kind == MatchBody
+}
+
+// match says if a Matcher accepts a request. The request body is passed
+// separately, as it can only be read from the request once.
+func (m *Matcher) match(req *http.Request, body []byte) bool {
+	switch m.Kind {
+	case MatchHeader:
+		for _, v := range req.Header[http.CanonicalHeaderKey(m.Name)] {
+			if m.matchValue(v) {
+				return true
+			}
+		}
+		return false
+	case MatchQuery:
+		for _, v := range req.URL.Query()[m.Name] {
+			if m.matchValue(v) {
+				return true
+			}
+		}
+		return false
+	case MatchJSON:
+		var doc interface{}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return false
+		}
+		v, ok := lookupJSONPath(doc, m.Path)
+		if !ok {
+			return false
+		}
+		return m.matchValue(jsonValueString(v))
+	case MatchBody:
+		return m.matchValue(string(body))
+	default:
+		return false
+	}
+}
+
+// matchValue compares a single value against Equals and Regex.
+func (m *Matcher) matchValue(v string) bool {
+	if m.Equals != nil && *m.Equals != v {
+		return false
+	}
+	if m.Regex != "" {
+		if m.regex == nil {
+			matched, err := regexp.MatchString(m.Regex, v)
+			return err == nil && matched
+		}
+		return m.regex.MatchString(v)
+	}
+	return true
+}
+
+// readBody reads the full body of a request, and replaces it so that it can
+// be read again by whatever handles the request.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return []byte{}, nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return body, nil
+}
+
+// lookupJSONPath finds a value in a decoded JSON document using a simple
+// dotted path, with an optional leading `$` and array indices in either
+// bracket or dotted form.
+//   $.data.repository.issues[0].title
+//   data.repository.issues.0.title
+func lookupJSONPath(doc interface{}, path string) (interface{}, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	path = strings.NewReplacer("[", ".", "]", "").Replace(path)
+	if path == "" {
+		return doc, true
+	}
+
+	current := doc
+	for _, segment := range strings.Split(path, ".") {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			v, ok := node[segment]
+			if !ok {
+				return nil, false
+			}
+			current = v
+		case []interface{}:
+			idx, err := strconv.Atoi(segment)
+			if err != nil || idx < 0 || idx >= len(node) {
+				return nil, false
+			}
+			current = node[idx]
+		default:
+			return nil, false
+		}
+	}
+
+	return current, true
+}
+
+// jsonValueString converts a decoded JSON value to the string a Matcher
+// compares against. Strings are used as is, anything else is re-encoded.
+func jsonValueString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
@@ -0,0 +1,196 @@
+package mock
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatcherValidate(t *testing.T) {
+	tcs := []struct {
+		name    string
+		matcher *Matcher
+		wantErr string
+	}{
+		{
+			name:    "header",
+			matcher: &Matcher{Kind: MatchHeader, Name: "X-Foo"},
+		},
+		{
+			name:    "header without name",
+			matcher: &Matcher{Kind: MatchHeader},
+			wantErr: "header matcher requires a name",
+		},
+		{
+			name:    "json without path",
+			matcher: &Matcher{Kind: MatchJSON},
+			wantErr: "json matcher requires a path",
+		},
+		{
+			name:    "body without condition",
+			matcher: &Matcher{Kind: MatchBody},
+			wantErr: "body matcher requires equals or regex",
+		},
+		{
+			name:    "invalid regex",
+			matcher: &Matcher{Kind: MatchQuery, Name: "page", Regex: "("},
+			wantErr: "invalid query matcher regex",
+		},
+		{
+			name:    "unknown kind",
+			matcher: &Matcher{Kind: "cookie"},
+			wantErr: "unknown matcher kind",
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := tc.matcher.Validate()
+			if tc.wantErr == "" {
+				require.Nil(t, err)
+			} else {
+				require.NotNil(t, err)
+				assert.Contains(t, err.Error(), tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestMatcherMatch(t *testing.T) {
+	tcs := []struct {
+		name    string
+		matcher *Matcher
+		url     string
+		headers map[string]string
+		body    string
+		want    bool
+	}{
+		{
+			name:    "header present",
+			matcher: &Matcher{Kind: MatchHeader, Name: "x-github-event"},
+			headers: map[string]string{"X-GitHub-Event": "push"},
+			want:    true,
+		},
+		{
+			name:    "header missing",
+			matcher: &Matcher{Kind: MatchHeader, Name: "X-GitHub-Event"},
+			want:    false,
+		},
+		{
+			name:    "header equals",
+			matcher: &Matcher{Kind: MatchHeader, Name: "X-GitHub-Event", Equals: strPtr("push")},
+			headers: map[string]string{"X-GitHub-Event": "release"},
+			want:    false,
+		},
+		{
+			name:    "query regex",
+			matcher: &Matcher{Kind: MatchQuery, Name: "page", Regex: "^[0-9]+$"},
+			url:     "http://example.com/?page=2",
+			want:    true,
+		},
+		{
+			name:    "query regex miss",
+			matcher: &Matcher{Kind: MatchQuery, Name: "page", Regex: "^[0-9]+$"},
+			url:     "http://example.com/?page=last",
+			want:    false,
+		},
+		{
+			name:    "query equals empty",
+			matcher: &Matcher{Kind: MatchQuery, Name: "draft", Equals: strPtr("")},
+			url:     "http://example.com/?draft=",
+			want:    true,
+		},
+		{
+			name:    "json string",
+			matcher: &Matcher{Kind: MatchJSON, Path: "$.operationName", Equals: strPtr("GetViewer")},
+			body:    `{"operationName": "GetViewer"}`,
+			want:    true,
+		},
+		{
+			name:    "json nested number",
+			matcher: &Matcher{Kind: MatchJSON, Path: "$.variables.ids[1]", Equals: strPtr("7")},
+			body:    `{"variables": {"ids": [3, 7]}}`,
+			want:    true,
+		},
+		{
+			name:    "json missing path",
+			matcher: &Matcher{Kind: MatchJSON, Path: "variables.ids.5"},
+			body:    `{"variables": {"ids": [3, 7]}}`,
+			want:    false,
+		},
+		{
+			name:    "json invalid body",
+			matcher: &Matcher{Kind: MatchJSON, Path: "operationName"},
+			body:    `operationName=GetViewer`,
+			want:    false,
+		},
+		{
+			name:    "body regex",
+			matcher: &Matcher{Kind: MatchBody, Regex: `mutation\s+CreateIssue`},
+			body:    `{"query": "mutation  CreateIssue { }"}`,
+			want:    true,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			require.Nil(t, tc.matcher.Validate())
+
+			url := "http://example.com/"
+			if tc.url != "" {
+				url = tc.url
+			}
+			req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(tc.body))
+			require.Nil(t, err)
+			for k, v := range tc.headers {
+				req.Header.Add(k, v)
+			}
+
+			assert.Equal(t, tc.want, tc.matcher.match(req, []byte(tc.body)))
+		})
+	}
+}
+
+func TestLookupJSONPath(t *testing.T) {
+	var doc interface{}
+	require.Nil(t, json.Unmarshal(
+		[]byte(`{"a": {"b": [{"c": "d"}, {"c": true}]}}`), &doc,
+	))
+
+	tcs := []struct {
+		name   string
+		path   string
+		want   string
+		wantOK bool
+	}{
+		{name: "root", path: "$", want: `{"a":{"b":[{"c":"d"},{"c":true}]}}`, wantOK: true},
+		{name: "brackets", path: "$.a.b[0].c", want: "d", wantOK: true},
+		{name: "dotted indices", path: "a.b.1.c", want: "true", wantOK: true},
+		{name: "missing key", path: "a.x", wantOK: false},
+		{name: "index out of range", path: "a.b[2]", wantOK: false},
+		{name: "index into object", path: "a.0", wantOK: false},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, ok := lookupJSONPath(doc, tc.path)
+			assert.Equal(t, tc.wantOK, ok)
+			if tc.wantOK {
+				assert.Equal(t, tc.want, jsonValueString(got))
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package mock
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WithCA is a functional option that allows the forward proxy to intercept
+// HTTPS requests, by terminating TLS with leaf certificates signed by the
+// given CA. Clients must trust the CA. Without a CA, HTTPS requests are
+// always tunnelled to their upstream.
+func WithCA(ca tls.Certificate) Option {
+	return func(m *MockServer) error {
+		if len(ca.Certificate) == 0 || ca.PrivateKey == nil {
+			return fmt.Errorf("CA requires a certificate and private key")
+		}
+		if ca.Leaf == nil {
+			leaf, err := x509.ParseCertificate(ca.Certificate[0])
+			if err != nil {
+				return fmt.Errorf("error parsing CA certificate: %w", err)
+			}
+			ca.Leaf = leaf
+		}
+		if !ca.Leaf.IsCA {
+			return fmt.Errorf("certificate %s is not a CA", ca.Leaf.Subject)
+		}
+
+		m.ca = &ca
+		m.certs = newCertCache()
+		return nil
+	}
+}
+
+// interceptHost says if HTTPS requests to a host, in the host:port form of a
+// CONNECT request, should be decrypted, which is when a Route mocks the host.
+func (ms *MockServer) interceptHost(host string) bool {
+	if ms.ca == nil {
+		return false
+	}
+
+	return ms.mockedHost(host)
+}
+
+// routeHost converts the host:port form of a CONNECT request into the form
+// used by Routes, which omits the default HTTPS port.
+func routeHost(host string) string {
+	if h, port, err := net.SplitHostPort(host); err == nil && port == "443" {
+		return h
+	}
+	return host
+}
+
+// handleConnect handles a CONNECT request to the forward proxy. Hosts that a
+// Route mocks are intercepted, and every other host is tunnelled, unless the
+// UnmatchedPolicy denies it.
+func (ms *MockServer) handleConnect(w http.ResponseWriter, r *http.Request) {
+	if ms.interceptHost(r.Host) {
+		ms.intercept(w, r)
+		return
+	}
+	if ms.denied(r) {
+		ms.deny(w, r)
+		return
+	}
+	ms.tunnel(w, r)
+}
+
+// tunnel connects the client directly to the upstream host of a CONNECT
+// request, without inspecting the traffic.
+func (ms *MockServer) tunnel(w http.ResponseWriter, r *http.Request) {
+	entry := newJournalEntry(r, false)
+	entry.Passthrough = true
+	ms.journal.add(entry)
+
+	upstream, err := net.DialTimeout("tcp", r.Host, 30*time.Second)
+	if err != nil {
+		ms.logger.Error("failed connecting upstream", "host", r.Host, "error", err.Error())
+		http.Error(w, fmt.Sprintf("failed connecting upstream: %s", err.Error()),
+			http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	conn, err := ms.hijackConnect(w)
+	if err != nil {
+		ms.logger.Error("failed hijacking connection", "error", err.Error())
+		return
+	}
+	defer conn.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(upstream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// intercept terminates TLS for the host of a CONNECT request, and serves the
+// decrypted requests as if they had been sent to the forward proxy directly.
+func (ms *MockServer) intercept(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	conn, err := ms.hijackConnect(w)
+	if err != nil {
+		ms.logger.Error("failed hijacking connection", "error", err.Error())
+		return
+	}
+
+	serverName, _, err := net.SplitHostPort(host)
+	if err != nil {
+		serverName = host
+	}
+	tlsConn := tls.Server(conn, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" {
+				return ms.certs.get(hello.ServerName, ms.leafCertificate)
+			}
+			return ms.certs.get(serverName, ms.leafCertificate)
+		},
+	})
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Scheme = "https"
+		r.URL.Host = routeHost(host)
+		ms.proxy(w, r)
+	})
+
+	// Serve the single connection, which closes the listener once it's done.
+	l := newConnListener(tlsConn)
+	_ = (&http.Server{Handler: handler}).Serve(l)
+}
+
+// hijackConnect takes over the connection of a CONNECT request, and tells the
+// client that it has been established.
+func (ms *MockServer) hijackConnect(w http.ResponseWriter) (net.Conn, error) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection cannot be hijacked", http.StatusInternalServerError)
+		return nil, fmt.Errorf("response writer does not support hijacking")
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// The client may already have sent data, which is buffered.
+	if brw.Reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: brw.Reader}, nil
+	}
+	return conn, nil
+}
+
+// leafCertificate mints a certificate for a host, signed by the CA. Minted
+// certificates are cached in ms.certs.
+func (ms *MockServer) leafCertificate(host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("error generating leaf key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("error generating leaf serial number: %w", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	if template.NotAfter.After(ms.ca.Leaf.NotAfter) {
+		template.NotAfter = ms.ca.Leaf.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ms.ca.Leaf,
+		key.Public(), ms.ca.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("error signing leaf certificate for %s: %w", host, err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing leaf certificate for %s: %w", host, err)
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ms.ca.Certificate[0]},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// bufferedConn is a net.Conn that first returns any data that was buffered
+// before it was hijacked.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(p []byte) (int, error) {
+	return bc.r.Read(p)
+}
+
+// connListener is a net.Listener that accepts a single connection, then
+// blocks until that connection is closed, so that an http.Server can serve
+// a connection that has already been accepted.
+type connListener struct {
+	conn net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	l := &connListener{done: make(chan struct{})}
+	l.conn = &closeNotifyConn{Conn: conn, closed: l.close}
+	return l
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	conn := l.conn
+	l.conn = nil
+	if conn != nil {
+		return conn, nil
+	}
+
+	<-l.done
+	return nil, io.EOF
+}
+
+func (l *connListener) close() {
+	l.once.Do(func() { close(l.done) })
+}
+
+func (l *connListener) Close() error {
+	l.close()
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// closeNotifyConn is a net.Conn that calls a function when it is closed.
+type closeNotifyConn struct {
+	net.Conn
+	closed func()
+}
+
+func (c *closeNotifyConn) Close() error {
+	err := c.Conn.Close()
+	c.closed()
+	return err
+}
@@ -0,0 +1,126 @@
+package mock
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCA creates a self signed CA for intercepting HTTPS requests.
+func newTestCA(t *testing.T) tls.Certificate {
+	return newTestCAValidFor(t, 48*time.Hour)
+}
+
+// newTestCAValidFor creates a self signed CA that expires after a duration.
+func newTestCAValidFor(t *testing.T, validity time.Duration) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mock-proxy test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.Nil(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestWithCA(t *testing.T) {
+	ca := newTestCA(t)
+
+	leaf, err := x509.ParseCertificate(ca.Certificate[0])
+	require.Nil(t, err)
+	leaf.IsCA = false
+
+	tcs := []struct {
+		name    string
+		ca      tls.Certificate
+		wantErr string
+	}{
+		{name: "valid", ca: ca},
+		{name: "empty", ca: tls.Certificate{}, wantErr: "requires a certificate and private key"},
+		{
+			name:    "not a CA",
+			ca:      tls.Certificate{Certificate: ca.Certificate, PrivateKey: ca.PrivateKey, Leaf: leaf},
+			wantErr: "is not a CA",
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := NewMockServer(WithMockRoot("testdata/"), WithCA(tc.ca))
+			if tc.wantErr == "" {
+				assert.Nil(t, err)
+			} else {
+				require.NotNil(t, err)
+				assert.Contains(t, err.Error(), tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestProxyServerHTTPS(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+
+	ps, err := NewProxyServer(WithMockRoot("testdata/"), WithCA(newTestCA(t)))
+	require.Nil(t, err)
+	defer ps.Close()
+
+	// Trust both the proxy's CA, for intercepted hosts, and the upstream's
+	// certificate, for tunnelled hosts.
+	client := ps.Client()
+	transport := client.Transport.(*http.Transport)
+	transport.TLSClientConfig.RootCAs.AddCert(upstream.Certificate())
+
+	tcs := []struct {
+		name     string
+		url      string
+		wantBody string
+	}{
+		{name: "intercepted", url: "https://example.com/users/russell", wantBody: "russell\n"},
+		{name: "tunnelled", url: upstream.URL + "/real", wantBody: "upstream"},
+	}
+
+	for _, tc := range tcs {
+		resp, err := client.Get(tc.url)
+		require.Nil(t, err, tc.name)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Nil(t, err, tc.name)
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode, tc.name)
+		assert.Equal(t, tc.wantBody, string(body), tc.name)
+	}
+
+	got := ps.Requests(JournalFilter{})
+	require.Len(t, got, 2)
+	assert.Equal(t, "https://example.com/users/russell", got[0].URL)
+	assert.Equal(t, http.MethodConnect, got[1].Method)
+	assert.True(t, got[1].Passthrough)
+}
@@ -1,33 +1,50 @@
 package mock
 
 import (
-	"context"
+	"crypto/tls"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/go-icap/icap"
 	"github.com/hashicorp/go-hclog"
+	billy "gopkg.in/src-d/go-billy.v4"
 	"gopkg.in/src-d/go-billy.v4/osfs"
-
-	gitpktline "gopkg.in/src-d/go-git.v4/plumbing/format/pktline"
-	gitcapability "gopkg.in/src-d/go-git.v4/plumbing/protocol/packp/capability"
-	gittransport "gopkg.in/src-d/go-git.v4/plumbing/transport"
-	gitserver "gopkg.in/src-d/go-git.v4/plumbing/transport/server"
+	gitmemory "gopkg.in/src-d/go-git.v4/storage/memory"
 )
 
 const (
 	DesiredStatusCodeHeader = "X-Desired-Response-Code"
+
+	// RecordHeader marks a request to be recorded while in ModeRecord, even
+	// if it matches an existing Route.
+	RecordHeader = "X-Mock-Proxy-Record"
+)
+
+// Mode controls how MockServer treats requests that it has no mock for.
+type Mode string
+
+const (
+	// ModeReplay serves mocks for requests that match a Route, and lets all
+	// other requests through to their upstream unmodified. This is the
+	// default Mode.
+	ModeReplay Mode = "replay"
+
+	// ModeRecord serves mocks like ModeReplay, but also captures the upstream
+	// response to every request that passes through, writing it out as a new
+	// mock file and Route that are then replayed.
+	ModeRecord Mode = "record"
 )
 
 // Transformer is an interface that applies some mutation to a mock response.
@@ -48,11 +65,71 @@ type Option func(*MockServer) error
 type MockServer struct {
 	mockFilesRoot string
 
-	icapPort int
-	apiPort  int
+	icapPort  int
+	apiPort   int
+	proxyPort int
+	mode      Mode
+
+	reloadInterval time.Duration
+
+	// mu guards routeConfig, which is replaced when the routes file is
+	// reloaded, and can also change at runtime while recording, and
+	// runtimeRoutes, which are managed through the API. Both are copied
+	// rather than modified in place, so readers can keep using them once
+	// mu is released.
+	mu            sync.RWMutex
+	routeConfig   RouteConfig
+	runtimeRoutes RouteConfig
+
+	// gitRepos caches the repositories built from plain directories for git
+	// Routes, by path, and is also guarded by mu. It is replaced when the
+	// routes file is reloaded, so changes to git mocks are picked up.
+	gitRepos map[string]*gitmemory.Storage
+
+	// vars holds the variable substitutions of every scope.
+	vars *variableStore
+
+	// defaultVariables are the variable substitutions given by
+	// WithDefaultVariables, which the global variables are reset to.
+	defaultVariables []*VariableSubstitution
+
+	// templates caches the compiled templates of mocks.
+	templates *templateCache
+
+	// routesModTime and routesSize describe the routes file as it was when
+	// it was last loaded, and are also guarded by mu.
+	routesModTime time.Time
+	routesSize    int64
+
+	journalSize int
+	journal     *journal
+
+	// transport forwards requests that aren't mocked to their upstream, when
+	// running as a forward proxy.
+	transport http.RoundTripper
 
-	RouteConfig  RouteConfig
-	transformers []Transformer
+	// api serves requests made directly to the forward proxy.
+	api http.Handler
+
+	// ca signs the certificates used to intercept HTTPS requests sent
+	// through the forward proxy, and certs caches those certificates.
+	ca    *tls.Certificate
+	certs *certCache
+
+	scenarios *scenarios
+	faults    *faults
+
+	// pushMu serializes the git pushes applied to mock repositories, and
+	// keeps other git requests from reading a repository while a push is
+	// applied to it.
+	pushMu sync.RWMutex
+
+	// unmatchedPolicy decides which requests that don't match a Route are
+	// denied, rather than let through, and the denied response to send.
+	unmatchedPolicy UnmatchedPolicy
+	deniedHosts     []string
+	deniedStatus    int
+	deniedBody      string
 
 	logger hclog.Logger
 }
@@ -65,6 +142,19 @@ func NewMockServer(options ...Option) (*MockServer, error) {
 
 		icapPort: 11344,
 		apiPort:  80,
+		mode:     ModeReplay,
+
+		reloadInterval: 2 * time.Second,
+
+		journalSize: 1000,
+
+		templates: newTemplateCache(),
+		vars:      newVariableStore(),
+
+		transport: newTransport(),
+
+		unmatchedPolicy: UnmatchedAllow,
+		deniedStatus:    http.StatusForbidden,
 
 		logger: hclog.NewNullLogger(),
 	}
@@ -75,6 +165,11 @@ func NewMockServer(options ...Option) (*MockServer, error) {
 		}
 	}
 
+	ms.journal = newJournal(ms.journalSize)
+	ms.scenarios = newScenarios()
+	ms.faults = newFaults()
+	ms.api = ms.APIHandler()
+
 	_, err := os.Open(ms.mockFilesRoot)
 	if err != nil {
 		return nil, fmt.Errorf(
@@ -82,18 +177,42 @@ func NewMockServer(options ...Option) (*MockServer, error) {
 		)
 	}
 
-	rc, err := ParseRoutes(filepath.Join(ms.mockFilesRoot, "routes.hcl"))
+	ms.statRoutes()
+	rc, err := ParseRoutes(ms.routesFile())
 	if err != nil {
 		return nil, fmt.Errorf(
-			"invalid mock routes file %s: %w",
-			filepath.Join(ms.mockFilesRoot, "routes.hcl"), err,
+			"invalid mock routes file %s: %w", ms.routesFile(), err,
 		)
 	}
-	ms.RouteConfig = rc
+	repos, err := ms.buildGitRepos(rc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid git mock: %w", err)
+	}
+	ms.routeConfig, ms.gitRepos = rc, repos
 
 	return ms, nil
 }
 
+// routesFile returns the path of the routes file in the mock file directory.
+func (ms *MockServer) routesFile() string {
+	return filepath.Join(ms.mockFilesRoot, "routes.hcl")
+}
+
+// Routes returns the RouteConfig currently in use, which is made up of the
+// routes from the routes file followed by any routes added through the API.
+func (ms *MockServer) Routes() RouteConfig {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	if len(ms.runtimeRoutes) == 0 {
+		return ms.routeConfig
+	}
+
+	rc := make(RouteConfig, 0, len(ms.routeConfig)+len(ms.runtimeRoutes))
+	rc = append(rc, ms.routeConfig...)
+	return append(rc, ms.runtimeRoutes...)
+}
+
 // WithMockRoot is a functional option that changes where MockServer looks for
 // mock files.
 func WithMockRoot(root string) Option {
@@ -110,11 +229,71 @@ func WithDefaultVariables(vars ...*VariableSubstitution) Option {
 	return func(m *MockServer) error {
 		for _, v := range vars {
 			m.addVariableSubstitution(v)
+			m.defaultVariables = append(m.defaultVariables, v)
 		}
 		return nil
 	}
 }
 
+// WithMode is a functional option that sets how the Mock server treats
+// requests that it has no mock for.
+func WithMode(mode Mode) Option {
+	return func(m *MockServer) error {
+		switch mode {
+		case ModeReplay, ModeRecord:
+			m.mode = mode
+			return nil
+		default:
+			return fmt.Errorf("unknown mode %q", mode)
+		}
+	}
+}
+
+// WithReloadInterval is a functional option that changes how often the Mock
+// server checks the routes file for changes. An interval of zero disables
+// automatic reloading, but reloads can still be requested through the API.
+func WithReloadInterval(interval time.Duration) Option {
+	return func(m *MockServer) error {
+		if interval < 0 {
+			return fmt.Errorf("reload interval cannot be negative")
+		}
+		m.reloadInterval = interval
+		return nil
+	}
+}
+
+// WithJournalSize is a functional option that changes how many requests the
+// Mock server keeps in its request journal. A size of zero disables the
+// journal.
+func WithJournalSize(size int) Option {
+	return func(m *MockServer) error {
+		if size < 0 {
+			return fmt.Errorf("journal size cannot be negative")
+		}
+		m.journalSize = size
+		return nil
+	}
+}
+
+// WithICAPPort is a functional option that changes the port the Mock server
+// runs its ICAP server on. A port of zero disables the ICAP server.
+func WithICAPPort(port int) Option {
+	return func(m *MockServer) error {
+		m.icapPort = port
+		return nil
+	}
+}
+
+// WithProxyPort is a functional option that also runs the Mock server as a
+// forward HTTP proxy on the given port, which can be used instead of Squid.
+// The proxy is disabled by default.
+func WithProxyPort(port int) Option {
+	return func(m *MockServer) error {
+		m.proxyPort = port
+		return nil
+	}
+}
+
 // WithAPIPort is a functional option that changes the port the Mock server
 // runs its API on.
 func WithAPIPort(port int) Option {
@@ -136,28 +315,68 @@ func WithLogger(logger hclog.Logger) Option {
 	}
 }
 
-// Serve starts the actual servers and handlers, then waits for them to exit
-// or for an Interrupt signal.
-func (ms *MockServer) Serve() error {
-	// ICAP makes use of these handlers on the DefaultServeMux
-	http.HandleFunc("/", ms.mockHandler)
-	icap.HandleFunc("/icap", ms.interception)
+// ICAPHandler returns the icap.Handler serving the ICAP endpoint, which Serve
+// listens on the ICAP port with.
+func (ms *MockServer) ICAPHandler() icap.Handler {
+	icapMux := icap.NewServeMux()
+	icapMux.HandleFunc("/icap", ms.interception)
+	return icapMux
+}
 
-	// We also create a custom ServeMux mock-proxy for API endpoints
+// APIHandler returns the http.Handler serving the API endpoints, which Serve
+// listens on the API port with.
+func (ms *MockServer) APIHandler() http.Handler {
 	apiMux := http.NewServeMux()
+	apiMux.HandleFunc("/health", ms.healthHandler)
 	apiMux.HandleFunc("/substitution-variables", ms.substitutionVariableHandler)
+	apiMux.HandleFunc("/substitution-variables/", ms.substitutionVariableHandler)
+	apiMux.HandleFunc("/reload", ms.reloadHandler)
+	apiMux.HandleFunc("/routes", ms.routesHandler)
+	apiMux.HandleFunc("/routes/", ms.routesHandler)
+	apiMux.HandleFunc("/requests", ms.requestsHandler)
+	apiMux.HandleFunc("/scenarios", ms.scenariosHandler)
+	apiMux.HandleFunc("/scenarios/", ms.scenariosHandler)
+	apiMux.HandleFunc("/faults", ms.faultsHandler)
+	apiMux.HandleFunc("/faults/", ms.faultsHandler)
+	apiMux.HandleFunc("/ca.pem", ms.caHandler)
+	apiMux.HandleFunc("/ca.crt", ms.caHandler)
+	return apiMux
+}
 
-	icapErrC := make(chan error)
+// Serve starts the actual servers and handlers, then waits for them to exit
+// or for an Interrupt signal.
+func (ms *MockServer) Serve() error {
+	icapMux := ms.ICAPHandler()
+	apiMux := ms.APIHandler()
+
+	// Servers that are disabled leave their channel nil, so it never receives.
+	var icapErrC, proxyErrC chan error
 	apiErrC := make(chan error)
 
 	// We also want to gracefully stop when the OS asks us to
 	killSignal := make(chan os.Signal, 1)
 	signal.Notify(killSignal, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
-	go func() {
-		ms.logger.Info("starting icap server on", "port", ms.icapPort)
-		icapErrC <- icap.ListenAndServe(fmt.Sprintf(":%d", ms.icapPort), nil)
-	}()
+	stopWatching := make(chan struct{})
+	defer close(stopWatching)
+	if ms.reloadInterval > 0 {
+		go ms.watchRoutes(stopWatching)
+	}
+
+	if ms.icapPort > 0 {
+		icapErrC = make(chan error)
+		go func() {
+			ms.logger.Info("starting icap server on", "port", ms.icapPort)
+			icapErrC <- icap.ListenAndServe(fmt.Sprintf(":%d", ms.icapPort), icapMux)
+		}()
+	}
+	if ms.proxyPort > 0 {
+		proxyErrC = make(chan error)
+		go func() {
+			ms.logger.Info("starting proxy server on", "port", ms.proxyPort)
+			proxyErrC <- http.ListenAndServe(fmt.Sprintf(":%d", ms.proxyPort), ms)
+		}()
+	}
 	go func() {
 		ms.logger.Info("starting api server on", "port", ms.apiPort)
 		apiErrC <- http.ListenAndServe(fmt.Sprintf(":%d", ms.apiPort), apiMux)
@@ -170,6 +389,11 @@ func (ms *MockServer) Serve() error {
 				ms.logger.Error("exiting due to icap error", "error", err.Error())
 			}
 			return err
+		case err := <-proxyErrC:
+			if err != nil {
+				ms.logger.Error("exiting due to proxy error", "error", err.Error())
+			}
+			return err
 		case err := <-apiErrC:
 			if err != nil {
 				ms.logger.Error("exiting due to api error", "error", err.Error())
@@ -184,13 +408,16 @@ func (ms *MockServer) Serve() error {
 
 // interception runs the ICAP handler. When a request is input, we either:
 //   1. If it matches a known "mocked" host, injects a response.
-//   2. If it does not, returns a 204 which allows the request unmodifed.
+//   2. If it does not, returns a 204 which allows the request unmodifed, or
+//      injects an error response if the UnmatchedPolicy denies it.
+// In RESPMOD mode, the upstream responses to requests allowed through are
+// patched if they match a "patch" Route, or captured when recording.
 func (ms *MockServer) interception(w icap.ResponseWriter, req *icap.Request) {
 	switch req.Method {
 	case "OPTIONS":
 		h := w.Header()
 
-		h.Set("Methods", "REQMOD")
+		h.Set("Methods", "REQMOD, RESPMOD")
 		h.Set("Allow", "204")
 		h.Set("Preview", "0")
 		h.Set("Transfer-Preview", "*")
@@ -199,40 +426,149 @@ func (ms *MockServer) interception(w icap.ResponseWriter, req *icap.Request) {
 		ms.logger.Info("REQMOD request for", "host", req.Request.Host)
 		ms.logger.Info("REQMOD request URL", "url", fmt.Sprintf("%+v", req.Request.URL))
 
-		route, _ := ms.RouteConfig.MatchRoute(req.Request.URL)
-		if route != nil {
-			icap.ServeLocally(w, req)
+		// Squid sends the address of its client when icap_send_client_ip is
+		// on, which identifies the client for client scoped variables.
+		if ip := req.Header.Get("X-Client-IP"); ip != "" {
+			req.Request.RemoteAddr = net.JoinHostPort(ip, "0")
+		}
+
+		route, _ := ms.matchRoute(req.Request)
+		if route != nil && route.Type != "patch" && !ms.shouldRecord(req.Request, route) {
+			// Serve the mock locally, bridging the HTTP response into ICAP.
+			ms.mockHandler(newICAPResponseWriter(w), req.Request)
+		} else if route == nil && ms.denied(req.Request) {
+			ms.deny(icap.NewBridgedResponseWriter(w), req.Request)
 		} else {
+			// Journal the request, but don't read its body, which would
+			// require it to be sent back to the ICAP client.
+			entry := newJournalEntry(req.Request, false)
+			entry.Route = route
+			entry.Passthrough = true
+			ms.journal.add(entry)
+
 			// Return the request unmodified.
 			w.WriteHeader(http.StatusNoContent, nil, false)
 		}
+	case "RESPMOD":
+		ms.logger.Info("RESPMOD request for", "host", req.Request.Host)
+
+		route, _ := ms.matchRoute(req.Request)
+		if route != nil && route.Type == "patch" && !ms.shouldRecord(req.Request, route) {
+			body, err := ms.patchResponse(route, req.Response)
+			if err != nil {
+				ms.logger.Error("failed reading upstream response", "error", err.Error())
+				w.WriteHeader(http.StatusInternalServerError, nil, false)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK, req.Response, true)
+			if _, err := w.Write(body); err != nil {
+				ms.logger.Error("failed writing patched response", "error", err.Error())
+			}
+			return
+		}
+		if !ms.shouldRecord(req.Request, route) {
+			// Return the response unmodified.
+			w.WriteHeader(http.StatusNoContent, nil, false)
+			return
+		}
+
+		body, err := ioutil.ReadAll(req.Response.Body)
+		if err != nil {
+			ms.logger.Error("failed reading upstream response", "error", err.Error())
+			w.WriteHeader(http.StatusInternalServerError, nil, false)
+			return
+		}
+
+		recorded, err := ms.record(req.Request, req.Response, body)
+		if err != nil {
+			ms.logger.Error("failed recording upstream response", "error", err.Error())
+		} else {
+			ms.logger.Info("recorded upstream response", "route", fmt.Sprintf("%+v", recorded))
+		}
+
+		// Having read the body, it must be sent back rather than allowing the
+		// response through unmodified.
+		w.WriteHeader(http.StatusOK, req.Response, true)
+		if _, err := w.Write(body); err != nil {
+			ms.logger.Error("failed writing upstream response", "error", err.Error())
+		}
 	default:
-		// This ICAP server is only able to handle REQMOD, will not be using
-		// RESMOD mode.
 		w.WriteHeader(http.StatusMethodNotAllowed, nil, false)
 		ms.logger.Error("invalid request method to ICAP server", "method", req.Method)
 	}
 }
 
+// icapResponseWriter bridges a mock response into ICAP, like the
+// http.ResponseWriter of icap.NewBridgedResponseWriter, which it wraps. As
+// there is no connection to hijack, it aborts a response for a Fault itself.
+type icapResponseWriter struct {
+	http.ResponseWriter
+	icap        icap.ResponseWriter
+	wroteHeader bool
+}
+
+func newICAPResponseWriter(w icap.ResponseWriter) *icapResponseWriter {
+	return &icapResponseWriter{ResponseWriter: icap.NewBridgedResponseWriter(w), icap: w}
+}
+
+func (iw *icapResponseWriter) WriteHeader(code int) {
+	iw.wroteHeader = true
+	iw.ResponseWriter.WriteHeader(code)
+}
+
+func (iw *icapResponseWriter) Write(p []byte) (int, error) {
+	iw.wroteHeader = true
+	return iw.ResponseWriter.Write(p)
+}
+
+// abort ends a response early. A response that hasn't started is answered
+// with an ICAP error, which Squid turns into an error page of its own, and a
+// truncated response ends short of its Content-Length, which Squid passes on
+// by closing the connection to its client.
+func (iw *icapResponseWriter) abort(reset bool) error {
+	if !iw.wroteHeader {
+		iw.wroteHeader = true
+		iw.icap.WriteHeader(http.StatusInternalServerError, nil, false)
+	}
+	return nil
+}
+
 // mockHandler receives requests and based on them, returns one of the known
-// .mock files, after running it through the configured Transformers.
+// .mock files, after rendering it as a template and running it through the
+// configured Transformers.
 func (ms *MockServer) mockHandler(w http.ResponseWriter, r *http.Request) {
 	ms.logger.Info("MOCK request", "url", r.URL.String())
 
+	// Journal every request along with the status code it was given.
+	entry := newJournalEntry(r, true)
+	sw := &statusWriter{ResponseWriter: w}
+	w = sw
+	defer func() {
+		entry.Status = sw.status
+		ms.journal.add(entry)
+	}()
+
+	// A status code requested by the client takes precedence over any status
+	// code set in a response file.
+	var desiredCode int
 	successCode := http.StatusOK
 	successCodeString := r.Header.Get(DesiredStatusCodeHeader)
 	if successCodeString != "" {
 		var err error
-		successCode, err = strconv.Atoi(successCodeString)
+		desiredCode, err = strconv.Atoi(successCodeString)
 		if err != nil {
 			ms.logger.Error(fmt.Sprintf("failed to parse %s", DesiredStatusCodeHeader),
 				"error", err.Error())
 			http.Error(w, fmt.Sprintf("failed to parse %s: %s",
 				DesiredStatusCodeHeader, err.Error()), http.StatusInternalServerError)
+			return
 		}
+		successCode = desiredCode
 	}
 
-	route, err := ms.RouteConfig.MatchRoute(r.URL)
+	route, err := ms.matchRoute(r)
+	entry.Route = route
 	if err != nil || route == nil {
 		if err == nil {
 			err = fmt.Errorf("found no matching route for %s", r.URL.String())
@@ -243,6 +579,22 @@ func (ms *MockServer) mockHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Faults delay the response, or replace or break it.
+	if fault := ms.routeFault(route); fault != nil {
+		kind, fw, ok := injectFault(w, r, fault)
+		entry.Fault = kind
+		if kind != "" {
+			ms.logger.Info("injecting fault", "fault", kind, "url", r.URL.String())
+		}
+		if !ok {
+			return
+		}
+		if fw != nil {
+			w = fw
+			defer fw.finish()
+		}
+	}
+
 	ms.logger.Info("parsing URL", "route", fmt.Sprintf("%+v", route), "url", r.URL)
 	path, localTransformers, err := route.ParseURL(r.URL)
 	if err != nil {
@@ -255,28 +607,34 @@ func (ms *MockServer) mockHandler(w http.ResponseWriter, r *http.Request) {
 	switch route.Type {
 	case "http":
 		ms.logger.Info("detected an http mock attempt")
-		fileName := filepath.Join(ms.mockFilesRoot, path)
-		mock, err := os.Open(fileName)
+
+		mock, mockResponse, err := ms.openMock(route, path, r.Method)
 		if err != nil {
-			ms.logger.Error("failed opening mock file", "error", err.Error())
-			http.Error(w, fmt.Sprintf("failed opening mock file: %s", err.Error()), http.StatusNotFound)
+			ms.logger.Error("failed opening mock", "error", err.Error())
+			http.Error(w, fmt.Sprintf("failed opening mock: %s", err.Error()), http.StatusNotFound)
 			return
 		}
+		defer mock.Close()
 
-		// Apply the configured transformations to the mock file
-		transformers := append(ms.transformers, localTransformers...)
-		var res io.Reader = mock
-		for _, t := range transformers {
-			res, err = t.Transform(res)
-			if err != nil {
-				ms.logger.Error("error applying transformations", "error", err.Error())
-				http.Error(
-					w,
-					fmt.Sprintf("error applying transformations: %s", err.Error()),
-					http.StatusInternalServerError,
-				)
-				return
-			}
+		if mockResponse.Status != 0 && desiredCode == 0 {
+			successCode = mockResponse.Status
+		}
+		if err := mockResponse.apply(w, r); err != nil {
+			ms.logger.Error("failed applying mock response", "error", err.Error())
+			return
+		}
+
+		// Render the mock file as a template, then apply any other
+		// transformations.
+		res, err := ms.render(path, mock, r, route, mockResponse, localTransformers)
+		if err != nil {
+			ms.logger.Error("error applying transformations", "error", err.Error())
+			http.Error(
+				w,
+				fmt.Sprintf("error applying transformations: %s", err.Error()),
+				http.StatusInternalServerError,
+			)
+			return
 		}
 
 		w.WriteHeader(successCode)
@@ -290,129 +648,24 @@ func (ms *MockServer) mockHandler(w http.ResponseWriter, r *http.Request) {
 			)
 			return
 		}
-	case "git":
-		ms.logger.Info("detected a git clone attempt")
-
-		mockFS := osfs.New(filepath.Join(ms.mockFilesRoot))
-		loader := gitserver.NewFilesystemLoader(
-			mockFS,
-		)
-		gitServer := gitserver.NewServer(loader)
 
-		ep, err := gittransport.NewEndpoint(path)
-		if err != nil {
-			ms.logger.Error("failed creating transport", "error", err.Error())
-			http.Error(w, fmt.Sprintf("failed creating transport: %s",
-				err.Error()), http.StatusInternalServerError)
-			return
+		if route.NextState != "" {
+			ms.scenarios.setState(route.Scenario, route.NextState)
 		}
-
-		fs, _ := mockFS.Chroot(ep.Path)
-		ms.logger.Info("attempting to load local git repo", "filepath", fmt.Sprintf("%+v", fs.Root()))
-
-		sess, err := gitServer.NewUploadPackSession(ep, nil)
+	case "git":
+		loader, err := ms.gitLoader(r, route, path, localTransformers)
 		if err != nil {
-			ms.logger.Error("failed creating git-upload-pack session", "error", err.Error())
-			http.Error(w, fmt.Sprintf("failed creating git-upload-pack session: %s",
+			ms.logger.Error("failed loading git repo", "error", err.Error())
+			http.Error(w, fmt.Sprintf("failed loading git repo: %s",
 				err.Error()), http.StatusInternalServerError)
 			return
 		}
-		defer sess.Close()
-
-		if strings.HasSuffix(r.URL.String(), "info/refs?service=git-upload-pack") {
-			ms.logger.Info("detected a reference advertisement request")
-
-			refs, err := sess.AdvertisedReferences()
-			if err != nil {
-				ms.logger.Error("failed to load reference advertisement", "error", err.Error())
-				http.Error(w, fmt.Sprintf("failed to load reference advertisement: %s",
-					err.Error()), http.StatusInternalServerError)
-				return
-			}
 
-			// Add the Shallow capability
-			if err := refs.Capabilities.Add(gitcapability.Shallow); err != nil {
-				ms.logger.Error("failed to add shallow capability", "error", err.Error())
-				http.Error(w, fmt.Sprintf("failed to add shallow capability: %s",
-					err.Error()), http.StatusInternalServerError)
-				return
-			}
-
-			// To successfully interact with smart git clone, we must set a
-			// prefix saying which service this is.
-			refs.Prefix = [][]byte{
-				[]byte(
-					fmt.Sprintf("# service=%s", gittransport.UploadPackServiceName),
-				),
-				// Note: This is a semantically significant flush, and I don't
-				// really know why, but do not touch.
-				gitpktline.Flush,
-			}
-			w.Header().Add("Content-Type", "application/x-git-upload-pack-advertisement")
-			w.Header().Add("Cache-Control", "no-cache")
-
-			w.WriteHeader(successCode)
-			if err := refs.Encode(w); err != nil {
-				ms.logger.Error("failed writing response", "error", err.Error())
-				http.Error(w, fmt.Sprintf("failed writing response: %s",
-					err.Error()), http.StatusInternalServerError)
-				return
-			}
-			return
-		} else if strings.HasSuffix(r.URL.String(), "git-upload-pack") {
-			ms.logger.Info("detected a git-upload-pack request")
-
-			ctx, cancelFunc := context.WithTimeout(context.Background(), 30*time.Second)
-			defer cancelFunc()
-
-			w.Header().Add("Content-Type", "application/x-git-upload-pack-result")
-			w.Header().Add("Cache-Control", "no-cache")
-
-			// Originally tried implementing `upload-pack` in `go-git`, but
-			// this got complicated, and git --stateless-rpc serves this purpose
-			// well.
-			cmd := exec.CommandContext(ctx, "git", "upload-pack", "--stateless-rpc", fs.Root())
-
-			// Set the stdin to read from the request, and the stdout to write
-			// to the response.
-			cmd.Stdin = r.Body
-			cmd.Stdout = w
-
-			if err := cmd.Start(); err != nil {
-				ms.logger.Error("error starting git upload-pack", "error", err.Error())
-				http.Error(w, fmt.Sprintf("error starting git upload-pack: %s",
-					err.Error()), 500)
-				return
-			}
-
-			if err := cmd.Wait(); err != nil {
-				if err != nil {
-					// For shallow clones, the exit code will be 128, if this is
-					// the case, don't error.
-					var exerr *exec.ExitError
-					if errors.As(err, &exerr) {
-						if exerr.ExitCode() != 128 {
-							ms.logger.Error("error running git upload-pack", "error", err.Error())
-							http.Error(w, fmt.Sprintf("error running git upload-pack: %s",
-								err.Error()), 500)
-							return
-						}
-					} else {
-						ms.logger.Error("error running git upload-pack", "error", err.Error())
-						http.Error(w, fmt.Sprintf("error running git upload-pack: %s",
-							err.Error()), 500)
-						return
-					}
-				}
-			}
-
-			return
-		} else {
-			ms.logger.Error("detected an unknown git request type", "url", r.URL.String())
-			http.Error(w, fmt.Sprintf("detected an unknown git request type: %s",
-				r.URL.String()), http.StatusNotFound)
+		if isReceivePack(r) {
+			ms.receivePack(w, r, route, loader, path, successCode)
 			return
 		}
+		ms.uploadPack(w, r, loader, path, successCode)
 	default:
 		ms.logger.Error("detected an unknown route type", "url", r.URL.String())
 		http.Error(w, fmt.Sprintf("detected an unknown route type: %s",
@@ -421,30 +674,129 @@ func (ms *MockServer) mockHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// substitutionVariableHandler can receive a GET or POST request.
-//   GET) Returns a JSON representation of the current variable substitutions.
-//   POST) Adds a new variable substitution based on multi-part form values.
+// mockFS returns the mock file directory as a filesystem, in which git Routes
+// find their repositories.
+func (ms *MockServer) mockFS() billy.Filesystem {
+	return osfs.New(ms.mockFilesRoot)
+}
+
+// openMock opens the body of a mock for an http Route, along with the
+// MockResponse describing how to serve it. The body is either inline in the
+// Route, or read from a mock file. A Route with a sequence of Responses serves
+// the next mock file in the sequence. Otherwise, unless the Route names its
+// mock file explicitly, a mock file specific to the request method is
+// preferred over the method agnostic mock file.
+func (ms *MockServer) openMock(
+	route *Route,
+	path string,
+	method string,
+) (io.ReadCloser, *MockResponse, error) {
+	mockResponse := route.Response
+	if mockResponse == nil {
+		mockResponse = &MockResponse{}
+	}
+
+	if route.Body != nil {
+		return ioutil.NopCloser(strings.NewReader(*route.Body)), mockResponse, nil
+	}
+
+	fileName := filepath.Join(ms.mockFilesRoot, path)
+	explicit := route.File != ""
+	if len(route.Responses) != 0 {
+		fileName = filepath.Join(ms.mockFilesRoot, route.Responses[ms.scenarios.next(route)])
+		explicit = true
+	}
+	if !explicit {
+		fileName = filepath.Join(ms.mockFilesRoot, methodMockPath(path, method))
+	}
+	mock, err := os.Open(fileName)
+	if os.IsNotExist(err) && !explicit {
+		fileName = filepath.Join(ms.mockFilesRoot, path)
+		mock, err = os.Open(fileName)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed opening mock file: %w", err)
+	}
+
+	if route.Response == nil {
+		mockResponse, err = loadMockResponse(fileName)
+		if err != nil {
+			mock.Close()
+			return nil, nil, fmt.Errorf("failed loading mock response file: %w", err)
+		}
+	}
+
+	return mock, mockResponse, nil
+}
+
+// healthHandler responds with a 200 once the API server is up, so that
+// clients can wait for mock-proxy to start.
+func (ms *MockServer) healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// substitutionVariableHandler can receive a GET, POST, PUT or DELETE request.
+// Each takes optional scope and name parameters, to act on the variables of a
+// host, route or client scope instead of the global variables.
+//   GET) Returns a JSON representation of the current variable substitutions,
+//        or of those in every scope when the scope parameter is "all".
+//         curl squid.proxy/substitution-variables?scope=host&name=example.com
+//   POST) Adds a new variable substitution based on multi-part form values, or
+//         on a JSON object with the same fields.
 //         curl -X POST -F "key=A" -F "value=B" squid.proxy/substitution-variables
+//   PUT) Replaces every variable substitution in the scope with those in a JSON
+//        array, as returned by GET. When the scope is "all", every scope is
+//        replaced, with each variable substitution in its own scope.
+//         curl -X PUT -d '[{"key": "A", "value": "B"}]' squid.proxy/substitution-variables
+//   DELETE) Removes the variable substitution given by the key query parameter,
+//           or every variable substitution in the scope when no key is given.
+//         curl -X DELETE squid.proxy/substitution-variables?key=A
+// A POST to /substitution-variables/reset restores the variable substitutions
+// given by WithDefaultVariables, and removes every scoped variable.
 func (ms *MockServer) substitutionVariableHandler(
 	w http.ResponseWriter,
 	r *http.Request,
 ) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/substitution-variables"), "/")
+	if action != "" {
+		if action != "reset" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ms.resetVariables()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	all := r.URL.Query().Get("scope") == "all"
+	scope := VariableScope{}
+	if !all {
+		var err error
+		if scope, err = scopeFromQuery(r.URL.Query()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	switch r.Method {
 	case http.MethodGet:
-		resp := []struct {
-			Key   string `json:"key"`
-			Value string `json:"value"`
-		}{}
-
-		for _, transform := range ms.transformers {
-			switch tr := transform.(type) {
-			case *VariableSubstitution:
-				resp = append(resp, struct {
-					Key   string `json:"key"`
-					Value string `json:"value"`
-				}{
-					Key:   tr.key,
-					Value: tr.value,
+		scopes := []VariableScope{scope}
+		if all {
+			scopes = ms.scopes()
+		}
+
+		resp := []scopedVariable{}
+		for _, scope := range scopes {
+			for _, vs := range ms.variables(scope) {
+				resp = append(resp, scopedVariable{
+					Key:           vs.key,
+					Value:         vs.value,
+					VariableScope: scope,
 				})
 			}
 		}
@@ -458,56 +810,63 @@ func (ms *MockServer) substitutionVariableHandler(
 		w.Header().Set("Content-Type", "application/json")
 		_, _ = w.Write(js)
 	case http.MethodPost:
-		err := r.ParseMultipartForm(4096)
-		if err != nil {
-			http.Error(
-				w,
-				fmt.Sprintf("error parsing input form: %s", err.Error()),
-				http.StatusInternalServerError,
-			)
+		if all {
+			http.Error(w, "a variable cannot be set in every scope", http.StatusBadRequest)
 			return
 		}
 
-		key := r.PostForm.Get("key")
-		value := r.PostForm.Get("value")
-
-		if key == "" || value == "" {
-			http.Error(
-				w,
-				"both key and value must be supplied",
-				http.StatusBadRequest,
-			)
+		posted, code, err := postedVariable(r, scope)
+		if err != nil {
+			http.Error(w, err.Error(), code)
 			return
 		}
 
-		vs, err := NewVariableSubstitution(key, value)
+		vs, err := NewVariableSubstitution(posted.Key, posted.Value)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		ms.addVariableSubstitution(vs)
+		ms.setVariable(posted.VariableScope, vs)
 		w.WriteHeader(http.StatusOK)
-	}
-}
+	case http.MethodPut:
+		vars := []scopedVariable{}
+		if err := json.NewDecoder(r.Body).Decode(&vars); err != nil {
+			http.Error(w, fmt.Sprintf("error parsing variables: %s", err.Error()),
+				http.StatusBadRequest)
+			return
+		}
 
-// addVariableSubstitution adds a new variable substitution. It iterates the
-// currently configured Transformers, and if an existing substitution for a
-// variable with the new key already exists, replaces it instead of having two.
-func (ms *MockServer) addVariableSubstitution(
-	new *VariableSubstitution,
-) {
-	var replaced bool
-	for idx, transform := range ms.transformers {
-		switch tr := transform.(type) {
-		case *VariableSubstitution:
-			if tr.key == new.key {
-				ms.transformers[idx] = new
-				replaced = true
-			}
+		byScope, err := groupVariables(vars, scope, all)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
+
+		ms.replaceVariables(scope, all, byScope)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		key := r.URL.Query().Get("key")
+		switch {
+		case key != "" && all:
+			http.Error(w, "a key cannot be deleted from every scope", http.StatusBadRequest)
+			return
+		case key != "":
+			ms.deleteVariable(scope, key)
+		case all:
+			ms.clearVariables()
+		default:
+			ms.deleteVariables(scope)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 	}
-	if !replaced {
-		ms.transformers = append(ms.transformers, new)
-	}
+}
+
+// addVariableSubstitution adds a new global variable substitution, replacing
+// any existing substitution for a variable with the same key instead of
+// having two.
+func (ms *MockServer) addVariableSubstitution(new *VariableSubstitution) {
+	ms.setVariable(VariableScope{}, new)
 }
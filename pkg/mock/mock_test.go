@@ -6,6 +6,7 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -62,12 +63,15 @@ func TestNewMockServer(t *testing.T) {
 
 func TestMockServerMockHandler(t *testing.T) {
 	tcs := []struct {
-		name     string
-		options  []Option
-		url      string
-		headers  map[string]string
-		want     string
-		wantCode int
+		name        string
+		options     []Option
+		method      string
+		url         string
+		headers     map[string]string
+		body        string
+		want        string
+		wantCode    int
+		wantHeaders map[string]string
 	}{
 		{
 			name: "simple",
@@ -124,6 +128,72 @@ func TestMockServerMockHandler(t *testing.T) {
 			want:     "notexists\n",
 			wantCode: 404,
 		},
+		{
+			name:   "method agnostic route",
+			method: http.MethodGet,
+			url:    "http://example.com/repos",
+			options: []Option{
+				WithMockRoot("testdata/"),
+			},
+			want: "[]\n",
+		},
+		{
+			name:   "method specific route and mock file",
+			method: http.MethodPost,
+			url:    "http://example.com/repos",
+			options: []Option{
+				WithMockRoot("testdata/"),
+			},
+			want: "{\"created\": true}\n",
+		},
+		{
+			name: "response file",
+			url:  "http://example.com/created",
+			options: []Option{
+				WithMockRoot("testdata/"),
+			},
+			want:     "{\"id\": 1}\n",
+			wantCode: 201,
+			wantHeaders: map[string]string{
+				"Content-Type": "application/json",
+				"Location":     "/created/1",
+			},
+		},
+		{
+			name: "X-Desired-Response-Code overrides response file",
+			url:  "http://example.com/created",
+			options: []Option{
+				WithMockRoot("testdata/"),
+			},
+			headers: map[string]string{
+				"X-Desired-Response-Code": "409",
+			},
+			want:     "{\"id\": 1}\n",
+			wantCode: 409,
+		},
+		{
+			name:   "json body matcher",
+			method: http.MethodPost,
+			url:    "http://example.com/graphql",
+			options: []Option{
+				WithMockRoot("testdata/"),
+			},
+			body: `{"operationName": "GetViewer", "query": "{ viewer { login } }"}`,
+			want: "{\"data\": {\"viewer\": {\"login\": \"octocat\"}}}\n",
+		},
+		{
+			name:   "body and header matchers",
+			method: http.MethodPost,
+			url:    "http://example.com/graphql",
+			options: []Option{
+				WithMockRoot("testdata/"),
+			},
+			headers: map[string]string{
+				"Authorization": "Bearer abc123",
+			},
+			body: `{"query": "mutation CreateIssue { createIssue { number } }"}`,
+			want: "{\"data\": {\"createIssue\": {\"number\": 1}}}\n",
+		},
 	}
 
 	for _, tc := range tcs {
@@ -134,7 +204,11 @@ func TestMockServerMockHandler(t *testing.T) {
 			ms, err := NewMockServer(tc.options...)
 			require.Nil(t, err)
 
-			req, err := http.NewRequest(http.MethodGet, tc.url, nil)
+			method := http.MethodGet
+			if tc.method != "" {
+				method = tc.method
+			}
+			req, err := http.NewRequest(method, tc.url, strings.NewReader(tc.body))
 			require.Nil(t, err)
 
 			for k, v := range tc.headers {
@@ -151,6 +225,10 @@ func TestMockServerMockHandler(t *testing.T) {
 			}
 			assert.Equal(t, wantCode, recorder.Result().StatusCode)
 
+			for k, v := range tc.wantHeaders {
+				assert.Equal(t, v, recorder.Result().Header.Get(k))
+			}
+
 			gotBytes, err := ioutil.ReadAll(recorder.Result().Body)
 			require.Nil(t, err)
 			got := string(gotBytes)
@@ -222,7 +300,7 @@ func TestMockServerSubstitutionVariableHandler_POST(t *testing.T) {
 		options []Option
 		key     string
 		value   string
-		want    []Transformer
+		want    []*VariableSubstitution
 	}{
 		{
 			name:  "simple",
@@ -231,7 +309,7 @@ func TestMockServerSubstitutionVariableHandler_POST(t *testing.T) {
 			options: []Option{
 				WithMockRoot("testdata/"),
 			},
-			want: []Transformer{
+			want: []*VariableSubstitution{
 				&VariableSubstitution{key: "name", value: "Davenport"},
 			},
 		},
@@ -245,7 +323,7 @@ func TestMockServerSubstitutionVariableHandler_POST(t *testing.T) {
 					&VariableSubstitution{key: "name", value: "Davenport"},
 				),
 			},
-			want: []Transformer{
+			want: []*VariableSubstitution{
 				&VariableSubstitution{key: "name", value: "Barry"},
 			},
 		},
@@ -259,7 +337,7 @@ func TestMockServerSubstitutionVariableHandler_POST(t *testing.T) {
 					&VariableSubstitution{key: "name", value: "Davenport"},
 				),
 			},
-			want: []Transformer{
+			want: []*VariableSubstitution{
 				&VariableSubstitution{key: "name", value: "Davenport"},
 				&VariableSubstitution{key: "foo", value: "bar"},
 			},
@@ -295,7 +373,7 @@ func TestMockServerSubstitutionVariableHandler_POST(t *testing.T) {
 				require.Fail(t, res)
 			}
 
-			got := ms.transformers
+			got := ms.variables(VariableScope{})
 			assert.Equal(t, tc.want, got)
 		})
 	}
@@ -306,7 +384,7 @@ func TestMockServerAddVariableSubstitution(t *testing.T) {
 		name          string
 		options       []Option
 		substitutions []*VariableSubstitution
-		want          []Transformer
+		want          []*VariableSubstitution
 	}{
 		{
 			name: "simple",
@@ -316,7 +394,7 @@ func TestMockServerAddVariableSubstitution(t *testing.T) {
 			substitutions: []*VariableSubstitution{
 				{key: "foo", value: "bar"},
 			},
-			want: []Transformer{
+			want: []*VariableSubstitution{
 				&VariableSubstitution{key: "foo", value: "bar"},
 			},
 		},
@@ -329,7 +407,7 @@ func TestMockServerAddVariableSubstitution(t *testing.T) {
 				{key: "foo", value: "bar"},
 				{key: "bing", value: "baz"},
 			},
-			want: []Transformer{
+			want: []*VariableSubstitution{
 				&VariableSubstitution{key: "foo", value: "bar"},
 				&VariableSubstitution{key: "bing", value: "baz"},
 			},
@@ -343,7 +421,7 @@ func TestMockServerAddVariableSubstitution(t *testing.T) {
 				{key: "foo", value: "bar"},
 				{key: "foo", value: "baz"},
 			},
-			want: []Transformer{
+			want: []*VariableSubstitution{
 				&VariableSubstitution{key: "foo", value: "baz"},
 			},
 		},
@@ -361,7 +439,7 @@ func TestMockServerAddVariableSubstitution(t *testing.T) {
 				ms.addVariableSubstitution(s)
 			}
 
-			got := ms.transformers
+			got := ms.variables(VariableScope{})
 			assert.Equal(t, tc.want, got)
 		})
 	}
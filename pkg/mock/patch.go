@@ -0,0 +1,468 @@
+package mock
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The supported kinds of Patch, used as the label of a `patch` block.
+const (
+	PatchJSONMerge = "json_merge"
+	PatchJSONPatch = "json_patch"
+	PatchHeader    = "header"
+	PatchRegex     = "regex"
+)
+
+// Patch is a change made to a real upstream response by a "patch" Route,
+// rather than replacing the response with a mock.
+//   patch "json_merge" { value = "{\"archived\": true}" }
+//   patch "json_patch" { value = "[{\"op\": \"remove\", \"path\": \"/owner\"}]" }
+//   patch "header"     { name = "X-RateLimit-Remaining", value = "0" }
+//   patch "header"     { name = "ETag", remove = true }
+//   patch "regex"      { regex = "\"private\":\\s*false", value = "\"private\": true" }
+type Patch struct {
+	Kind   string `hcl:"kind,label" json:"kind"`
+	Name   string `hcl:"name,optional" json:"name,omitempty"`
+	Value  string `hcl:"value,optional" json:"value,omitempty"`
+	Remove bool   `hcl:"remove,optional" json:"remove,omitempty"`
+	Regex  string `hcl:"regex,optional" json:"regex,omitempty"`
+
+	// regex is the compiled form of Regex, set by Validate.
+	regex *regexp.Regexp
+}
+
+// Validate checks that a Patch is well formed, and compiles its regular
+// expression.
+func (p *Patch) Validate() error {
+	switch p.Kind {
+	case PatchJSONMerge:
+		var v interface{}
+		if err := json.Unmarshal([]byte(p.Value), &v); err != nil {
+			return fmt.Errorf("%s patch value is not valid JSON: %w", p.Kind, err)
+		}
+	case PatchJSONPatch:
+		if _, err := parseJSONPatch(p.Value); err != nil {
+			return fmt.Errorf("invalid %s patch: %w", p.Kind, err)
+		}
+	case PatchHeader:
+		if p.Name == "" {
+			return fmt.Errorf("%s patch requires a name", p.Kind)
+		}
+	case PatchRegex:
+		re, err := regexp.Compile(p.Regex)
+		if err != nil || p.Regex == "" {
+			return fmt.Errorf("%s patch requires a valid regex: %v", p.Kind, err)
+		}
+		p.regex = re
+	default:
+		return fmt.Errorf("unknown patch kind %q", p.Kind)
+	}
+
+	return nil
+}
+
+// apply makes the change described by a Patch to the headers and body of a
+// response, and returns the new body.
+func (p *Patch) apply(h http.Header, body []byte) ([]byte, error) {
+	switch p.Kind {
+	case PatchJSONMerge:
+		doc, err := decodeJSON(body)
+		if err != nil {
+			return nil, err
+		}
+		patch, err := decodeJSON([]byte(p.Value))
+		if err != nil {
+			return nil, err
+		}
+		return encodeJSON(mergePatch(doc, patch))
+	case PatchJSONPatch:
+		doc, err := decodeJSON(body)
+		if err != nil {
+			return nil, err
+		}
+		ops, err := parseJSONPatch(p.Value)
+		if err != nil {
+			return nil, err
+		}
+		for _, op := range ops {
+			if doc, err = op.apply(doc); err != nil {
+				return nil, err
+			}
+		}
+		return encodeJSON(doc)
+	case PatchHeader:
+		if p.Remove {
+			h.Del(p.Name)
+		} else {
+			h.Set(p.Name, p.Value)
+		}
+		return body, nil
+	case PatchRegex:
+		re := p.regex
+		if re == nil {
+			var err error
+			if re, err = regexp.Compile(p.Regex); err != nil {
+				return nil, err
+			}
+		}
+		return re.ReplaceAll(body, []byte(p.Value)), nil
+	default:
+		return nil, fmt.Errorf("unknown patch kind %q", p.Kind)
+	}
+}
+
+// patchResponse reads the body of a real upstream response and applies the
+// Patches of a Route to it, returning the patched body. The response headers
+// are patched, and updated to describe the new body.
+//
+// A response that can't be patched, such as a JSON patch of an HTML error
+// page, is logged and passed through unmodified, along with its body. Only a
+// failure to read the response is returned as an error.
+func (ms *MockServer) patchResponse(route *Route, resp *http.Response) ([]byte, error) {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading upstream response: %w", err)
+	}
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	header := resp.Header.Clone()
+	patched, err := applyPatches(route.Patches, header, body)
+	if err != nil {
+		ms.logger.Warn("passing upstream response through unpatched", "error", err.Error())
+		return body, nil
+	}
+
+	header.Set("Content-Length", strconv.Itoa(len(patched)))
+	resp.Header = header
+	resp.ContentLength = int64(len(patched))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(patched))
+	return patched, nil
+}
+
+// applyPatches applies Patches in turn to a response body and its headers.
+func applyPatches(patches []*Patch, header http.Header, body []byte) ([]byte, error) {
+	// Patches apply to the uncompressed body, which is then sent uncompressed.
+	var err error
+	switch encoding := header.Get("Content-Encoding"); strings.ToLower(encoding) {
+	case "", "identity":
+	case "gzip":
+		if body, err = decompressBody(header, body); err != nil {
+			return nil, err
+		}
+		header.Del("Content-Encoding")
+	default:
+		return nil, fmt.Errorf("cannot patch a response with content encoding %s", encoding)
+	}
+
+	for _, p := range patches {
+		if body, err = p.apply(header, body); err != nil {
+			return nil, fmt.Errorf("error applying %s patch: %w", p.Kind, err)
+		}
+	}
+	return body, nil
+}
+
+// decodeJSON decodes a JSON document, keeping numbers as they were written.
+func decodeJSON(b []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, fmt.Errorf("error decoding JSON: %w", err)
+	}
+	return v, nil
+}
+
+// encodeJSON encodes a JSON document without escaping HTML characters, so that
+// parts of a document that aren't patched are unchanged.
+func encodeJSON(v interface{}) ([]byte, error) {
+	b := &bytes.Buffer{}
+	e := json.NewEncoder(b)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), nil
+}
+
+// mergePatch applies a JSON merge patch, as described by RFC 7386, to a
+// decoded JSON document.
+func mergePatch(doc, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	docObj, ok := doc.(map[string]interface{})
+	if !ok {
+		docObj = map[string]interface{}{}
+	}
+	for k, v := range patchObj {
+		if v == nil {
+			delete(docObj, k)
+			continue
+		}
+		docObj[k] = mergePatch(docObj[k], v)
+	}
+	return docObj
+}
+
+// jsonPatchOp is a single operation of a JSON patch, as described by RFC 6902.
+type jsonPatchOp struct {
+	Op    string           `json:"op"`
+	Path  string           `json:"path"`
+	From  string           `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+// parseJSONPatch parses and checks the operations of a JSON patch.
+func parseJSONPatch(s string) ([]jsonPatchOp, error) {
+	ops := []jsonPatchOp{}
+	if err := json.Unmarshal([]byte(s), &ops); err != nil {
+		return nil, fmt.Errorf("error decoding JSON patch: %w", err)
+	}
+
+	for _, op := range ops {
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, fmt.Errorf("%s operation requires a value", op.Op)
+			}
+		case "move", "copy":
+			if _, err := parsePointer(op.From); err != nil {
+				return nil, err
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("unknown JSON patch operation %q", op.Op)
+		}
+		if _, err := parsePointer(op.Path); err != nil {
+			return nil, err
+		}
+	}
+	return ops, nil
+}
+
+// apply applies a single JSON patch operation to a decoded JSON document, and
+// returns the new document.
+func (op jsonPatchOp) apply(doc interface{}) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add":
+		value, err := decodeJSON(*op.Value)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, value)
+	case "remove":
+		doc, _, err := pointerRemove(doc, path)
+		return doc, err
+	case "replace":
+		value, err := decodeJSON(*op.Value)
+		if err != nil {
+			return nil, err
+		}
+		if doc, _, err = pointerRemove(doc, path); err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, value)
+	case "move":
+		from, _ := parsePointer(op.From)
+		doc, value, err := pointerRemove(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, value)
+	case "copy":
+		from, _ := parsePointer(op.From)
+		value, err := pointerGet(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		// Copy by round tripping, so the two values don't share state.
+		b, _ := json.Marshal(value)
+		if value, err = decodeJSON(b); err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, value)
+	case "test":
+		want, err := decodeJSON(*op.Value)
+		if err != nil {
+			return nil, err
+		}
+		got, err := pointerGet(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		wantJSON, _ := json.Marshal(want)
+		gotJSON, _ := json.Marshal(got)
+		if !bytes.Equal(wantJSON, gotJSON) {
+			return nil, fmt.Errorf("test failed at %s", op.Path)
+		}
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("unknown JSON patch operation %q", op.Op)
+	}
+}
+
+// parsePointer splits a JSON pointer, as described by RFC 6901, into its
+// unescaped reference tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("JSON pointer %q must start with /", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(t)
+	}
+	return tokens, nil
+}
+
+// arrayIndex converts a reference token into an index of an array of length
+// n. When adding, the index may be n, or "-", to append to the array.
+func arrayIndex(token string, n int, adding bool) (int, error) {
+	if adding && token == "-" {
+		return n, nil
+	}
+
+	idx, err := strconv.Atoi(token)
+	if err != nil || idx < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if idx > n || (!adding && idx == n) {
+		return 0, fmt.Errorf("array index %d out of range", idx)
+	}
+	return idx, nil
+}
+
+// pointerGet returns the value a JSON pointer refers to.
+func pointerGet(doc interface{}, path []string) (interface{}, error) {
+	current := doc
+	for _, token := range path {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			v, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("no value at %q", token)
+			}
+			current = v
+		case []interface{}:
+			idx, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			current = node[idx]
+		default:
+			return nil, fmt.Errorf("cannot index into a scalar with %q", token)
+		}
+	}
+	return current, nil
+}
+
+// pointerAdd adds a value at the location a JSON pointer refers to, replacing
+// an object member or inserting into an array, and returns the new document.
+func pointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+		return doc, nil
+	case []interface{}:
+		idx, err := arrayIndex(last, len(node), true)
+		if err != nil {
+			return nil, err
+		}
+		node = append(node, nil)
+		copy(node[idx+1:], node[idx:])
+		node[idx] = value
+		return pointerSet(doc, path[:len(path)-1], node)
+	default:
+		return nil, fmt.Errorf("cannot add to a scalar at %q", last)
+	}
+}
+
+// pointerRemove removes the value a JSON pointer refers to, and returns the
+// new document along with the removed value.
+func pointerRemove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	last := path[len(path)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		v, ok := node[last]
+		if !ok {
+			return nil, nil, fmt.Errorf("no value at %q", last)
+		}
+		delete(node, last)
+		return doc, v, nil
+	case []interface{}:
+		idx, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		v := node[idx]
+		node = append(node[:idx:idx], node[idx+1:]...)
+		doc, err := pointerSet(doc, path[:len(path)-1], node)
+		return doc, v, err
+	default:
+		return nil, nil, fmt.Errorf("cannot remove from a scalar at %q", last)
+	}
+}
+
+// pointerSet replaces the value a JSON pointer refers to, which is needed
+// when an array changes length, and returns the new document.
+func pointerSet(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+	case []interface{}:
+		idx, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		node[idx] = value
+	}
+	return doc, nil
+}
@@ -0,0 +1,293 @@
+package mock
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-icap/icap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPatchApply(t *testing.T) {
+	repo := `{"name": "mock-proxy", "archived": false, "owner": {"login": "hashicorp", "id": 761456}, "topics": ["go", "icap"]}`
+
+	tcs := []struct {
+		name       string
+		patch      *Patch
+		body       string
+		wantBody   string
+		wantHeader http.Header
+		wantErr    string
+	}{
+		{
+			name:     "json merge",
+			patch:    &Patch{Kind: PatchJSONMerge, Value: `{"archived": true, "owner": {"id": null, "type": "Organization"}}`},
+			body:     repo,
+			wantBody: `{"archived":true,"name":"mock-proxy","owner":{"login":"hashicorp","type":"Organization"},"topics":["go","icap"]}`,
+		},
+		{
+			name: "json patch",
+			patch: &Patch{Kind: PatchJSONPatch, Value: `[
+				{"op": "test", "path": "/archived", "value": false},
+				{"op": "replace", "path": "/archived", "value": true},
+				{"op": "add", "path": "/topics/-", "value": "proxy"},
+				{"op": "add", "path": "/topics/0", "value": "mock"},
+				{"op": "remove", "path": "/topics/1"},
+				{"op": "copy", "from": "/owner/login", "path": "/org"},
+				{"op": "move", "from": "/owner/id", "path": "/owner_id"}
+			]`},
+			body:     repo,
+			wantBody: `{"archived":true,"name":"mock-proxy","org":"hashicorp","owner":{"login":"hashicorp"},"owner_id":761456,"topics":["mock","icap","proxy"]}`,
+		},
+		{
+			name:    "json patch failed test",
+			patch:   &Patch{Kind: PatchJSONPatch, Value: `[{"op": "test", "path": "/archived", "value": true}]`},
+			body:    repo,
+			wantErr: "test failed at /archived",
+		},
+		{
+			name:    "json patch missing path",
+			patch:   &Patch{Kind: PatchJSONPatch, Value: `[{"op": "remove", "path": "/license/key"}]`},
+			body:    repo,
+			wantErr: "no value",
+		},
+		{
+			name:     "json patch escaped pointer",
+			patch:    &Patch{Kind: PatchJSONPatch, Value: `[{"op": "add", "path": "/a~1b~0c", "value": 1}]`},
+			body:     `{}`,
+			wantBody: `{"a/b~c":1}`,
+		},
+		{
+			name:    "json body required",
+			patch:   &Patch{Kind: PatchJSONMerge, Value: `{}`},
+			body:    "<html></html>",
+			wantErr: "error decoding JSON",
+		},
+		{
+			name:       "header set",
+			patch:      &Patch{Kind: PatchHeader, Name: "X-RateLimit-Remaining", Value: "0"},
+			body:       repo,
+			wantBody:   repo,
+			wantHeader: http.Header{"Etag": {`"abc"`}, "X-Ratelimit-Remaining": {"0"}},
+		},
+		{
+			name:       "header remove",
+			patch:      &Patch{Kind: PatchHeader, Name: "ETag", Remove: true},
+			body:       repo,
+			wantBody:   repo,
+			wantHeader: http.Header{},
+		},
+		{
+			name:     "regex",
+			patch:    &Patch{Kind: PatchRegex, Regex: `"archived":\s*(\w+)`, Value: `"archived": true, "was_archived": $1`},
+			body:     repo,
+			wantBody: strings.Replace(repo, `"archived": false`, `"archived": true, "was_archived": false`, 1),
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			require.Nil(t, tc.patch.Validate())
+
+			h := http.Header{"Etag": {`"abc"`}}
+			got, err := tc.patch.apply(h, []byte(tc.body))
+			if tc.wantErr != "" {
+				require.NotNil(t, err)
+				assert.Contains(t, err.Error(), tc.wantErr)
+				return
+			}
+
+			require.Nil(t, err)
+			assert.Equal(t, tc.wantBody, string(got))
+			if tc.wantHeader != nil {
+				assert.Equal(t, tc.wantHeader, h)
+			}
+		})
+	}
+}
+
+func TestPatchValidate(t *testing.T) {
+	tcs := []struct {
+		name    string
+		patch   *Patch
+		wantErr string
+	}{
+		{name: "unknown kind", patch: &Patch{Kind: "xml"}, wantErr: "unknown patch kind"},
+		{name: "invalid merge", patch: &Patch{Kind: PatchJSONMerge, Value: "{"}, wantErr: "not valid JSON"},
+		{name: "invalid operation", patch: &Patch{Kind: PatchJSONPatch, Value: `[{"op": "frob", "path": "/a"}]`}, wantErr: "unknown JSON patch operation"},
+		{name: "missing value", patch: &Patch{Kind: PatchJSONPatch, Value: `[{"op": "add", "path": "/a"}]`}, wantErr: "requires a value"},
+		{name: "invalid pointer", patch: &Patch{Kind: PatchJSONPatch, Value: `[{"op": "remove", "path": "a"}]`}, wantErr: "must start with /"},
+		{name: "header without name", patch: &Patch{Kind: PatchHeader, Value: "x"}, wantErr: "requires a name"},
+		{name: "invalid regex", patch: &Patch{Kind: PatchRegex, Regex: "("}, wantErr: "requires a valid regex"},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := tc.patch.Validate()
+			require.NotNil(t, err)
+			assert.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
+
+func TestPatchResponseGzip(t *testing.T) {
+	t.Parallel()
+
+	compressed := &bytes.Buffer{}
+	gz := gzip.NewWriter(compressed)
+	_, err := gz.Write([]byte(`{"archived": false}`))
+	require.Nil(t, err)
+	require.Nil(t, gz.Close())
+
+	resp := &http.Response{
+		Header: http.Header{"Content-Encoding": {"gzip"}},
+		Body:   ioutil.NopCloser(compressed),
+	}
+	route := &Route{Type: "patch", Patches: []*Patch{
+		{Kind: PatchJSONMerge, Value: `{"archived": true}`},
+	}}
+
+	ms, err := NewMockServer(WithMockRoot("testdata/"))
+	require.Nil(t, err)
+
+	body, err := ms.patchResponse(route, resp)
+	require.Nil(t, err)
+	assert.Equal(t, `{"archived":true}`, string(body))
+	assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "17", resp.Header.Get("Content-Length"))
+}
+
+// addPatchRoute adds a patch Route for an upstream to a MockServer.
+func addPatchRoute(t *testing.T, ms *MockServer, host string) {
+	require.Nil(t, ms.AddRoute(&Route{
+		Host: host,
+		Path: "/orgs/:org",
+		Type: "patch",
+		Patches: []*Patch{
+			{Kind: PatchJSONMerge, Value: `{"method": "PATCHED"}`},
+			{Kind: PatchHeader, Name: "X-Patched", Value: "true"},
+		},
+	}))
+}
+
+func TestMockServerInterceptionRESPMODPatch(t *testing.T) {
+	t.Parallel()
+
+	upstream := newUpstream(t)
+	req, err := http.NewRequest(http.MethodGet, upstream.URL+"/orgs/hashicorp", nil)
+	require.Nil(t, err)
+	ms, err := NewMockServer(WithMockRoot("testdata/"))
+	require.Nil(t, err)
+	addPatchRoute(t, ms, req.URL.Host)
+
+	// REQMOD lets the request through to the upstream.
+	recorder := newICAPRecorder()
+	ms.interception(recorder, &icap.Request{Method: "REQMOD", Request: req})
+	assert.Equal(t, http.StatusNoContent, recorder.code)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+
+	// RESPMOD patches the real response.
+	recorder = newICAPRecorder()
+	ms.interception(recorder, &icap.Request{Method: "RESPMOD", Request: req, Response: resp})
+	require.Equal(t, http.StatusOK, recorder.code)
+	assert.Equal(t, resp, recorder.message)
+	assert.Equal(t, `{"method":"PATCHED"}`, recorder.body.String())
+	assert.Equal(t, "true", resp.Header.Get("X-Patched"))
+	assert.Equal(t, "41", resp.Header.Get("X-RateLimit-Remaining"))
+
+	// Responses to other requests are unmodified.
+	other, err := http.NewRequest(http.MethodGet, upstream.URL+"/users/octocat", nil)
+	require.Nil(t, err)
+	recorder = newICAPRecorder()
+	ms.interception(recorder, &icap.Request{Method: "RESPMOD", Request: other, Response: resp})
+	assert.Equal(t, http.StatusNoContent, recorder.code)
+}
+
+func TestProxyServerPatch(t *testing.T) {
+	t.Parallel()
+
+	upstream := newUpstream(t)
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	ps, err := NewProxyServer(WithMockRoot("testdata/"))
+	require.Nil(t, err)
+	defer ps.Close()
+	addPatchRoute(t, ps.MockServer, host)
+
+	resp, err := ps.Client().Get(upstream.URL + "/orgs/hashicorp")
+	require.Nil(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "true", resp.Header.Get("X-Patched"))
+	assert.Equal(t, `{"method":"PATCHED"}`, string(body))
+}
+
+func TestPatchUnpatchableUpstream(t *testing.T) {
+	t.Parallel()
+
+	const page = "<html><body>Bad Gateway</body></html>"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(page))
+	}))
+	t.Cleanup(upstream.Close)
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	t.Run("icap", func(t *testing.T) {
+		t.Parallel()
+
+		ms, err := NewMockServer(WithMockRoot("testdata/"))
+		require.Nil(t, err)
+		addPatchRoute(t, ms, host)
+
+		req, err := http.NewRequest(http.MethodGet, upstream.URL+"/orgs/hashicorp", nil)
+		require.Nil(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+
+		recorder := newICAPRecorder()
+		ms.interception(recorder, &icap.Request{Method: "RESPMOD", Request: req, Response: resp})
+		require.Equal(t, http.StatusOK, recorder.code)
+		assert.Equal(t, resp, recorder.message)
+		assert.Equal(t, page, recorder.body.String())
+		assert.Equal(t, "", resp.Header.Get("X-Patched"))
+	})
+
+	t.Run("proxy", func(t *testing.T) {
+		t.Parallel()
+
+		ps, err := NewProxyServer(WithMockRoot("testdata/"))
+		require.Nil(t, err)
+		defer ps.Close()
+		addPatchRoute(t, ps.MockServer, host)
+
+		resp, err := ps.Client().Get(upstream.URL + "/orgs/hashicorp")
+		require.Nil(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Nil(t, err)
+
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		assert.Equal(t, "text/html", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "", resp.Header.Get("X-Patched"))
+		assert.Equal(t, page, string(body))
+	})
+}
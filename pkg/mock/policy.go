@@ -0,0 +1,154 @@
+package mock
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// UnmatchedHeader is set on the error responses given to requests denied by
+// the UnmatchedPolicy, to tell them apart from responses sent by an upstream.
+const UnmatchedHeader = "X-Mock-Proxy-Unmatched"
+
+// UnmatchedPolicy controls whether requests that don't match any Route are
+// allowed through to their upstream.
+type UnmatchedPolicy string
+
+const (
+	// UnmatchedAllow lets every unmatched request through to its upstream.
+	// This is the default UnmatchedPolicy.
+	UnmatchedAllow UnmatchedPolicy = "allow"
+
+	// UnmatchedDeny fails every unmatched request with an error response,
+	// so that nothing leaks through to the internet.
+	UnmatchedDeny UnmatchedPolicy = "deny"
+
+	// UnmatchedDenyHosts fails unmatched requests to a list of hosts with an
+	// error response, and lets unmatched requests to other hosts through.
+	UnmatchedDenyHosts UnmatchedPolicy = "deny-hosts"
+)
+
+// WithUnmatchedPolicy is a functional option that sets whether the Mock server
+// lets requests that don't match any Route through to their upstream. The
+// UnmatchedDenyHosts policy requires the hosts to deny, which may start with
+// a "*." wildcard to also deny every subdomain:
+//   WithUnmatchedPolicy(UnmatchedDenyHosts, "api.github.com", "*.amazonaws.com")
+func WithUnmatchedPolicy(policy UnmatchedPolicy, hosts ...string) Option {
+	return func(m *MockServer) error {
+		switch policy {
+		case UnmatchedAllow, UnmatchedDeny:
+			if len(hosts) != 0 {
+				return fmt.Errorf("unmatched policy %q does not take hosts", policy)
+			}
+		case UnmatchedDenyHosts:
+			if len(hosts) == 0 {
+				return fmt.Errorf("unmatched policy %q requires hosts", policy)
+			}
+		default:
+			return fmt.Errorf("unknown unmatched policy %q", policy)
+		}
+
+		m.unmatchedPolicy = policy
+		m.deniedHosts = hosts
+		return nil
+	}
+}
+
+// WithDeniedResponse is a functional option that sets the status code and
+// body of the error response given to requests denied by the UnmatchedPolicy.
+// An empty body is replaced with a message naming the denied request.
+func WithDeniedResponse(status int, body string) Option {
+	return func(m *MockServer) error {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("invalid denied response status %d", status)
+		}
+		m.deniedStatus = status
+		m.deniedBody = body
+		return nil
+	}
+}
+
+// denied says if a request that doesn't match a Route should be failed rather
+// than let through to its upstream, according to the UnmatchedPolicy.
+func (ms *MockServer) denied(r *http.Request) bool {
+	if ms.unmatchedPolicy == UnmatchedAllow {
+		return false
+	}
+
+	host := r.URL.Host
+	if host == "" {
+		host = r.Host
+	}
+
+	// A CONNECT request can't match a Route, but must be allowed for hosts
+	// that Routes mock, as the HTTPS requests it carries may match.
+	if r.Method == http.MethodConnect && ms.mockedHost(host) {
+		return false
+	}
+
+	if ms.unmatchedPolicy == UnmatchedDeny {
+		return true
+	}
+	for _, pattern := range ms.deniedHosts {
+		if hostMatches(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// mockedHost says if any Route mocks a host, in the host:port form of a
+// CONNECT request.
+func (ms *MockServer) mockedHost(host string) bool {
+	host = routeHost(host)
+	for _, route := range ms.Routes() {
+		if route.Host == host {
+			return true
+		}
+	}
+	return false
+}
+
+// hostMatches says if a host, with or without a port, matches a host from the
+// deny list. A pattern of the form "*.example.com" matches every subdomain of
+// example.com, but not example.com itself.
+func hostMatches(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(host)
+
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+// deny fails a request that doesn't match a Route with the configured error
+// response, instead of letting it through to its upstream.
+func (ms *MockServer) deny(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.String()
+	if r.Method == http.MethodConnect {
+		target = r.Host
+	}
+	ms.logger.Warn("denied unmocked request", "method", r.Method, "url", target,
+		"policy", ms.unmatchedPolicy)
+
+	entry := newJournalEntry(r, false)
+	entry.Denied = true
+	entry.Status = ms.deniedStatus
+	ms.journal.add(entry)
+
+	body := ms.deniedBody
+	if body == "" {
+		body = fmt.Sprintf("mock-proxy: no mock for %s %s, and unmatched requests are denied\n",
+			r.Method, target)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set(UnmatchedHeader, "true")
+	w.WriteHeader(ms.deniedStatus)
+	_, _ = w.Write([]byte(body))
+}
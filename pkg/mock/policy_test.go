@@ -0,0 +1,171 @@
+package mock
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-icap/icap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithUnmatchedPolicy(t *testing.T) {
+	tcs := []struct {
+		name    string
+		option  Option
+		wantErr string
+	}{
+		{name: "allow", option: WithUnmatchedPolicy(UnmatchedAllow)},
+		{name: "deny", option: WithUnmatchedPolicy(UnmatchedDeny)},
+		{name: "deny hosts", option: WithUnmatchedPolicy(UnmatchedDenyHosts, "example.com")},
+		{name: "deny hosts without hosts", option: WithUnmatchedPolicy(UnmatchedDenyHosts), wantErr: "requires hosts"},
+		{name: "deny with hosts", option: WithUnmatchedPolicy(UnmatchedDeny, "example.com"), wantErr: "does not take hosts"},
+		{name: "unknown", option: WithUnmatchedPolicy("block"), wantErr: "unknown unmatched policy"},
+		{name: "denied response", option: WithDeniedResponse(http.StatusBadGateway, "")},
+		{name: "invalid denied response", option: WithDeniedResponse(0, "no"), wantErr: "invalid denied response status"},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := NewMockServer(WithMockRoot("testdata/"), tc.option)
+			if tc.wantErr != "" {
+				require.NotNil(t, err)
+				assert.Contains(t, err.Error(), tc.wantErr)
+				return
+			}
+			assert.Nil(t, err)
+		})
+	}
+}
+
+func TestMockServerDenied(t *testing.T) {
+	hosts := []string{"api.github.com", "*.amazonaws.com"}
+
+	tcs := []struct {
+		name   string
+		policy UnmatchedPolicy
+		method string
+		url    string
+		want   bool
+	}{
+		{name: "allow", policy: UnmatchedAllow, url: "http://api.github.com/", want: false},
+		{name: "deny", policy: UnmatchedDeny, url: "http://api.github.com/", want: true},
+		{name: "deny connect", policy: UnmatchedDeny, method: http.MethodConnect, url: "//api.github.com:443", want: true},
+		{name: "deny connect to mocked host", policy: UnmatchedDeny, method: http.MethodConnect, url: "//example.com:443", want: false},
+		{name: "listed host", policy: UnmatchedDenyHosts, url: "http://API.github.com/", want: true},
+		{name: "listed host with port", policy: UnmatchedDenyHosts, url: "http://api.github.com:8080/", want: true},
+		{name: "wildcard host", policy: UnmatchedDenyHosts, url: "http://s3.us-east-1.amazonaws.com/", want: true},
+		{name: "wildcard parent", policy: UnmatchedDenyHosts, url: "http://amazonaws.com/", want: false},
+		{name: "unlisted host", policy: UnmatchedDenyHosts, url: "http://github.com/", want: false},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var policyHosts []string
+			if tc.policy == UnmatchedDenyHosts {
+				policyHosts = hosts
+			}
+			ms, err := NewMockServer(WithMockRoot("testdata/"),
+				WithUnmatchedPolicy(tc.policy, policyHosts...))
+			require.Nil(t, err)
+
+			method := http.MethodGet
+			if tc.method != "" {
+				method = tc.method
+			}
+			req, err := http.NewRequest(method, tc.url, nil)
+			require.Nil(t, err)
+			if method == http.MethodConnect {
+				req.Host = strings.TrimPrefix(tc.url, "//")
+			}
+
+			assert.Equal(t, tc.want, ms.denied(req))
+		})
+	}
+}
+
+func TestMockServerInterceptionDenied(t *testing.T) {
+	t.Parallel()
+
+	ms, err := NewMockServer(WithMockRoot("testdata/"),
+		WithUnmatchedPolicy(UnmatchedDeny),
+		WithDeniedResponse(http.StatusBadGateway, "not mocked\n"))
+	require.Nil(t, err)
+
+	tcs := []struct {
+		url      string
+		wantCode int
+		wantBody string
+	}{
+		{url: "http://example.com/simple", wantCode: http.StatusOK, wantBody: "Hello, World!\n"},
+		{url: "http://example.com/unmatched", wantCode: http.StatusOK, wantBody: "not mocked\n"},
+	}
+
+	for _, tc := range tcs {
+		httpReq, err := http.NewRequest(http.MethodGet, tc.url, nil)
+		require.Nil(t, err, tc.url)
+
+		recorder := newICAPRecorder()
+		ms.interception(recorder, &icap.Request{Method: "REQMOD", Request: httpReq})
+
+		// Both are bridged HTTP responses, which the ICAP server sends in a
+		// 200 response.
+		assert.Equal(t, tc.wantCode, recorder.code, tc.url)
+		assert.Contains(t, recorder.body.String(), tc.wantBody, tc.url)
+	}
+
+	got := ms.Requests(JournalFilter{Path: "/unmatched"})
+	require.Len(t, got, 1)
+	assert.True(t, got[0].Denied)
+	assert.False(t, got[0].Passthrough)
+	assert.Equal(t, http.StatusBadGateway, got[0].Status)
+}
+
+func TestProxyServerDenied(t *testing.T) {
+	t.Parallel()
+
+	upstream := newUpstream(t)
+
+	ps, err := NewProxyServer(WithMockRoot("testdata/"), WithUnmatchedPolicy(UnmatchedDeny))
+	require.Nil(t, err)
+	defer ps.Close()
+
+	client := ps.Client()
+
+	// Mocked requests and the API are unaffected.
+	for _, url := range []string{"http://example.com/users/russell", ps.URL + "/health"} {
+		resp, err := client.Get(url)
+		require.Nil(t, err, url)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, url)
+	}
+
+	resp, err := client.Get(upstream.URL + "/real")
+	require.Nil(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, "true", resp.Header.Get(UnmatchedHeader))
+	assert.Contains(t, string(body), "no mock for GET "+upstream.URL+"/real")
+
+	// HTTPS requests to hosts that aren't mocked are refused a tunnel.
+	_, err = client.Get("https://" + strings.TrimPrefix(upstream.URL, "http://"))
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Forbidden")
+
+	got := ps.Requests(JournalFilter{})
+	require.Len(t, got, 3)
+	assert.True(t, got[1].Denied)
+	assert.True(t, got[2].Denied)
+	assert.Equal(t, http.MethodConnect, got[2].Method)
+}
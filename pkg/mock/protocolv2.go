@@ -0,0 +1,478 @@
+package mock
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	gitpackfile "gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	gitpktline "gopkg.in/src-d/go-git.v4/plumbing/format/pktline"
+	gitpackp "gopkg.in/src-d/go-git.v4/plumbing/protocol/packp"
+	gitcapability "gopkg.in/src-d/go-git.v4/plumbing/protocol/packp/capability"
+	gitsideband "gopkg.in/src-d/go-git.v4/plumbing/protocol/packp/sideband"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	gittransport "gopkg.in/src-d/go-git.v4/plumbing/transport"
+	gitserver "gopkg.in/src-d/go-git.v4/plumbing/transport/server"
+)
+
+// pktDelim is the delimiter packet of protocol v2, which separates the
+// sections of requests and responses. go-git has no support for it.
+const pktDelim = "0001"
+
+// v2Capabilities are the capabilities advertised to protocol v2 clients.
+var v2Capabilities = []string{
+	"version 2\n",
+	fmt.Sprintf("agent=%s\n", gitcapability.DefaultAgent),
+	"ls-refs\n",
+	"fetch=shallow filter\n",
+	"object-format=sha1\n",
+}
+
+// isProtocolV2 says if a git client asked for protocol v2, in the
+// colon-separated parameters of its Git-Protocol header.
+func isProtocolV2(r *http.Request) bool {
+	for _, param := range strings.Split(r.Header.Get("Git-Protocol"), ":") {
+		if param == "version=2" {
+			return true
+		}
+	}
+	return false
+}
+
+// advertiseV2 writes the protocol v2 capability advertisement of a git Route,
+// which, unlike the v0 reference advertisement, lists no references. Clients
+// list them with the ls-refs command instead.
+func (ms *MockServer) advertiseV2(
+	w http.ResponseWriter,
+	loader gitserver.Loader,
+	ep *gittransport.Endpoint,
+	successCode int,
+) {
+	ms.logger.Info("detected a protocol v2 capability advertisement request")
+
+	if _, err := loader.Load(ep); err != nil {
+		ms.logger.Error("failed loading git repo", "error", err.Error())
+		http.Error(w, fmt.Sprintf("failed loading git repo: %s",
+			err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/x-git-upload-pack-advertisement")
+	w.Header().Add("Cache-Control", "no-cache")
+	w.WriteHeader(successCode)
+
+	e := gitpktline.NewEncoder(w)
+	err := e.EncodeString(fmt.Sprintf("# service=%s\n", gittransport.UploadPackServiceName))
+	if err == nil {
+		err = e.Flush()
+	}
+	if err == nil {
+		err = e.EncodeString(v2Capabilities...)
+	}
+	if err == nil {
+		err = e.Flush()
+	}
+	if err != nil {
+		ms.logger.Error("failed writing response", "error", err.Error())
+	}
+}
+
+// serveV2 serves a protocol v2 git-upload-pack request, which runs a single
+// command, either ls-refs or fetch.
+func (ms *MockServer) serveV2(
+	w http.ResponseWriter,
+	body io.Reader,
+	sto storer.Storer,
+	successCode int,
+) {
+	req, err := decodeV2Request(body)
+	if err != nil {
+		ms.logger.Error("failed decoding git-upload-pack request", "error", err.Error())
+		http.Error(w, fmt.Sprintf("failed decoding git-upload-pack request: %s",
+			err.Error()), http.StatusBadRequest)
+		return
+	}
+	ms.logger.Info("detected a protocol v2 command", "command", req.command)
+
+	w.Header().Add("Content-Type", "application/x-git-upload-pack-result")
+	w.Header().Add("Cache-Control", "no-cache")
+
+	var write func(io.Writer) error
+	switch req.command {
+	case "ls-refs":
+		write, err = lsRefs(sto, req.args)
+	case "fetch":
+		write, err = fetchV2(sto, req.args)
+	default:
+		err = fmt.Errorf("unknown command %q", req.command)
+	}
+	if err != nil {
+		// As with v0, errors in the request are reported to git, which
+		// shows them as a remote error.
+		ms.logger.Error("failed running protocol v2 command", "command", req.command, "error", err.Error())
+		w.WriteHeader(successCode)
+		_ = gitpktline.NewEncoder(w).Encodef("ERR upload-pack: %s\n", err.Error())
+		return
+	}
+
+	w.WriteHeader(successCode)
+	if err := write(w); err != nil {
+		ms.logger.Error("failed writing git-upload-pack response", "error", err.Error())
+	}
+}
+
+// v2Request is a protocol v2 request: a command, the capabilities the client
+// is using, and the arguments of the command.
+type v2Request struct {
+	command      string
+	capabilities []string
+	args         []string
+}
+
+// decodeV2Request decodes a protocol v2 request, in which the capabilities
+// and the arguments are separated by a delimiter packet, and which ends with a
+// flush.
+func decodeV2Request(r io.Reader) (*v2Request, error) {
+	req := &v2Request{}
+	inArgs := false
+	for {
+		size, line, err := readPacket(r)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case size == 0:
+			if req.command == "" {
+				return nil, fmt.Errorf("missing command")
+			}
+			return req, nil
+		case size == 1:
+			if inArgs {
+				return nil, fmt.Errorf("unexpected delimiter")
+			}
+			inArgs = true
+		case inArgs:
+			req.args = append(req.args, line)
+		case strings.HasPrefix(line, "command="):
+			req.command = strings.TrimPrefix(line, "command=")
+		default:
+			req.capabilities = append(req.capabilities, line)
+		}
+	}
+}
+
+// readPacket reads a pkt-line, returning its length, which is 0 for a flush
+// and 1 for a delimiter, and its payload without a trailing newline.
+func readPacket(r io.Reader) (int, string, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, "", fmt.Errorf("error reading pkt-line: %w", err)
+	}
+
+	n, err := strconv.ParseUint(string(size[:]), 16, 16)
+	switch {
+	case err != nil:
+		return 0, "", fmt.Errorf("invalid pkt-line length %q", size)
+	case n == 0 || n == 1:
+		return int(n), "", nil
+	case n < 4:
+		return 0, "", fmt.Errorf("unexpected pkt-line length %q", size)
+	}
+
+	payload := make([]byte, n-4)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, "", fmt.Errorf("error reading pkt-line: %w", err)
+	}
+	return int(n), strings.TrimSuffix(string(payload), "\n"), nil
+}
+
+// parseObjectID parses the hex object ID in an argument of a protocol v2
+// command.
+func parseObjectID(id string) (plumbing.Hash, error) {
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 40 {
+		return plumbing.ZeroHash, fmt.Errorf("invalid object ID %q", id)
+	}
+	return plumbing.NewHash(id), nil
+}
+
+// lsRefs runs the ls-refs command, which lists HEAD and the references of a
+// repository, limited to those starting with any ref-prefix arguments. The
+// symrefs and peel arguments add the targets of symbolic references, and of
+// annotated tags.
+func lsRefs(sto storer.Storer, args []string) (func(io.Writer) error, error) {
+	var symrefs, peeled bool
+	prefixes := []string{}
+	for _, arg := range args {
+		switch {
+		case arg == "symrefs":
+			symrefs = true
+		case arg == "peel":
+			peeled = true
+		case strings.HasPrefix(arg, "ref-prefix "):
+			prefixes = append(prefixes, strings.TrimPrefix(arg, "ref-prefix "))
+		default:
+			return nil, fmt.Errorf("unexpected ls-refs argument %q", arg)
+		}
+	}
+
+	refs, err := sto.IterReferences()
+	if err != nil {
+		return nil, fmt.Errorf("error reading references: %w", err)
+	}
+	names := []plumbing.ReferenceName{}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name() != plumbing.HEAD {
+			names = append(names, ref.Name())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading references: %w", err)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	names = append([]plumbing.ReferenceName{plumbing.HEAD}, names...)
+
+	lines := []string{}
+	for _, name := range names {
+		if !hasAnyPrefix(name.String(), prefixes) {
+			continue
+		}
+
+		// Unborn and broken symbolic references aren't listed.
+		resolved, err := storer.ResolveReference(sto, name)
+		if err == plumbing.ErrReferenceNotFound {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("error resolving %s: %w", name, err)
+		}
+
+		line := fmt.Sprintf("%s %s", resolved.Hash(), name)
+		if symrefs {
+			ref, err := sto.Reference(name)
+			if err != nil {
+				return nil, fmt.Errorf("error reading %s: %w", name, err)
+			}
+			if ref.Type() == plumbing.SymbolicReference {
+				line += fmt.Sprintf(" symref-target:%s", ref.Target())
+			}
+		}
+		if peeled {
+			target, _, tags, err := peel(sto, resolved.Hash())
+			if err != nil {
+				return nil, err
+			}
+			if len(tags) != 0 {
+				line += fmt.Sprintf(" peeled:%s", target)
+			}
+		}
+		lines = append(lines, line+"\n")
+	}
+
+	return func(w io.Writer) error {
+		e := gitpktline.NewEncoder(w)
+		if err := e.EncodeString(lines...); err != nil {
+			return err
+		}
+		return e.Flush()
+	}, nil
+}
+
+// hasAnyPrefix says if s starts with any of prefixes, or if there are none.
+func hasAnyPrefix(s string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchV2 runs the fetch command, which is negotiated like a stateless v0
+// git-upload-pack request.
+func fetchV2(sto storer.Storer, args []string) (func(io.Writer) error, error) {
+	req := &uploadRequest{UploadRequest: gitpackp.NewUploadRequest()}
+	for _, arg := range args {
+		name, value := arg, ""
+		if i := strings.Index(arg, " "); i != -1 {
+			name, value = arg[:i], arg[i+1:]
+		}
+
+		var err error
+		switch name {
+		case "want", "have", "shallow":
+			var h plumbing.Hash
+			if h, err = parseObjectID(value); err != nil {
+				break
+			}
+			switch name {
+			case "want":
+				req.Wants = append(req.Wants, h)
+			case "have":
+				req.haves = append(req.haves, h)
+				req.negotiating = true
+			default:
+				req.Shallows = append(req.Shallows, h)
+			}
+		case "done":
+			req.done = true
+		case "deepen":
+			var depth int
+			if depth, err = strconv.Atoi(value); err != nil || depth <= 0 {
+				err = fmt.Errorf("invalid depth %q", value)
+				break
+			}
+			req.Depth = gitpackp.DepthCommits(depth)
+		case "deepen-relative", "deepen-since", "deepen-not":
+			err = errUnsupportedDeepen
+		case "filter":
+			req.filter, err = parseObjectFilter(value)
+		case "include-tag":
+			req.includeTag = true
+		case "thin-pack", "no-progress", "ofs-delta":
+		default:
+			err = fmt.Errorf("unexpected fetch argument %q", arg)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := negotiateUpload(sto, req)
+	if err != nil {
+		return nil, err
+	}
+	return func(w io.Writer) error {
+		return res.encodeV2(w, sto)
+	}, nil
+}
+
+// encodeV2 writes an uploadResult as the response to a protocol v2 fetch.
+// While the client is negotiating, that is the acknowledgments section, with
+// an ACK of each common commit, or a NAK when there are none. Once the client
+// is done, or if it had nothing to negotiate, that is the shallow-info section
+// when the client asked to deepen, then the packfile section, which is always
+// sent over sideband.
+func (res *uploadResult) encodeV2(w io.Writer, s storer.EncodedObjectStorer) error {
+	e := gitpktline.NewEncoder(w)
+
+	if res.negotiating && !res.done {
+		lines := []string{"acknowledgments\n"}
+		for _, h := range res.common {
+			lines = append(lines, fmt.Sprintf("ACK %s\n", h))
+		}
+		if len(res.common) == 0 {
+			lines = append(lines, "NAK\n")
+		}
+		if err := e.EncodeString(lines...); err != nil {
+			return err
+		}
+		return e.Flush()
+	}
+
+	if res.deepen {
+		lines := []string{"shallow-info\n"}
+		for _, h := range res.shallows {
+			lines = append(lines, fmt.Sprintf("shallow %s\n", h))
+		}
+		for _, h := range res.unshallows {
+			lines = append(lines, fmt.Sprintf("unshallow %s\n", h))
+		}
+		if err := e.EncodeString(lines...); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, pktDelim); err != nil {
+			return err
+		}
+	}
+
+	if err := e.EncodeString("packfile\n"); err != nil {
+		return err
+	}
+	mux := gitsideband.NewMuxer(gitsideband.Sideband64k, w)
+	if _, err := gitpackfile.NewEncoder(mux, s, false).Encode(res.objects, 10); err != nil {
+		return err
+	}
+	return e.Flush()
+}
+
+// objectFilter leaves objects out of a partial clone, as asked for by the
+// filter argument of a protocol v2 fetch. A nil objectFilter leaves nothing
+// out.
+type objectFilter struct {
+	// blobLimit leaves out blobs of at least this many bytes, unless it is
+	// negative.
+	blobLimit int64
+
+	// treeDepth leaves out trees and blobs at least this deep, where the root
+	// tree of a commit is 0 deep, unless it is negative.
+	treeDepth int
+}
+
+// parseObjectFilter parses the filter specs of blob:none, blob:limit=<n>[kmg]
+// and tree:<depth>.
+func parseObjectFilter(spec string) (*objectFilter, error) {
+	f := &objectFilter{blobLimit: -1, treeDepth: -1}
+	switch {
+	case spec == "blob:none":
+		f.blobLimit = 0
+	case strings.HasPrefix(spec, "blob:limit="):
+		limit := strings.ToLower(strings.TrimPrefix(spec, "blob:limit="))
+		unit := int64(1)
+		for i, suffix := range []string{"k", "m", "g"} {
+			if strings.HasSuffix(limit, suffix) {
+				limit = strings.TrimSuffix(limit, suffix)
+				unit = 1 << (10 * uint(i+1))
+				break
+			}
+		}
+		n, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid filter %q", spec)
+		}
+		f.blobLimit = n * unit
+	case strings.HasPrefix(spec, "tree:"):
+		depth, err := strconv.Atoi(strings.TrimPrefix(spec, "tree:"))
+		if err != nil || depth < 0 {
+			return nil, fmt.Errorf("invalid filter %q", spec)
+		}
+		f.treeDepth = depth
+	default:
+		return nil, fmt.Errorf("unsupported filter %q", spec)
+	}
+	return f, nil
+}
+
+// omitsTree says if a tree at a depth is left out.
+func (f *objectFilter) omitsTree(depth int) bool {
+	return f != nil && f.treeDepth >= 0 && depth >= f.treeDepth
+}
+
+// omitsBlob says if a blob at a depth is left out.
+func (f *objectFilter) omitsBlob(s storer.EncodedObjectStorer, h plumbing.Hash, depth int) (bool, error) {
+	switch {
+	case f == nil:
+		return false, nil
+	case f.omitsTree(depth) || f.blobLimit == 0:
+		return true, nil
+	case f.blobLimit < 0:
+		return false, nil
+	}
+
+	o, err := s.EncodedObject(plumbing.BlobObject, h)
+	if err != nil {
+		return false, fmt.Errorf("error reading blob %s: %w", h, err)
+	}
+	return o.Size() >= f.blobLimit, nil
+}
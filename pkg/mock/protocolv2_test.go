@@ -0,0 +1,246 @@
+package mock
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pktLines encodes lines as pkt-lines, other than flush and delimiter packets,
+// which are written as they are.
+func pktLines(lines ...string) string {
+	b := &strings.Builder{}
+	for _, line := range lines {
+		if line == "0000" || line == pktDelim {
+			b.WriteString(line)
+			continue
+		}
+		fmt.Fprintf(b, "%04x%s\n", len(line)+5, line)
+	}
+	return b.String()
+}
+
+func TestParseObjectFilter(t *testing.T) {
+	tcs := []struct {
+		spec    string
+		want    *objectFilter
+		wantErr string
+	}{
+		{spec: "blob:none", want: &objectFilter{blobLimit: 0, treeDepth: -1}},
+		{spec: "blob:limit=512", want: &objectFilter{blobLimit: 512, treeDepth: -1}},
+		{spec: "blob:limit=2k", want: &objectFilter{blobLimit: 2048, treeDepth: -1}},
+		{spec: "blob:limit=1M", want: &objectFilter{blobLimit: 1 << 20, treeDepth: -1}},
+		{spec: "tree:0", want: &objectFilter{blobLimit: -1, treeDepth: 0}},
+		{spec: "blob:limit=lots", wantErr: "invalid filter"},
+		{spec: "tree:-1", wantErr: "invalid filter"},
+		{spec: "sparse:oid=main:.sparse", wantErr: "unsupported filter"},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.spec, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := parseObjectFilter(tc.spec)
+			if tc.wantErr != "" {
+				require.NotNil(t, err)
+				assert.Contains(t, err.Error(), tc.wantErr)
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestProxyServerGitProtocolV2(t *testing.T) {
+	t.Parallel()
+
+	root, gitDir := newMockRepo(t, "example.com", "/repo")
+	work := filepath.Dir(gitDir)
+	commitFile(t, work, "large.bin", strings.Repeat("mock-proxy\n", 1000))
+	commitFile(t, work, "VERSION", "1.0.0\n")
+	mustGit(t, work, "tag", "-a", "v1.0.0", "-m", "Release 1.0.0")
+	commitFile(t, work, "docs/index.md", "# docs\n")
+	commitFile(t, work, "large.bin", strings.Repeat("mock-proxy 2\n", 1000))
+	commitFile(t, work, "VERSION", "1.1.0-dev\n")
+
+	ps, err := NewProxyServer(WithMockRoot(root))
+	require.Nil(t, err)
+	defer ps.Close()
+	require.Nil(t, ps.AddRoute(&Route{Host: "example.com", Path: "/repo", Type: "git"}))
+
+	git := func(dir string, args ...string) string {
+		return mustGit(t, dir, append([]string{"-c", "protocol.version=2", "-c", "http.proxy=" + ps.URL}, args...)...)
+	}
+	url := "http://example.com/repo"
+	tmp := newReloadRoot(t, "")
+
+	t.Run("advertisement", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, url+"/info/refs?service=git-upload-pack", nil)
+		req.Header.Set("Git-Protocol", "version=2")
+		recorder := httptest.NewRecorder()
+		ps.mockHandler(recorder, req)
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "version 2\n")
+		assert.Contains(t, recorder.Body.String(), "fetch=shallow filter\n")
+		assert.NotContains(t, recorder.Body.String(), "refs/heads/main")
+	})
+
+	t.Run("ls-remote", func(t *testing.T) {
+		out := git(tmp, "ls-remote", url, "refs/tags/*")
+		tag := mustGit(t, work, "rev-parse", "v1.0.0")
+		commit := mustGit(t, work, "rev-parse", "v1.0.0^{}")
+		assert.Equal(t, tag+"\trefs/tags/v1.0.0\n"+commit+"\trefs/tags/v1.0.0^{}", out)
+
+		out = git(tmp, "ls-remote", "--symref", url, "HEAD")
+		assert.Contains(t, out, "ref: refs/heads/main\tHEAD")
+	})
+
+	t.Run("clone", func(t *testing.T) {
+		dir := filepath.Join(tmp, "full")
+		git(tmp, "clone", "-q", url, dir)
+
+		assert.Equal(t, mustGit(t, work, "rev-parse", "HEAD"), mustGit(t, dir, "rev-parse", "HEAD"))
+		assert.Equal(t, "v1.0.0-3-g"+mustGit(t, work, "rev-parse", "--short=7", "HEAD"), mustGit(t, dir, "describe", "--abbrev=7"))
+		mustGit(t, dir, "fsck", "--strict")
+
+		commitFile(t, work, "CHANGELOG.md", "## 1.1.0\n")
+		mustGit(t, work, "tag", "-a", "v1.1.0", "-m", "Release 1.1.0")
+		defer mustGit(t, work, "tag", "-d", "v1.1.0")
+		defer mustGit(t, work, "reset", "-q", "--hard", "HEAD~1")
+
+		// Tags of fetched commits are followed.
+		git(dir, "pull", "-q", "--ff-only")
+		assert.FileExists(t, filepath.Join(dir, "CHANGELOG.md"))
+		assert.Equal(t, "v1.1.0", mustGit(t, dir, "describe"))
+		mustGit(t, dir, "fsck", "--strict")
+	})
+
+	t.Run("shallow clone", func(t *testing.T) {
+		dir := filepath.Join(tmp, "shallow")
+		git(tmp, "clone", "-q", "--depth", "1", url, dir)
+		assert.Equal(t, "1", mustGit(t, dir, "rev-list", "--count", "HEAD"))
+
+		git(dir, "fetch", "-q", "--unshallow")
+		assert.Equal(t, "6", mustGit(t, dir, "rev-list", "--count", "HEAD"))
+		mustGit(t, dir, "fsck", "--strict")
+	})
+
+	// Cloning checks out the last commit, so only objects of older commits
+	// are left missing.
+	older := []string{"v1.0.0^{tree}", "v1.0.0:VERSION", "v1.0.0:large.bin"}
+	tcs := []struct {
+		filter      string
+		wantMissing []string
+	}{
+		{filter: "blob:none", wantMissing: []string{"v1.0.0:VERSION", "v1.0.0:large.bin"}},
+		{filter: "blob:limit=1k", wantMissing: []string{"v1.0.0:large.bin"}},
+		// The blobs of missing trees can't be listed as missing.
+		{filter: "tree:0", wantMissing: []string{"v1.0.0^{tree}"}},
+	}
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run("partial clone "+tc.filter, func(t *testing.T) {
+			dir := filepath.Join(tmp, strings.NewReplacer(":", "-", "=", "-").Replace(tc.filter))
+			git(tmp, "clone", "-q", "--filter="+tc.filter, url, dir)
+			assert.FileExists(t, filepath.Join(dir, "docs", "index.md"))
+
+			missing := mustGit(t, dir, "rev-list", "--objects", "--missing=print", "--all")
+			for _, rev := range older {
+				want := false
+				for _, m := range tc.wantMissing {
+					want = want || m == rev
+				}
+				assert.Equal(t, want, strings.Contains(missing, "?"+mustGit(t, work, "rev-parse", rev)), rev)
+			}
+
+			// Missing objects are fetched when they are needed.
+			git(dir, "checkout", "-q", "v1.0.0")
+			assert.FileExists(t, filepath.Join(dir, "large.bin"))
+			assert.Equal(t, "1.0.0", mustGit(t, dir, "show", "HEAD:VERSION"))
+		})
+	}
+}
+
+func TestMockServerGitProtocolV2Errors(t *testing.T) {
+	root, gitDir := newMockRepo(t, "example.com", "/repo")
+	head := mustGit(t, gitDir, "--git-dir", gitDir, "rev-parse", "HEAD")
+
+	ms, err := NewMockServer(WithMockRoot(root))
+	require.Nil(t, err)
+	require.Nil(t, ms.AddRoute(&Route{Host: "example.com", Path: "/repo", Type: "git"}))
+
+	tcs := []struct {
+		name     string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "unknown command",
+			body:     pktLines("command=bundle-uri", "0000"),
+			wantCode: http.StatusOK,
+			wantBody: `ERR upload-pack: unknown command "bundle-uri"`,
+		},
+		{
+			name:     "unknown ls-refs argument",
+			body:     pktLines("command=ls-refs", pktDelim, "unborn", "0000"),
+			wantCode: http.StatusOK,
+			wantBody: `ERR upload-pack: unexpected ls-refs argument "unborn"`,
+		},
+		{
+			name:     "unknown want",
+			body:     pktLines("command=fetch", pktDelim, "want 0123456789012345678901234567890123456789", "done", "0000"),
+			wantCode: http.StatusOK,
+			wantBody: "ERR upload-pack: not our ref 0123456789012345678901234567890123456789",
+		},
+		{
+			name:     "deepen since",
+			body:     pktLines("command=fetch", pktDelim, "want "+head, "deepen-since 946684800", "done", "0000"),
+			wantCode: http.StatusOK,
+			wantBody: "ERR upload-pack: only deepen by a number of commits is supported",
+		},
+		{
+			name:     "unsupported filter",
+			body:     pktLines("command=fetch", pktDelim, "want "+head, "filter combine:blob:none+tree:0", "done", "0000"),
+			wantCode: http.StatusOK,
+			wantBody: `ERR upload-pack: unsupported filter "combine:blob:none+tree:0"`,
+		},
+		{
+			name:     "missing command",
+			body:     pktLines("agent=git/2.39.0", "0000"),
+			wantCode: http.StatusBadRequest,
+			wantBody: "missing command",
+		},
+		{
+			name:     "truncated",
+			body:     pktLines("command=fetch", pktDelim, "want "+head),
+			wantCode: http.StatusBadRequest,
+			wantBody: "error reading pkt-line",
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodPost, "http://example.com/repo/git-upload-pack",
+				strings.NewReader(tc.body))
+			req.Header.Set("Git-Protocol", "version=2")
+			recorder := httptest.NewRecorder()
+			ms.mockHandler(recorder, req)
+
+			assert.Equal(t, tc.wantCode, recorder.Code)
+			assert.Contains(t, recorder.Body.String(), tc.wantBody)
+		})
+	}
+}
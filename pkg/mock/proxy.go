@@ -0,0 +1,226 @@
+package mock
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// hopHeaders are the headers that describe a single connection, rather than
+// the request or response, so are not forwarded by the proxy.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers from a set of headers,
+// including any named by the Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range splitHeaderList(v) {
+			h.Del(name)
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// splitHeaderList splits a comma separated header value into its parts.
+func splitHeaderList(v string) []string {
+	parts := []string{}
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+// newTransport creates the http.RoundTripper used to forward requests that
+// aren't mocked. It never uses a proxy itself, as it would likely be this one.
+func newTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	return t
+}
+
+// ServeHTTP makes MockServer a forward HTTP proxy, which can be used in place
+// of Squid and ICAP. Requests sent through the proxy, which use absolute-form
+// request URIs, are served a mock if they match a Route, and are otherwise
+// forwarded to their upstream. HTTPS requests, sent using CONNECT, are
+// decrypted and handled the same way if a CA is configured and a Route mocks
+// their host, and are otherwise tunnelled. Requests sent to the proxy itself
+// are served by the API.
+func (ms *MockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodConnect:
+		ms.handleConnect(w, r)
+	case !r.URL.IsAbs() || isLocalAddr(r, r.URL.Host):
+		ms.api.ServeHTTP(w, r)
+	default:
+		ms.proxy(w, r)
+	}
+}
+
+// proxy serves a request sent through the forward proxy, with a mock if it
+// matches a Route, or otherwise by passing it through to its upstream, unless
+// the UnmatchedPolicy denies it.
+func (ms *MockServer) proxy(w http.ResponseWriter, r *http.Request) {
+	route, _ := ms.matchRoute(r)
+	if route != nil && route.Type != "patch" && !ms.shouldRecord(r, route) {
+		ms.mockHandler(w, r)
+		return
+	}
+	if route == nil && ms.denied(r) {
+		ms.deny(w, r)
+		return
+	}
+
+	ms.passthrough(w, r, route)
+}
+
+// isLocalAddr says if a host is the address the request was received on, so
+// that requests sent through the proxy to the proxy itself don't loop.
+func isLocalAddr(r *http.Request, host string) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.String() == host
+}
+
+// passthrough forwards a request to its upstream, and copies the upstream
+// response back to the client, patching or recording it if required.
+func (ms *MockServer) passthrough(w http.ResponseWriter, r *http.Request, route *Route) {
+	entry := newJournalEntry(r, false)
+	entry.Route = route
+	entry.Passthrough = true
+	ms.journal.add(entry)
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	removeHopHeaders(out.Header)
+
+	resp, err := ms.transport.RoundTrip(out)
+	if err != nil {
+		ms.logger.Error("failed forwarding request upstream", "error", err.Error())
+		http.Error(w, fmt.Sprintf("failed forwarding request upstream: %s",
+			err.Error()), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	var body io.Reader = resp.Body
+	if route != nil && route.Type == "patch" && !ms.shouldRecord(r, route) {
+		b, err := ms.patchResponse(route, resp)
+		if err != nil {
+			ms.logger.Error("failed reading upstream response", "error", err.Error())
+			http.Error(w, fmt.Sprintf("failed reading upstream response: %s",
+				err.Error()), http.StatusBadGateway)
+			return
+		}
+		body = bytes.NewReader(b)
+	} else if ms.shouldRecord(r, route) {
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			ms.logger.Error("failed reading upstream response", "error", err.Error())
+			http.Error(w, fmt.Sprintf("failed reading upstream response: %s",
+				err.Error()), http.StatusBadGateway)
+			return
+		}
+
+		recorded, err := ms.record(r, resp, b)
+		if err != nil {
+			ms.logger.Error("failed recording upstream response", "error", err.Error())
+		} else {
+			ms.logger.Info("recorded upstream response", "route", fmt.Sprintf("%+v", recorded))
+		}
+		body = bytes.NewReader(b)
+	}
+
+	removeHopHeaders(resp.Header)
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, body); err != nil {
+		ms.logger.Error("failed copying upstream response", "error", err.Error())
+	}
+}
+
+// ProxyServer is a MockServer running as a forward HTTP proxy on a local port,
+// for use in Go tests without Squid, ICAP or any fixed ports. It is similar to
+// an httptest.Server.
+type ProxyServer struct {
+	*MockServer
+
+	// URL is the base URL of the proxy, of the form http://127.0.0.1:port.
+	// The API is also served at this URL.
+	URL string
+
+	server *http.Server
+}
+
+// NewProxyServer creates a MockServer with the given options, and starts it
+// as a forward HTTP proxy on a random local port. The caller should call
+// Close when finished, to shut it down.
+func NewProxyServer(options ...Option) (*ProxyServer, error) {
+	ms, err := NewMockServer(options...)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("error listening for proxy: %w", err)
+	}
+
+	ps := &ProxyServer{
+		MockServer: ms,
+		URL:        "http://" + l.Addr().String(),
+		server:     &http.Server{Handler: ms},
+	}
+	go func() {
+		_ = ps.server.Serve(l)
+	}()
+
+	return ps, nil
+}
+
+// ProxyURL returns the URL of the proxy, for use as http.Transport.Proxy.
+func (ps *ProxyServer) ProxyURL(*http.Request) (*url.URL, error) {
+	return url.Parse(ps.URL)
+}
+
+// Client returns an http.Client that sends every request through the proxy,
+// and trusts its CA, if it has one.
+func (ps *ProxyServer) Client() *http.Client {
+	transport := &http.Transport{Proxy: ps.ProxyURL}
+	if ps.ca != nil {
+		pool := x509.NewCertPool()
+		pool.AddCert(ps.ca.Leaf)
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: transport}
+}
+
+// Close shuts down the proxy, waiting for in flight requests to complete.
+func (ps *ProxyServer) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = ps.server.Shutdown(ctx)
+}
@@ -0,0 +1,108 @@
+package mock
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyServer(t *testing.T) {
+	t.Parallel()
+
+	upstream := newUpstream(t)
+
+	ps, err := NewProxyServer(WithMockRoot("testdata/"))
+	require.Nil(t, err)
+	defer ps.Close()
+
+	// A second instance can run alongside the first.
+	other, err := NewProxyServer(WithMockRoot("testdata/"))
+	require.Nil(t, err)
+	defer other.Close()
+	assert.NotEqual(t, ps.URL, other.URL)
+
+	client := ps.Client()
+
+	tcs := []struct {
+		name        string
+		method      string
+		url         string
+		wantCode    int
+		wantBody    string
+		passthrough bool
+	}{
+		{
+			name:     "mocked",
+			method:   http.MethodGet,
+			url:      "http://example.com/users/russell",
+			wantCode: http.StatusOK,
+			wantBody: "russell\n",
+		},
+		{
+			name:        "passed through",
+			method:      http.MethodPost,
+			url:         upstream.URL + "/real",
+			wantCode:    http.StatusCreated,
+			wantBody:    `{"method": "POST"}`,
+			passthrough: true,
+		},
+		{
+			name:     "api",
+			method:   http.MethodGet,
+			url:      ps.URL + "/health",
+			wantCode: http.StatusOK,
+		},
+	}
+
+	for _, tc := range tcs {
+		req, err := http.NewRequest(tc.method, tc.url, nil)
+		require.Nil(t, err, tc.name)
+
+		resp, err := client.Do(req)
+		require.Nil(t, err, tc.name)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Nil(t, err, tc.name)
+
+		assert.Equal(t, tc.wantCode, resp.StatusCode, tc.name)
+		assert.Equal(t, tc.wantBody, string(body), tc.name)
+	}
+
+	got := ps.Requests(JournalFilter{})
+	require.Len(t, got, 2)
+	assert.False(t, got[0].Passthrough)
+	assert.True(t, got[1].Passthrough)
+	assert.Equal(t, "/real", got[1].Path)
+
+	// Nothing was sent through the other instance.
+	assert.Empty(t, other.Requests(JournalFilter{}))
+}
+
+func TestProxyServerRecord(t *testing.T) {
+	t.Parallel()
+
+	root := newRecordingRoot(t)
+	upstream := newUpstream(t)
+
+	ps, err := NewProxyServer(WithMockRoot(root), WithMode(ModeRecord))
+	require.Nil(t, err)
+	defer ps.Close()
+
+	resp, err := ps.Client().Get(upstream.URL + "/orgs/hashicorp/repos")
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	// Having been recorded, the next request is served from the new mock.
+	upstream.Close()
+	resp, err = ps.Client().Get(upstream.URL + "/orgs/hashicorp/repos")
+	require.Nil(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, `{"method": "GET"}`, string(body))
+}
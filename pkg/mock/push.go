@@ -0,0 +1,273 @@
+package mock
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	gitpackfile "gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	gitpktline "gopkg.in/src-d/go-git.v4/plumbing/format/pktline"
+	gitpackp "gopkg.in/src-d/go-git.v4/plumbing/protocol/packp"
+	gitcapability "gopkg.in/src-d/go-git.v4/plumbing/protocol/packp/capability"
+	gitsideband "gopkg.in/src-d/go-git.v4/plumbing/protocol/packp/sideband"
+	gittransport "gopkg.in/src-d/go-git.v4/plumbing/transport"
+	gitserver "gopkg.in/src-d/go-git.v4/plumbing/transport/server"
+	gitmemory "gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+// The push policies of a git Route, which decide what happens to a git push.
+const (
+	// PushApply accepts a push and applies it to the mock repository, so
+	// later clones see it.
+	PushApply = "apply"
+
+	// PushDiscard accepts a push, after checking its packfile, but leaves the
+	// mock repository as it was, so every test starts from the same state.
+	PushDiscard = "discard"
+
+	// PushReject rejects a push, sending the PushMessage of the Route to the
+	// client over sideband, where git shows it as a remote message.
+	PushReject = "reject"
+)
+
+// defaultPushMessage is sent when a push is rejected by a Route without a
+// PushMessage.
+const defaultPushMessage = "mock-proxy: pushes to this repository are rejected"
+
+// noThinCapability asks git clients to send complete packfiles, which can be
+// checked without the objects of the mock repository. go-git has no constant
+// for it.
+const noThinCapability gitcapability.Capability = "no-thin"
+
+// isReceivePack says if a request is part of a git push.
+func isReceivePack(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, "/"+gittransport.ReceivePackServiceName) ||
+		r.URL.Query().Get("service") == gittransport.ReceivePackServiceName
+}
+
+// receivePack serves the two requests of a git push to a git Route, the
+// reference advertisement and the git-receive-pack request, according to the
+// Route's push policy.
+func (ms *MockServer) receivePack(
+	w http.ResponseWriter,
+	r *http.Request,
+	route *Route,
+	loader gitserver.Loader,
+	path string,
+	successCode int,
+) {
+	ms.logger.Info("detected a git push attempt", "policy", route.Push)
+
+	ep := gitEndpoint(path)
+
+	// Applied pushes write to the mock repository, so only one is handled
+	// at a time, and nothing else reads the repository meanwhile.
+	if route.Push == PushApply && r.Method == http.MethodPost {
+		ms.pushMu.Lock()
+		defer ms.pushMu.Unlock()
+	} else {
+		ms.pushMu.RLock()
+		defer ms.pushMu.RUnlock()
+	}
+
+	sess, err := gitserver.NewServer(loader).NewReceivePackSession(ep, nil)
+	if err != nil {
+		ms.logger.Error("failed creating git-receive-pack session", "error", err.Error())
+		http.Error(w, fmt.Sprintf("failed creating git-receive-pack session: %s",
+			err.Error()), http.StatusInternalServerError)
+		return
+	}
+	defer sess.Close()
+
+	if r.Method == http.MethodGet {
+		ms.logger.Info("detected a receive-pack reference advertisement request")
+
+		refs, err := sess.AdvertisedReferences()
+		if err != nil {
+			ms.logger.Error("failed to load reference advertisement", "error", err.Error())
+			http.Error(w, fmt.Sprintf("failed to load reference advertisement: %s",
+				err.Error()), http.StatusInternalServerError)
+			return
+		}
+
+		for _, c := range []gitcapability.Capability{gitcapability.Sideband64k, noThinCapability} {
+			if err := refs.Capabilities.Add(c); err != nil {
+				ms.logger.Error("failed to add capability", "capability", c, "error", err.Error())
+				http.Error(w, fmt.Sprintf("failed to add capability %s: %s",
+					c, err.Error()), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		refs.Prefix = [][]byte{
+			[]byte(fmt.Sprintf("# service=%s", gittransport.ReceivePackServiceName)),
+			gitpktline.Flush,
+		}
+		w.Header().Add("Content-Type", "application/x-git-receive-pack-advertisement")
+		w.Header().Add("Cache-Control", "no-cache")
+
+		w.WriteHeader(successCode)
+		if err := refs.Encode(w); err != nil {
+			ms.logger.Error("failed writing response", "error", err.Error())
+		}
+		return
+	}
+
+	req := gitpackp.NewReferenceUpdateRequest()
+	if err := req.Decode(r.Body); err != nil {
+		ms.logger.Error("failed decoding git-receive-pack request", "error", err.Error())
+		http.Error(w, fmt.Sprintf("failed decoding git-receive-pack request: %s",
+			err.Error()), http.StatusBadRequest)
+		return
+	}
+	req.Packfile = nonEmptyPackfile(req.Packfile)
+
+	// go-git doesn't support sideband, so it is added around its report.
+	band := gitsideband.Type(0)
+	switch {
+	case req.Capabilities.Supports(gitcapability.Sideband64k):
+		band = gitsideband.Sideband64k
+	case req.Capabilities.Supports(gitcapability.Sideband):
+		band = gitsideband.Sideband
+	}
+	req.Capabilities.Delete(gitcapability.Sideband64k)
+	req.Capabilities.Delete(gitcapability.Sideband)
+
+	var status *gitpackp.ReportStatus
+	var message string
+	switch route.Push {
+	case PushApply:
+		status, err = sess.ReceivePack(r.Context(), req)
+		if err != nil {
+			ms.logger.Error("failed applying git push", "error", err.Error())
+		}
+	case PushDiscard:
+		status = discardPush(req)
+	default:
+		message = route.PushMessage
+		if message == "" {
+			message = defaultPushMessage
+		}
+		status = rejectPush(req, message)
+	}
+	if !req.Capabilities.Supports(gitcapability.ReportStatus) {
+		status = nil
+	}
+
+	w.Header().Add("Content-Type", "application/x-git-receive-pack-result")
+	w.Header().Add("Cache-Control", "no-cache")
+	w.WriteHeader(successCode)
+
+	if err := writePushResult(w, band, status, message); err != nil {
+		ms.logger.Error("failed writing response", "error", err.Error())
+	}
+}
+
+// nonEmptyPackfile returns nil for an empty packfile, which is sent when a
+// push only deletes references, and which go-git would fail to unpack.
+func nonEmptyPackfile(packfile io.ReadCloser) io.ReadCloser {
+	if packfile == nil {
+		return nil
+	}
+
+	br := bufio.NewReader(packfile)
+	if _, err := br.Peek(1); err != nil {
+		packfile.Close()
+		return nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{br, packfile}
+}
+
+// discardPush checks the packfile of a push by unpacking it into memory, and
+// reports every command as successful if it can be unpacked.
+func discardPush(req *gitpackp.ReferenceUpdateRequest) *gitpackp.ReportStatus {
+	status := gitpackp.NewReportStatus()
+	status.UnpackStatus = "ok"
+
+	if req.Packfile != nil {
+		defer req.Packfile.Close()
+
+		p, err := gitpackfile.NewParserWithStorage(
+			gitpackfile.NewScanner(req.Packfile), gitmemory.NewStorage(),
+		)
+		if err == nil {
+			_, err = p.Parse()
+		}
+		if err != nil {
+			status.UnpackStatus = err.Error()
+		}
+	}
+
+	for _, cmd := range req.Commands {
+		cmdStatus := "ok"
+		if status.UnpackStatus != "ok" {
+			cmdStatus = "unpacker error"
+		}
+		status.CommandStatuses = append(status.CommandStatuses, &gitpackp.CommandStatus{
+			ReferenceName: cmd.Name,
+			Status:        cmdStatus,
+		})
+	}
+	return status
+}
+
+// rejectPush reads and throws away the packfile of a push, and reports every
+// command as rejected, with the first line of message as the reason.
+func rejectPush(req *gitpackp.ReferenceUpdateRequest, message string) *gitpackp.ReportStatus {
+	if req.Packfile != nil {
+		_, _ = io.Copy(ioutil.Discard, req.Packfile)
+		req.Packfile.Close()
+	}
+
+	reason := strings.TrimSpace(strings.SplitN(strings.TrimSpace(message), "\n", 2)[0])
+
+	status := gitpackp.NewReportStatus()
+	status.UnpackStatus = "ok"
+	for _, cmd := range req.Commands {
+		status.CommandStatuses = append(status.CommandStatuses, &gitpackp.CommandStatus{
+			ReferenceName: cmd.Name,
+			Status:        reason,
+		})
+	}
+	return status
+}
+
+// writePushResult writes the result of a push, which is the report of the
+// status of each command, if the client asked for one. When the client asked
+// for sideband, the report is sent in the pack data channel, preceded by any
+// message in the progress channel, which git shows prefixed with "remote:".
+func writePushResult(w io.Writer, band gitsideband.Type, status *gitpackp.ReportStatus, message string) error {
+	report := &bytes.Buffer{}
+	if status != nil {
+		if err := status.Encode(report); err != nil {
+			return err
+		}
+	}
+
+	if band == 0 {
+		_, err := w.Write(report.Bytes())
+		return err
+	}
+
+	mux := gitsideband.NewMuxer(band, w)
+	if message != "" {
+		for _, line := range strings.Split(strings.TrimRight(message, "\n"), "\n") {
+			if _, err := mux.WriteChannel(gitsideband.ProgressMessage, []byte(line+"\n")); err != nil {
+				return err
+			}
+		}
+	}
+	if report.Len() != 0 {
+		if _, err := mux.Write(report.Bytes()); err != nil {
+			return err
+		}
+	}
+	return gitpktline.NewEncoder(w).Flush()
+}
@@ -0,0 +1,217 @@
+package mock
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// requireGit skips a test when the git binary isn't installed.
+func requireGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+}
+
+// runGit runs git in a directory, isolated from any user or system config, and
+// returns its combined output.
+func runGit(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{
+		"-c", "user.name=mock-proxy", "-c", "user.email=mock-proxy@example.com",
+		"-c", "init.defaultBranch=main", "-c", "protocol.version=0",
+	}, args...)...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_CONFIG_NOSYSTEM=1", "GIT_CONFIG_GLOBAL=/dev/null", "HOME="+dir, "GIT_TERMINAL_PROMPT=0",
+	)
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// mustGit runs git, failing the test if it fails.
+func mustGit(t *testing.T, dir string, args ...string) string {
+	out, err := runGit(dir, args...)
+	require.Nil(t, err, out)
+	return strings.TrimSpace(out)
+}
+
+// newMockRepo creates a mock root holding a git repository for a host and
+// path, with a single commit on main, and returns the mock root and the git
+// directory of the repository.
+func newMockRepo(t *testing.T, host, path string) (string, string) {
+	requireGit(t)
+
+	root := newReloadRoot(t, "")
+	work := filepath.Join(root, "git", host, path)
+	require.Nil(t, os.MkdirAll(work, 0755))
+
+	mustGit(t, work, "init", "-q")
+	mustGit(t, work, "symbolic-ref", "HEAD", "refs/heads/main")
+	require.Nil(t, ioutil.WriteFile(filepath.Join(work, "README.md"), []byte("# mock\n"), 0644))
+	mustGit(t, work, "add", "README.md")
+	mustGit(t, work, "commit", "-q", "-m", "Initial commit")
+
+	return root, filepath.Join(work, ".git")
+}
+
+// cloneAndCommit clones a mock repository through a ProxyServer, and commits a
+// new file to the clone, returning its directory.
+func cloneAndCommit(t *testing.T, ps *ProxyServer, url string) string {
+	dir := filepath.Join(newReloadRoot(t, ""), "clone")
+	mustGit(t, filepath.Dir(dir), "-c", "http.proxy="+ps.URL, "clone", "-q", url, dir)
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "CHANGELOG.md"), []byte("## 1.0.0\n"), 0644))
+	mustGit(t, dir, "add", "CHANGELOG.md")
+	mustGit(t, dir, "commit", "-q", "-m", "Release 1.0.0")
+	return dir
+}
+
+func TestRouteValidatePush(t *testing.T) {
+	tcs := []struct {
+		name    string
+		route   *Route
+		wantErr string
+	}{
+		{
+			name:  "apply",
+			route: &Route{Host: "github.com", Path: "/repo", Type: "git", Push: PushApply},
+		},
+		{
+			name:  "reject with a message",
+			route: &Route{Host: "github.com", Path: "/repo", Type: "git", Push: PushReject, PushMessage: "no"},
+		},
+		{
+			name:    "unknown policy",
+			route:   &Route{Host: "github.com", Path: "/repo", Type: "git", Push: "maybe"},
+			wantErr: "unknown push policy",
+		},
+		{
+			name:    "http route",
+			route:   &Route{Host: "github.com", Path: "/repo", Type: "http", Push: PushApply},
+			wantErr: "only git routes",
+		},
+		{
+			name:    "message without rejecting",
+			route:   &Route{Host: "github.com", Path: "/repo", Type: "git", Push: PushDiscard, PushMessage: "no"},
+			wantErr: "only the reject push policy",
+		},
+		{
+			name:    "apply to a templated repo",
+			route:   &Route{Host: "github.com", Path: "/:org/:repo", Type: "git", Push: PushApply},
+			wantErr: "can't be used with a templated git repo",
+		},
+		{
+			name:  "discard to a templated repo",
+			route: &Route{Host: "github.com", Path: "/:org/:repo", Type: "git", Push: PushDiscard},
+		},
+		{
+			name:    "message without a policy",
+			route:   &Route{Host: "github.com", Path: "/repo", Type: "git", PushMessage: "no"},
+			wantErr: "requires a push policy",
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := tc.route.Validate()
+			if tc.wantErr != "" {
+				require.NotNil(t, err)
+				assert.Contains(t, err.Error(), tc.wantErr)
+				return
+			}
+			assert.Nil(t, err)
+		})
+	}
+}
+
+func TestProxyServerGitPush(t *testing.T) {
+	tcs := []struct {
+		name        string
+		push        string
+		message     string
+		wantErr     bool
+		wantOutput  []string
+		wantApplied bool
+	}{
+		{
+			name:        "apply",
+			push:        PushApply,
+			wantApplied: true,
+		},
+		{
+			name: "discard",
+			push: PushDiscard,
+		},
+		{
+			name:       "reject",
+			push:       PushReject,
+			message:    "Pushes are disabled during the freeze.\nTry again on Monday.",
+			wantErr:    true,
+			wantOutput: []string{"remote: Pushes are disabled during the freeze.", "remote: Try again on Monday.", "[remote rejected]"},
+		},
+		{
+			name:       "reject by default",
+			push:       PushReject,
+			wantErr:    true,
+			wantOutput: []string{"remote: " + defaultPushMessage},
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			root, gitDir := newMockRepo(t, "example.com", "/repo")
+			before := mustGit(t, gitDir, "--git-dir", gitDir, "rev-parse", "refs/heads/main")
+
+			ps, err := NewProxyServer(WithMockRoot(root))
+			require.Nil(t, err)
+			defer ps.Close()
+			require.Nil(t, ps.AddRoute(&Route{
+				Host:        "example.com",
+				Path:        "/repo",
+				Type:        "git",
+				Push:        tc.push,
+				PushMessage: tc.message,
+			}))
+
+			dir := cloneAndCommit(t, ps, "http://example.com/repo")
+			pushed := mustGit(t, dir, "rev-parse", "HEAD")
+
+			out, err := runGit(dir, "-c", "http.proxy="+ps.URL, "push", "origin", "main", "main:refs/heads/release")
+			if tc.wantErr {
+				assert.NotNil(t, err, out)
+			} else {
+				assert.Nil(t, err, out)
+			}
+			for _, want := range tc.wantOutput {
+				assert.Contains(t, out, want)
+			}
+
+			after := mustGit(t, gitDir, "--git-dir", gitDir, "rev-parse", "refs/heads/main")
+			release, releaseErr := runGit(gitDir, "--git-dir", gitDir, "rev-parse", "--verify", "-q", "refs/heads/release")
+			if tc.wantApplied {
+				assert.Equal(t, pushed, after)
+				assert.Equal(t, pushed, strings.TrimSpace(release))
+
+				// Later clones see the push.
+				clone := filepath.Join(newReloadRoot(t, ""), "again")
+				mustGit(t, filepath.Dir(clone), "-c", "http.proxy="+ps.URL, "clone", "-q", "http://example.com/repo", clone)
+				assert.FileExists(t, filepath.Join(clone, "CHANGELOG.md"))
+			} else {
+				assert.Equal(t, before, after)
+				assert.NotNil(t, releaseErr, release)
+			}
+		})
+	}
+}
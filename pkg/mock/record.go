@@ -0,0 +1,211 @@
+package mock
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// unrecordedHeaders are the response headers that are not written to the
+// response file of a recorded mock, as they either describe the connection
+// rather than the response, or are set by mockHandler itself.
+var unrecordedHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Encoding":  true,
+	"Content-Length":    true,
+	"Content-Type":      true,
+	"Date":              true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// shouldRecord says if the upstream response to a request should be recorded,
+// given the Route it matched, if any.
+func (ms *MockServer) shouldRecord(req *http.Request, route *Route) bool {
+	if ms.mode != ModeRecord {
+		return false
+	}
+	return route == nil || req.Header.Get(RecordHeader) != ""
+}
+
+// record writes a captured upstream response out as a method specific mock
+// file, along with a response file holding its status and headers. If no
+// Route already serves the request, a new one is appended to the routes file
+// and added to the running RouteConfig. A request with a query is recorded
+// with a query Matcher for each of its parameters, and a mock file named after
+// a hash of the query.
+func (ms *MockServer) record(
+	req *http.Request,
+	resp *http.Response,
+	body []byte,
+) (*Route, error) {
+	host := req.URL.Host
+	if host == "" {
+		host = req.Host
+	}
+	route := &Route{
+		Host:   host,
+		Path:   req.URL.Path,
+		Type:   "http",
+		Method: req.Method,
+	}
+
+	path, _, err := route.ParseURL(req.URL)
+	if err != nil {
+		return nil, fmt.Errorf("error finding mock file path: %w", err)
+	}
+	mockPath := methodMockPath(path, req.Method)
+
+	// Requests that only differ by their query, like the pages of a list,
+	// are recorded as separate Routes, each matching its query parameters
+	// and with a mock file of its own.
+	if req.URL.RawQuery != "" {
+		query := req.URL.Query()
+		keys := make([]string, 0, len(query))
+		for k := range query {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			for _, v := range query[k] {
+				v := v
+				route.Matchers = append(route.Matchers, &Matcher{Kind: MatchQuery, Name: k, Equals: &v})
+			}
+		}
+
+		sum := sha256.Sum256([]byte(query.Encode()))
+		mockPath = fmt.Sprintf("%s.%x.mock", strings.TrimSuffix(mockPath, ".mock"), sum[:4])
+		route.File = mockPath
+	}
+
+	// Don't allow a crafted request path to write outside of the mocks root.
+	root := filepath.Clean(ms.mockFilesRoot)
+	fileName := filepath.Join(root, mockPath)
+	if !strings.HasPrefix(fileName, root+string(filepath.Separator)) {
+		return nil, fmt.Errorf("mock file path %s is outside of %s", fileName, root)
+	}
+
+	// Store bodies uncompressed, so that the mock files can be edited.
+	body, err = decompressBody(resp.Header, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Recorded bodies are served byte-for-byte, as any {{ in them came from
+	// the upstream rather than being meant for mock-proxy.
+	template := false
+	mr := &MockResponse{
+		Status:      resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		Headers:     map[string]string{},
+		Template:    &template,
+	}
+	for k, v := range resp.Header {
+		if !unrecordedHeaders[http.CanonicalHeaderKey(k)] {
+			mr.Headers[k] = strings.Join(v, ", ")
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return nil, fmt.Errorf("error creating mock file directory: %w", err)
+	}
+	if err := ioutil.WriteFile(fileName, body, 0644); err != nil {
+		return nil, fmt.Errorf("error writing mock file: %w", err)
+	}
+	if err := ioutil.WriteFile(
+		fileName+ResponseFileSuffix, mr.encode(), 0644,
+	); err != nil {
+		return nil, fmt.Errorf("error writing mock response file: %w", err)
+	}
+
+	if err := ms.addRecordedRoute(route); err != nil {
+		return nil, err
+	}
+
+	return route, nil
+}
+
+// decompressBody returns the uncompressed form of a response body, according
+// to its Content-Encoding. Only gzip is supported, other bodies are returned
+// as they are.
+func decompressBody(h http.Header, body []byte) ([]byte, error) {
+	if !strings.EqualFold(h.Get("Content-Encoding"), "gzip") {
+		return body, nil
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing response body: %w", err)
+	}
+	body, err = ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing response body: %w", err)
+	}
+	return body, nil
+}
+
+// addRecordedRoute appends a Route to the routes file and the running
+// RouteConfig, unless an identical Route already exists.
+func (ms *MockServer) addRecordedRoute(route *Route) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for _, existing := range ms.routeConfig {
+		if existing.Host == route.Host &&
+			existing.Path == route.Path &&
+			existing.Type == route.Type &&
+			existing.File == route.File &&
+			len(existing.Matchers) == len(route.Matchers) &&
+			strings.Join(existing.methods(), ",") == strings.Join(route.methods(), ",") {
+			return nil
+		}
+	}
+
+	f := hclwrite.NewEmptyFile()
+	f.Body().AppendNewline()
+	block := f.Body().AppendNewBlock("route", nil)
+	block.Body().SetAttributeValue("host", cty.StringVal(route.Host))
+	block.Body().SetAttributeValue("path", cty.StringVal(route.Path))
+	block.Body().SetAttributeValue("type", cty.StringVal(route.Type))
+	block.Body().SetAttributeValue("method", cty.StringVal(route.Method))
+	if route.File != "" {
+		block.Body().SetAttributeValue("file", cty.StringVal(route.File))
+	}
+	for _, m := range route.Matchers {
+		match := block.Body().AppendNewBlock("match", []string{m.Kind})
+		match.Body().SetAttributeValue("name", cty.StringVal(m.Name))
+		match.Body().SetAttributeValue("equals", cty.StringVal(*m.Equals))
+	}
+
+	routesFile, err := os.OpenFile(
+		ms.routesFile(), os.O_APPEND|os.O_WRONLY, 0644,
+	)
+	if err != nil {
+		return fmt.Errorf("error opening routes file: %w", err)
+	}
+	defer routesFile.Close()
+
+	if _, err := routesFile.Write(f.Bytes()); err != nil {
+		return fmt.Errorf("error writing routes file: %w", err)
+	}
+
+	// Copy rather than append in place, as readers may hold the old slice.
+	rc := make(RouteConfig, 0, len(ms.routeConfig)+1)
+	rc = append(rc, ms.routeConfig...)
+	ms.routeConfig = append(rc, route)
+
+	return nil
+}
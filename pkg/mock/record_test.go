@@ -0,0 +1,360 @@
+package mock
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-icap/icap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// icapRecorder is an icap.ResponseWriter that records the response written to
+// it, similar to httptest.ResponseRecorder.
+type icapRecorder struct {
+	header  http.Header
+	code    int
+	message interface{}
+	body    bytes.Buffer
+}
+
+func newICAPRecorder() *icapRecorder {
+	return &icapRecorder{header: http.Header{}}
+}
+
+func (ir *icapRecorder) Header() http.Header {
+	return ir.header
+}
+
+func (ir *icapRecorder) Write(p []byte) (int, error) {
+	if ir.code == 0 {
+		ir.WriteHeader(http.StatusOK, nil, true)
+	}
+	return ir.body.Write(p)
+}
+
+func (ir *icapRecorder) WriteHeader(code int, message interface{}, _ bool) {
+	ir.code = code
+	ir.message = message
+}
+
+// newRecordingRoot creates a temporary mocks root with an empty routes file.
+func newRecordingRoot(t *testing.T) string {
+	root, err := ioutil.TempDir("", "mock-proxy-record")
+	require.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(root, "routes.hcl"), []byte{}, 0644))
+	return root
+}
+
+// newUpstream creates a stand-in for a real upstream HTTP server.
+func newUpstream(t *testing.T) *httptest.Server {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-RateLimit-Remaining", "41")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"method": "` + r.Method + `"}`))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestMockServerRecord(t *testing.T) {
+	t.Parallel()
+
+	root := newRecordingRoot(t)
+	upstream := newUpstream(t)
+
+	ms, err := NewMockServer(WithMockRoot(root), WithMode(ModeRecord))
+	require.Nil(t, err)
+
+	req, err := http.NewRequest(http.MethodPost, upstream.URL+"/orgs/hashicorp/repos", nil)
+	require.Nil(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	resp.Body.Close()
+
+	route, err := ms.record(req, resp, body)
+	require.Nil(t, err)
+	assert.Equal(t, &Route{
+		Host:   req.URL.Host,
+		Path:   "/orgs/hashicorp/repos",
+		Type:   "http",
+		Method: http.MethodPost,
+	}, route)
+
+	mockFile := filepath.Join(root, "127.0.0.1", "orgs", "hashicorp", "repos.POST.mock")
+	gotBody, err := ioutil.ReadFile(mockFile)
+	require.Nil(t, err)
+	assert.Equal(t, `{"method": "POST"}`, string(gotBody))
+
+	gotResponse, err := ParseMockResponse(mockFile + ResponseFileSuffix)
+	require.Nil(t, err)
+	assert.Equal(t, &MockResponse{
+		Status:      http.StatusCreated,
+		ContentType: "application/json",
+		Headers:     map[string]string{"X-Ratelimit-Remaining": "41"},
+		Template:    boolPtr(false),
+	}, gotResponse)
+
+	// The route is written to the routes file, and only once.
+	_, err = ms.record(req, resp, body)
+	require.Nil(t, err)
+	gotRoutes, err := ParseRoutes(filepath.Join(root, "routes.hcl"))
+	require.Nil(t, err)
+	assert.Equal(t, RouteConfig{route}, gotRoutes)
+
+	// Replay the recorded mock, without the upstream.
+	upstream.Close()
+	replay, err := http.NewRequest(http.MethodPost, req.URL.String(), nil)
+	require.Nil(t, err)
+	recorder := httptest.NewRecorder()
+	ms.mockHandler(recorder, replay)
+
+	assert.Equal(t, http.StatusCreated, recorder.Result().StatusCode)
+	assert.Equal(t, "application/json", recorder.Result().Header.Get("Content-Type"))
+	assert.Equal(t, "41", recorder.Result().Header.Get("X-RateLimit-Remaining"))
+	assert.Equal(t, `{"method": "POST"}`, recorder.Body.String())
+}
+
+func TestMockServerRecordQuery(t *testing.T) {
+	t.Parallel()
+
+	root := newRecordingRoot(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"page": "` + r.URL.Query().Get("page") + `"}`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	ms, err := NewMockServer(WithMockRoot(root), WithMode(ModeRecord))
+	require.Nil(t, err)
+
+	pages := []string{"/search?q=mock&page=1", "/search?q=mock&page=2"}
+	for _, page := range pages {
+		req, err := http.NewRequest(http.MethodGet, upstream.URL+page, nil)
+		require.Nil(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.Nil(t, err)
+		resp.Body.Close()
+
+		route, err := ms.record(req, resp, body)
+		require.Nil(t, err)
+		require.Len(t, route.Matchers, 2)
+		assert.Equal(t, "page", route.Matchers[0].Name)
+		assert.Equal(t, "q", route.Matchers[1].Name)
+	}
+
+	// Each query gets a route and mock file of its own.
+	gotRoutes, err := ParseRoutes(filepath.Join(root, "routes.hcl"))
+	require.Nil(t, err)
+	require.Len(t, gotRoutes, 2)
+	assert.NotEqual(t, gotRoutes[0].File, gotRoutes[1].File)
+
+	upstream.Close()
+	for i, page := range pages {
+		recorder := httptest.NewRecorder()
+		ms.mockHandler(recorder, httptest.NewRequest(http.MethodGet, upstream.URL+page, nil))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, fmt.Sprintf(`{"page": "%d"}`, i+1), recorder.Body.String())
+	}
+
+	// The same query is only recorded once.
+	req, err := http.NewRequest(http.MethodGet, upstream.URL+pages[0], nil)
+	require.Nil(t, err)
+	_, err = ms.record(req, &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}, []byte(`{}`))
+	require.Nil(t, err)
+	gotRoutes, err = ParseRoutes(filepath.Join(root, "routes.hcl"))
+	require.Nil(t, err)
+	assert.Len(t, gotRoutes, 2)
+}
+
+func TestMockServerRecordTemplateDelimiters(t *testing.T) {
+	t.Parallel()
+
+	// A body that would render differently, or not at all, as a template.
+	const body = `{"chart": "{{ .Values.name }}", "quoted": "{{ \"hi\" }}", "stray": "{{"}`
+
+	root := newRecordingRoot(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(upstream.Close)
+
+	ms, err := NewMockServer(WithMockRoot(root), WithMode(ModeRecord))
+	require.Nil(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, upstream.URL+"/charts/vault", nil)
+	require.Nil(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	got, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	resp.Body.Close()
+
+	_, err = ms.record(req, resp, got)
+	require.Nil(t, err)
+
+	upstream.Close()
+	recorder := httptest.NewRecorder()
+	ms.mockHandler(recorder, httptest.NewRequest(http.MethodGet, upstream.URL+"/charts/vault", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, body, recorder.Body.String())
+}
+
+func TestMockServerRecordOutsideRoot(t *testing.T) {
+	t.Parallel()
+
+	root := newRecordingRoot(t)
+
+	ms, err := NewMockServer(WithMockRoot(root), WithMode(ModeRecord))
+	require.Nil(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/../../etc/passwd", nil)
+	require.Nil(t, err)
+	req.URL.Path = "/../../etc/passwd"
+
+	_, err = ms.record(req, &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}, []byte{})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "outside of")
+}
+
+func TestMockServerInterception(t *testing.T) {
+	tcs := []struct {
+		name     string
+		mode     Mode
+		method   string
+		url      string
+		headers  map[string]string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "REQMOD mocks matching requests",
+			method:   "REQMOD",
+			url:      "http://example.com/simple",
+			wantCode: http.StatusOK,
+			wantBody: "Hello, World!\n",
+		},
+		{
+			name:     "REQMOD allows unmatched requests",
+			method:   "REQMOD",
+			url:      "http://example.com/unmatched",
+			wantCode: http.StatusNoContent,
+		},
+		{
+			name:     "REQMOD allows marked requests when recording",
+			mode:     ModeRecord,
+			method:   "REQMOD",
+			url:      "http://example.com/simple",
+			headers:  map[string]string{RecordHeader: "true"},
+			wantCode: http.StatusNoContent,
+		},
+		{
+			name:     "RESPMOD allows responses when not recording",
+			method:   "RESPMOD",
+			url:      "http://example.com/unmatched",
+			wantCode: http.StatusNoContent,
+		},
+		{
+			name:     "RESPMOD allows mocked responses when recording",
+			mode:     ModeRecord,
+			method:   "RESPMOD",
+			url:      "http://example.com/simple",
+			wantCode: http.StatusNoContent,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			mode := ModeReplay
+			if tc.mode != "" {
+				mode = tc.mode
+			}
+			ms, err := NewMockServer(WithMockRoot("testdata/"), WithMode(mode))
+			require.Nil(t, err)
+
+			httpReq, err := http.NewRequest(http.MethodGet, tc.url, nil)
+			require.Nil(t, err)
+			for k, v := range tc.headers {
+				httpReq.Header.Set(k, v)
+			}
+			req := &icap.Request{
+				Method:   tc.method,
+				Request:  httpReq,
+				Response: &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))},
+			}
+
+			recorder := newICAPRecorder()
+			ms.interception(recorder, req)
+
+			assert.Equal(t, tc.wantCode, recorder.code)
+			assert.Equal(t, tc.wantBody, recorder.body.String())
+		})
+	}
+}
+
+func TestMockServerInterceptionRecords(t *testing.T) {
+	t.Parallel()
+
+	root := newRecordingRoot(t)
+	upstream := newUpstream(t)
+
+	ms, err := NewMockServer(WithMockRoot(root), WithMode(ModeRecord))
+	require.Nil(t, err)
+
+	httpReq, err := http.NewRequest(http.MethodGet, upstream.URL+"/users/octocat", nil)
+	require.Nil(t, err)
+	resp, err := http.DefaultClient.Do(httpReq)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+
+	recorder := newICAPRecorder()
+	ms.interception(recorder, &icap.Request{
+		Method:   "RESPMOD",
+		Request:  httpReq,
+		Response: resp,
+	})
+
+	// The upstream response is passed on to the client unchanged.
+	assert.Equal(t, http.StatusOK, recorder.code)
+	assert.Equal(t, resp, recorder.message)
+	assert.Equal(t, `{"method": "GET"}`, recorder.body.String())
+
+	// And is now replayed.
+	replay, err := http.NewRequest(http.MethodGet, httpReq.URL.String(), nil)
+	require.Nil(t, err)
+	route, err := ms.Routes().MatchRoute(replay)
+	require.Nil(t, err)
+	require.NotNil(t, route)
+
+	_, err = os.Stat(filepath.Join(root, "127.0.0.1", "users", "octocat.GET.mock"))
+	assert.Nil(t, err)
+}
+
+func TestMockServerInterceptionOptions(t *testing.T) {
+	t.Parallel()
+
+	ms, err := NewMockServer(WithMockRoot("testdata/"))
+	require.Nil(t, err)
+
+	recorder := newICAPRecorder()
+	ms.interception(recorder, &icap.Request{Method: "OPTIONS"})
+
+	assert.Equal(t, http.StatusOK, recorder.code)
+	assert.Equal(t, "REQMOD, RESPMOD", recorder.header.Get("Methods"))
+}
@@ -0,0 +1,103 @@
+package mock
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Reload parses the routes file again, and rebuilds the repositories of git
+// mocks, and if they are valid swaps them in for those currently in use. If
+// they are invalid, the current RouteConfig and repositories are kept, and the
+// error describes what is wrong.
+func (ms *MockServer) Reload() error {
+	ms.statRoutes()
+
+	rc, err := ParseRoutes(ms.routesFile())
+	if err != nil {
+		ms.logger.Error("keeping current routes, routes file is invalid",
+			"file", ms.routesFile(), "error", err.Error())
+		return fmt.Errorf(
+			"invalid mock routes file %s: %w", ms.routesFile(), err,
+		)
+	}
+
+	repos, err := ms.buildGitRepos(rc)
+	if err != nil {
+		ms.logger.Error("keeping current routes, git mock is invalid", "error", err.Error())
+		return fmt.Errorf("invalid git mock: %w", err)
+	}
+
+	ms.mu.Lock()
+	ms.routeConfig, ms.gitRepos = rc, repos
+	ms.scenarios.prune(ms.routeConfig, ms.runtimeRoutes)
+	ms.mu.Unlock()
+
+	ms.logger.Info("reloaded routes", "file", ms.routesFile(), "routes", len(rc))
+	return nil
+}
+
+// statRoutes records the modification time and size of the routes file, so
+// that watchRoutes can tell when it has changed since it was last loaded.
+func (ms *MockServer) statRoutes() {
+	fi, err := os.Stat(ms.routesFile())
+	if err != nil {
+		return
+	}
+
+	ms.mu.Lock()
+	ms.routesModTime, ms.routesSize = fi.ModTime(), fi.Size()
+	ms.mu.Unlock()
+}
+
+// watchRoutes polls the routes file for changes to its modification time or
+// size, reloading it when it changes, until stop is closed. Mock files don't
+// need to be watched, as they are read fresh for every request, other than
+// git mocks built from plain directories, which are rebuilt by a reload.
+func (ms *MockServer) watchRoutes(stop <-chan struct{}) {
+	ticker := time.NewTicker(ms.reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			fi, err := os.Stat(ms.routesFile())
+			if err != nil {
+				// Editors commonly replace files rather than write to them,
+				// so a missing file may only be missing for a moment.
+				ms.logger.Debug("failed checking routes file", "error", err.Error())
+				continue
+			}
+
+			ms.mu.RLock()
+			changed := !fi.ModTime().Equal(ms.routesModTime) || fi.Size() != ms.routesSize
+			ms.mu.RUnlock()
+			if !changed {
+				continue
+			}
+
+			ms.logger.Info("detected a change to the routes file")
+			// Errors are already logged by Reload.
+			_ = ms.Reload()
+		}
+	}
+}
+
+// reloadHandler can receive a POST request, which reloads the routes file.
+//   curl -X POST squid.proxy/reload
+func (ms *MockServer) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := ms.Reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
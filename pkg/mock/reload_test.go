@@ -0,0 +1,174 @@
+package mock
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	reloadRoutesBefore = `
+route {
+  host = "example.com"
+  path = "/before"
+  type = "http"
+}
+`
+	reloadRoutesAfter = `
+route {
+  host = "example.com"
+  path = "/after"
+  type = "http"
+}
+`
+	reloadRoutesInvalid = `
+route {
+  host = "example.com"
+  path = "/invalid"
+  type = "ftp"
+}
+`
+)
+
+// newReloadRoot creates a temporary mocks root with a given routes file.
+func newReloadRoot(t *testing.T, routes string) string {
+	root, err := ioutil.TempDir("", "mock-proxy-reload")
+	require.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	writeRoutes(t, root, routes)
+	return root
+}
+
+func writeRoutes(t *testing.T, root, routes string) {
+	require.Nil(t, ioutil.WriteFile(filepath.Join(root, "routes.hcl"), []byte(routes), 0644))
+}
+
+func TestMockServerReload(t *testing.T) {
+	tcs := []struct {
+		name     string
+		routes   string
+		wantPath string
+		wantErr  string
+	}{
+		{
+			name:     "valid routes are swapped in",
+			routes:   reloadRoutesAfter,
+			wantPath: "/after",
+		},
+		{
+			name:     "invalid routes keep the current routes",
+			routes:   reloadRoutesInvalid,
+			wantPath: "/before",
+			wantErr:  "unknown route type ftp",
+		},
+		{
+			name:     "unparseable routes keep the current routes",
+			routes:   "route {",
+			wantPath: "/before",
+			wantErr:  "error in ParseRoutes parsing HCL",
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			root := newReloadRoot(t, reloadRoutesBefore)
+			ms, err := NewMockServer(WithMockRoot(root))
+			require.Nil(t, err)
+
+			writeRoutes(t, root, tc.routes)
+			err = ms.Reload()
+			if tc.wantErr == "" {
+				require.Nil(t, err)
+			} else {
+				require.NotNil(t, err)
+				assert.Contains(t, err.Error(), tc.wantErr)
+			}
+
+			require.Len(t, ms.Routes(), 1)
+			assert.Equal(t, tc.wantPath, ms.Routes()[0].Path)
+		})
+	}
+}
+
+func TestMockServerWatchRoutes(t *testing.T) {
+	t.Parallel()
+
+	root := newReloadRoot(t, reloadRoutesBefore)
+	ms, err := NewMockServer(
+		WithMockRoot(root),
+		WithReloadInterval(10*time.Millisecond),
+	)
+	require.Nil(t, err)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go ms.watchRoutes(stop)
+
+	// Make sure the size changes, as the modification time may not have a
+	// fine enough resolution to notice the change.
+	writeRoutes(t, root, reloadRoutesAfter+"\n")
+
+	assert.Eventually(t, func() bool {
+		return ms.Routes()[0].Path == "/after"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMockServerReloadHandler(t *testing.T) {
+	tcs := []struct {
+		name     string
+		method   string
+		routes   string
+		wantCode int
+	}{
+		{
+			name:     "simple",
+			method:   http.MethodPost,
+			routes:   reloadRoutesAfter,
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "invalid routes",
+			method:   http.MethodPost,
+			routes:   reloadRoutesInvalid,
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name:     "wrong method",
+			method:   http.MethodGet,
+			routes:   reloadRoutesAfter,
+			wantCode: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			root := newReloadRoot(t, reloadRoutesBefore)
+			ms, err := NewMockServer(WithMockRoot(root))
+			require.Nil(t, err)
+
+			writeRoutes(t, root, tc.routes)
+
+			req, err := http.NewRequest(tc.method, "", nil)
+			require.Nil(t, err)
+			recorder := httptest.NewRecorder()
+
+			ms.reloadHandler(recorder, req)
+
+			assert.Equal(t, tc.wantCode, recorder.Result().StatusCode)
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package mock
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hclparse"
+	"github.com/hashicorp/hcl2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// ResponseFileSuffix is appended to the name of a mock file to find the
+// response file that describes how it should be served. For example, the
+// response file for `repos.POST.mock` is `repos.POST.mock.hcl`.
+const ResponseFileSuffix = ".hcl"
+
+// MockResponse describes everything about a mocked response other than its
+// body. It is read from an optional HCL response file sitting next to a mock
+// file, a mock file without one is served as a 200 with no extra headers.
+type MockResponse struct {
+	Status      int               `hcl:"status,optional" json:"status,omitempty"`
+	ContentType string            `hcl:"content_type,optional" json:"content_type,omitempty"`
+	Headers     map[string]string `hcl:"headers,optional" json:"headers,omitempty"`
+	Delay       string            `hcl:"delay,optional" json:"delay,omitempty"`
+
+	// Template can be set to false to serve a mock byte-for-byte, rather than
+	// rendering it as a template. Recorded mocks are always served this way.
+	Template *bool `hcl:"template,optional" json:"template,omitempty"`
+
+	// delay is the parsed form of Delay.
+	delay time.Duration
+}
+
+// ParseMockResponse parses an input response file, using HCL2, into a
+// MockResponse.
+func ParseMockResponse(inFile string) (*MockResponse, error) {
+	input, err := os.Open(inFile)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"error in ParseMockResponse opening response file: %w", err,
+		)
+	}
+	defer input.Close()
+
+	src, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"error in ParseMockResponse reading input `%s`: %w", inFile, err,
+		)
+	}
+
+	parser := hclparse.NewParser()
+	srcHCL, diag := parser.ParseHCL(src, inFile)
+	if diag.HasErrors() {
+		return nil, fmt.Errorf(
+			"error in ParseMockResponse parsing HCL: %w", diag,
+		)
+	}
+
+	mr := &MockResponse{}
+	if diag := gohcl.DecodeBody(srcHCL.Body, nil, mr); diag.HasErrors() {
+		return nil, fmt.Errorf(
+			"error in ParseMockResponse decoding HCL configuration: %w", diag,
+		)
+	}
+
+	if err := mr.Validate(); err != nil {
+		return nil, fmt.Errorf("error in ParseMockResponse: %w", err)
+	}
+
+	return mr, nil
+}
+
+// Validate checks that a MockResponse is well formed, and parses its Delay.
+func (mr *MockResponse) Validate() error {
+	if mr.Status != 0 && http.StatusText(mr.Status) == "" {
+		return fmt.Errorf("invalid status %d", mr.Status)
+	}
+
+	if mr.Delay != "" {
+		delay, err := time.ParseDuration(mr.Delay)
+		if err != nil {
+			return fmt.Errorf("invalid delay: %w", err)
+		}
+		mr.delay = delay
+	}
+
+	return nil
+}
+
+// templated reports whether the mock should be rendered as a template, which
+// it is unless Template is set to false.
+func (mr *MockResponse) templated() bool {
+	return mr.Template == nil || *mr.Template
+}
+
+// loadMockResponse finds the response file for a given mock file. If there is
+// no response file, an empty MockResponse is returned.
+func loadMockResponse(mockFile string) (*MockResponse, error) {
+	mr, err := ParseMockResponse(mockFile + ResponseFileSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return &MockResponse{}, nil
+	}
+	return mr, err
+}
+
+// apply sets the configured headers on a ResponseWriter, and waits out any
+// configured delay. It returns early with an error if the request is
+// cancelled while waiting.
+func (mr *MockResponse) apply(w http.ResponseWriter, r *http.Request) error {
+	if mr.ContentType != "" {
+		w.Header().Set("Content-Type", mr.ContentType)
+	}
+	for k, v := range mr.Headers {
+		w.Header().Set(k, v)
+	}
+
+	if mr.delay > 0 {
+		timer := time.NewTimer(mr.delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+	}
+
+	return nil
+}
+
+// encode converts a MockResponse to the HCL of a response file.
+func (mr *MockResponse) encode() []byte {
+	f := hclwrite.NewEmptyFile()
+	body := f.Body()
+
+	if mr.Status != 0 {
+		body.SetAttributeValue("status", cty.NumberIntVal(int64(mr.Status)))
+	}
+	if mr.ContentType != "" {
+		body.SetAttributeValue("content_type", cty.StringVal(mr.ContentType))
+	}
+	if len(mr.Headers) != 0 {
+		headers := map[string]cty.Value{}
+		for k, v := range mr.Headers {
+			headers[k] = cty.StringVal(v)
+		}
+		body.SetAttributeValue("headers", cty.MapVal(headers))
+	}
+	if mr.Delay != "" {
+		body.SetAttributeValue("delay", cty.StringVal(mr.Delay))
+	}
+	if mr.Template != nil {
+		body.SetAttributeValue("template", cty.BoolVal(*mr.Template))
+	}
+
+	return f.Bytes()
+}
@@ -0,0 +1,59 @@
+package mock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMockResponse(t *testing.T) {
+	tcs := []struct {
+		name  string
+		input string
+		want  *MockResponse
+	}{
+		{
+			name:  "simple",
+			input: "testdata/example.com/created.mock.hcl",
+			want: &MockResponse{
+				Status:      201,
+				ContentType: "application/json",
+				Headers: map[string]string{
+					"Location": "/created/1",
+				},
+				Delay: "10ms",
+				delay: 10 * time.Millisecond,
+			},
+		},
+		{
+			name:  "untemplated",
+			input: "testdata/example.com/raw.mock.hcl",
+			want: &MockResponse{
+				Template: boolPtr(false),
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := ParseMockResponse(tc.input)
+			require.Nil(t, err)
+
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestLoadMockResponse(t *testing.T) {
+	t.Parallel()
+
+	got, err := loadMockResponse("testdata/example.com/simple.mock")
+	require.Nil(t, err)
+
+	assert.Equal(t, &MockResponse{}, got)
+}
@@ -3,6 +3,7 @@ package mock
 import (
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -13,11 +14,57 @@ import (
 	"github.com/hashicorp/hcl2/hclparse"
 )
 
-// The Route struct represents a single mocked route.
+// The Route struct represents a single mocked route. An http Route serves
+// mock files, a patch Route patches the real upstream response, and a git
+// Route serves clones of, and pushes to, its repository.
 type Route struct {
-	Host string `hcl:"host"`
-	Path string `hcl:"path"`
-	Type string `hcl:"type"`
+	// ID identifies a Route in the API, and is generated for runtime Routes
+	// added without one.
+	ID   string `hcl:"id,optional" json:"id,omitempty"`
+	Host string `hcl:"host" json:"host"`
+	Path string `hcl:"path" json:"path"`
+	Type string `hcl:"type" json:"type"`
+
+	// Method and Methods are optional, a Route without either matches
+	// requests of any HTTP method.
+	Method  string   `hcl:"method,optional" json:"method,omitempty"`
+	Methods []string `hcl:"methods,optional" json:"methods,omitempty"`
+
+	// File overrides the mock file of an http Route, which is otherwise
+	// derived from its host and path, and Body replaces the mock file with
+	// an inline body.
+	File string  `hcl:"file,optional" json:"file,omitempty"`
+	Body *string `hcl:"body,optional" json:"body,omitempty"`
+
+	// Response replaces the response file of the mock file.
+	Response *MockResponse `hcl:"response,block" json:"response,omitempty"`
+
+	// Matchers further constrain a Route by the headers, query or body of a
+	// request.
+	Matchers []*Matcher `hcl:"match,block" json:"match,omitempty"`
+
+	// A Route in a Scenario with a State only matches while its Scenario is
+	// in that State, and serving it moves the Scenario to its NextState.
+	Scenario  string `hcl:"scenario,optional" json:"scenario,omitempty"`
+	State     string `hcl:"state,optional" json:"state,omitempty"`
+	NextState string `hcl:"next_state,optional" json:"next_state,omitempty"`
+
+	// Responses is an ordered list of mock files, relative to the mock root,
+	// which are served in turn. Once exhausted, the Sequence either sticks on
+	// the last response or cycles back to the first.
+	Responses []string `hcl:"responses,optional" json:"responses,omitempty"`
+	Sequence  string   `hcl:"sequence,optional" json:"sequence,omitempty"`
+
+	// Patches are applied to the upstream response of a patch Route.
+	Patches []*Patch `hcl:"patch,block" json:"patch,omitempty"`
+
+	// Fault makes the mock responses of a Route slow or unreliable.
+	Fault *Fault `hcl:"fault,block" json:"fault,omitempty"`
+
+	// Push is the push policy of a git Route, one of PushApply, PushDiscard
+	// or PushReject. A rejected push sends the client the PushMessage.
+	Push        string `hcl:"push,optional" json:"push,omitempty"`
+	PushMessage string `hcl:"push_message,optional" json:"push_message,omitempty"`
 }
 
 // RouteConfig is a type alias for many Routes.
@@ -60,6 +107,15 @@ func ParseRoutes(inFile string) (RouteConfig, error) {
 		)
 	}
 
+	for _, route := range rc.RouteConfig {
+		if err := route.Validate(); err != nil {
+			return []*Route{}, fmt.Errorf(
+				"error in ParseRoutes validating route %s%s: %w",
+				route.Host, route.Path, err,
+			)
+		}
+	}
+
 	// Return an instantiated RouteConfig instead of a nil pointer.
 	if rc.RouteConfig == nil {
 		rc.RouteConfig = RouteConfig{}
@@ -67,6 +123,109 @@ func ParseRoutes(inFile string) (RouteConfig, error) {
 	return rc.RouteConfig, nil
 }
 
+// Validate checks that a Route is well formed, and prepares its Matchers and
+// Response.
+func (r *Route) Validate() error {
+	if r.Host == "" {
+		return fmt.Errorf("route requires a host")
+	}
+
+	switch r.Type {
+	case "http", "git":
+		if len(r.Patches) != 0 {
+			return fmt.Errorf("only patch routes can have patches")
+		}
+	case "patch":
+		if len(r.Patches) == 0 {
+			return fmt.Errorf("patch route requires a patch")
+		}
+		if r.Fault != nil {
+			return fmt.Errorf("patch routes cannot have a fault")
+		}
+	default:
+		return fmt.Errorf("unknown route type %s", r.Type)
+	}
+
+	switch r.Push {
+	case "":
+		if r.PushMessage != "" {
+			return fmt.Errorf("route requires a push policy to have a push_message")
+		}
+	case PushApply, PushDiscard, PushReject:
+		if r.Type != "git" {
+			return fmt.Errorf("only git routes can have a push policy")
+		}
+		if r.PushMessage != "" && r.Push != PushReject {
+			return fmt.Errorf("only the %s push policy can have a push_message", PushReject)
+		}
+		if r.Push == PushApply && r.templated() {
+			return fmt.Errorf("the %s push policy can't be used with a templated git repo", PushApply)
+		}
+	default:
+		return fmt.Errorf("unknown push policy %q", r.Push)
+	}
+
+	if r.File != "" && r.Body != nil {
+		return fmt.Errorf("route cannot have both a file and a body")
+	}
+
+	if len(r.Responses) != 0 && (r.File != "" || r.Body != nil) {
+		return fmt.Errorf("route cannot have responses as well as a file or body")
+	}
+
+	// Mock files are joined onto the mock root, so a route mustn't be able
+	// to serve files outside of it.
+	for _, file := range append([]string{r.File}, r.Responses...) {
+		if file != "" && !insideMockRoot(file) {
+			return fmt.Errorf("mock file %s is outside of the mock root", file)
+		}
+	}
+
+	switch r.Sequence {
+	case "", SequenceStick, SequenceCycle:
+	default:
+		return fmt.Errorf("unknown sequence %q", r.Sequence)
+	}
+
+	if r.Scenario == "" && (r.State != "" || r.NextState != "") {
+		return fmt.Errorf("route requires a scenario to use states")
+	}
+
+	if r.Response != nil {
+		if err := r.Response.Validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range r.Matchers {
+		if err := m.Validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range r.Patches {
+		if err := p.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.Fault != nil {
+		if err := r.Fault.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// insideMockRoot says if a mock file path, relative to the mock root, stays
+// inside of it.
+func insideMockRoot(file string) bool {
+	clean := filepath.Clean(file)
+	return !filepath.IsAbs(clean) && clean != ".." &&
+		!strings.HasPrefix(clean, ".."+string(filepath.Separator))
+}
+
 // ParseURL is used by a single Route to convert that route to a filepath, a
 // list of transforms created by dynamic URLs, and an error. This should only
 // by used on a URL that the Route Matches, as determined below.
@@ -83,6 +242,9 @@ func (r *Route) ParseURL(in *url.URL) (string, []Transformer, error) {
 	case "http":
 		// An early escape for empty paths
 		if r.Path == "" || r.Path == "/" {
+			if r.File != "" {
+				return r.File, []Transformer{}, nil
+			}
 			return fmt.Sprintf("%s/index.mock", routeHostname), []Transformer{}, nil
 		}
 
@@ -92,16 +254,39 @@ func (r *Route) ParseURL(in *url.URL) (string, []Transformer, error) {
 				fmt.Errorf("error performing substitutions: %w", err)
 		}
 
+		if r.File != "" {
+			return r.File, subs, nil
+		}
 		return fmt.Sprintf("%s%s.mock", routeHostname, r.Path), subs, nil
 	case "git":
-		// At this time, you can't template anything about git repos, because
-		// of how references work.
-		return filepath.Join("/git", routeHostname, r.Path, ".git"), []Transformer{}, nil
+		// The path parameters of a templated git repo render its template
+		// repository, which lives at the Route's Path, as with http mocks.
+		subs, err := findSubstitutions(r.Path, gitRepoPath(in))
+		if err != nil {
+			return "", []Transformer{},
+				fmt.Errorf("error performing substitutions: %w", err)
+		}
+		return filepath.Join("/git", routeHostname, r.Path, ".git"), subs, nil
 	default:
 		return "", []Transformer{}, fmt.Errorf("unknown route type %s", r.Type)
 	}
 }
 
+// gitSuffixes are the paths of the git smart HTTP requests, relative to the
+// repository.
+var gitSuffixes = []string{"/info/refs", "/git-upload-pack", "/git-receive-pack"}
+
+// gitRepoPath returns the path of the repository a git smart HTTP request is
+// for, which is the path of the request without the git suffix, if it has one.
+func gitRepoPath(in *url.URL) string {
+	for _, suffix := range gitSuffixes {
+		if strings.HasSuffix(in.Path, suffix) {
+			return strings.TrimSuffix(in.Path, suffix)
+		}
+	}
+	return in.Path
+}
+
 // findSubstitutions is a helper function that abstracts out some pretty nasty
 // regexp logic. In short, take a dynamic URL, and a templating Path from the
 // Route, and convert the dynamic URL to a set of transformations with the
@@ -110,28 +295,26 @@ func (r *Route) ParseURL(in *url.URL) (string, []Transformer, error) {
 //   Input:    /mypath/1/bar/2
 //   Output:   []VariableSubstitution{{key: foo, value: 1},{key: baz, value: 2}}
 func findSubstitutions(tmplPath, inputPath string) ([]Transformer, error) {
-	// First, generate a regexp with capture groups to find everywhere the
-	// Route Path has a /:foo/ or /:foo value.
-	pathSubRegexp := regexp.MustCompile(`(\/:\w+(?:\/|\z))+`)
+	// First, find every /:foo segment of the Route Path, and turn it into a
+	// named capture group, quoting the other segments.
+	pathSubRegexp := regexp.MustCompile(`\A:\w+\z`)
+	segments := strings.Split(tmplPath, "/")
+	captures := 0
+	for i, segment := range segments {
+		if pathSubRegexp.MatchString(segment) {
+			segments[i] = fmt.Sprintf(`(?P<%s>\S+)`, strings.TrimPrefix(segment, ":"))
+			captures++
+			continue
+		}
+		segments[i] = regexp.QuoteMeta(segment)
+	}
 
 	// An early exit here, if no matches, we can bail.
-	pathMatches := pathSubRegexp.FindAllString(tmplPath, -1)
-	if len(pathMatches) == 0 {
+	if captures == 0 {
 		return []Transformer{}, nil
 	}
 
-	// Next, use those captured segments to generate a new regexp with a
-	// named capture group at each of those locations.
-	captureRegexpString := fmt.Sprintf(`\A%s\z`, regexp.QuoteMeta(tmplPath))
-	for _, pm := range pathMatches {
-		var cg string
-		if strings.HasSuffix(pm, "/") {
-			cg = fmt.Sprintf(`\/(?P<%s>\S+)\/`, strings.Trim(pm, "/:"))
-		} else {
-			cg = fmt.Sprintf(`\/(?P<%s>\S+)`, strings.TrimLeft(pm, "/:"))
-		}
-		captureRegexpString = strings.Replace(captureRegexpString, regexp.QuoteMeta(pm), cg, 1)
-	}
+	captureRegexpString := fmt.Sprintf(`\A%s\z`, strings.Join(segments, `\/`))
 	captureRegexp, err := regexp.Compile(captureRegexpString)
 	if err != nil {
 		return []Transformer{}, fmt.Errorf("error generating capture group regexp: %w", err)
@@ -158,15 +341,81 @@ func findSubstitutions(tmplPath, inputPath string) ([]Transformer, error) {
 	return transformers, nil
 }
 
-// match is a helper function that says if a single Route matches a single URL.
-func (r *Route) match(in *url.URL) bool {
+// templated says if a Route's Path has path parameters, such as :org.
+func (r *Route) templated() bool {
+	return strings.Contains(r.Path, "/:")
+}
+
+// methods returns the combined, upper-cased list of HTTP methods a Route is
+// restricted to. An empty list means the Route accepts any method.
+func (r *Route) methods() []string {
+	methods := []string{}
+	if r.Method != "" {
+		methods = append(methods, strings.ToUpper(r.Method))
+	}
+	for _, m := range r.Methods {
+		methods = append(methods, strings.ToUpper(m))
+	}
+	return methods
+}
+
+// matchMethod says if a Route accepts a given HTTP method.
+func (r *Route) matchMethod(method string) bool {
+	methods := r.methods()
+	if len(methods) == 0 {
+		return true
+	}
+	for _, m := range methods {
+		if m == strings.ToUpper(method) {
+			return true
+		}
+	}
+	return false
+}
+
+// needsBody says if any of a Route's Matchers inspect the request body.
+func (r *Route) needsBody() bool {
+	for _, m := range r.Matchers {
+		if m.needsBody() {
+			return true
+		}
+	}
+	return false
+}
+
+// match is a helper function that says if a single Route matches a single
+// request. The request body is passed separately, as it can only be read from
+// the request once.
+func (r *Route) match(req *http.Request, body []byte) bool {
+	in := req.URL
+
 	// Easy case, if the hosts don't match, they don't match
 	if r.Host != in.Host {
 		return false
 	}
 
+	if !r.matchMethod(req.Method) {
+		return false
+	}
+
+	if !r.matchPath(in) {
+		return false
+	}
+
+	for _, m := range r.Matchers {
+		if !m.match(req, body) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchPath says if a Route's path matches the path of a URL, according to
+// the rules of the Route's type.
+func (r *Route) matchPath(in *url.URL) bool {
 	switch r.Type {
-	case "http":
+	case "http", "patch":
 		// Another easy out, if the Paths already match, then true.
 		if r.Path == in.Path || (r.Path == "" && in.Path == "/") {
 			return true
@@ -180,11 +429,20 @@ func (r *Route) match(in *url.URL) bool {
 		if len(in.RawQuery) != 0 {
 			pathRequest = fmt.Sprintf("%s?%s", pathRequest, in.RawQuery)
 		}
-		switch pathRequest {
-		case fmt.Sprintf("%s/info/refs?service=git-upload-pack", r.Path):
-			return true
-		case fmt.Sprintf("%s/git-upload-pack", r.Path):
+
+		repo := gitRepoPath(in)
+		if repo != r.Path {
+			subs, err := findSubstitutions(r.Path, repo)
+			if err != nil || len(subs) == 0 {
+				return false
+			}
+		}
+
+		switch strings.TrimPrefix(pathRequest, repo) {
+		case "/info/refs?service=git-upload-pack", "/git-upload-pack":
 			return true
+		case "/info/refs?service=git-receive-pack", "/git-receive-pack":
+			return r.Push != ""
 		default:
 			return false
 		}
@@ -195,26 +453,81 @@ func (r *Route) match(in *url.URL) bool {
 	}
 }
 
+// specificity is a measure of how closely a Route describes a request. The
+// number of path components is the most significant part, the number of other
+// constraints (a method restriction, a scenario state, and each Matcher) only
+// breaks ties between otherwise equal paths.
+type specificity struct {
+	path        int
+	constraints int
+}
+
+// specificity calculates the specificity of a Route.
+func (r *Route) specificity() specificity {
+	s := specificity{
+		path:        len(strings.Split(r.Path, "/")),
+		constraints: len(r.Matchers),
+	}
+	if len(r.methods()) != 0 {
+		s.constraints++
+	}
+	if r.State != "" {
+		s.constraints++
+	}
+	return s
+}
+
+// compare returns a positive number if s is more specific than o, a negative
+// number if it is less specific, and zero if they are equally specific.
+func (s specificity) compare(o specificity) int {
+	if s.path != o.path {
+		return s.path - o.path
+	}
+	return s.constraints - o.constraints
+}
+
 // MatchRoute returns the Route from a list of Routes that matches a given
-// input URL.
-func (rc RouteConfig) MatchRoute(in *url.URL) (*Route, error) {
+// input request. If any Route has Matchers that inspect the body, the body is
+// read and replaced, so it can still be read by the caller.
+func (rc RouteConfig) MatchRoute(in *http.Request) (*Route, error) {
+	body := []byte{}
+	for _, route := range rc {
+		if route.needsBody() {
+			var err error
+			body, err = readBody(in)
+			if err != nil {
+				return nil, fmt.Errorf("error reading request body: %w", err)
+			}
+			break
+		}
+	}
+
 	var match *Route
-	var specificity int
+	var matchSpecificity specificity
 	for _, route := range rc {
-		if route.match(in) {
+		if route.match(in, body) {
 			// "specificity" is a measure of how many route components match
 			// between the input and the matching route.
-			currentSpecificity := len(strings.Split(route.Path, "/"))
+			currentSpecificity := route.specificity()
+
+			if match == nil {
+				matchSpecificity = currentSpecificity
+				match = route
+				continue
+			}
+
+			cmp := currentSpecificity.compare(matchSpecificity)
 
 			// An equally specific match is an error. Overlapping routes of
 			// this type cannot be easily chosen between.
-			if currentSpecificity == specificity {
-				return nil, fmt.Errorf("multiple routes matched input: %s", in.String())
+			if cmp == 0 {
+				return nil, fmt.Errorf("multiple routes matched input: %s %s",
+					in.Method, in.URL.String())
 			}
 
 			// A more specific match replaces the current match.
-			if currentSpecificity > specificity {
-				specificity = currentSpecificity
+			if cmp > 0 {
+				matchSpecificity = currentSpecificity
 				match = route
 			}
 
@@ -224,3 +537,12 @@ func (rc RouteConfig) MatchRoute(in *url.URL) (*Route, error) {
 
 	return match, nil
 }
+
+// methodMockPath converts the path of a mock file, as returned by ParseURL,
+// into the path of its method specific variant.
+//   Input:  example.com/orgs/:org/repos.mock
+//   Output: example.com/orgs/:org/repos.GET.mock
+func methodMockPath(path, method string) string {
+	return fmt.Sprintf("%s.%s.mock",
+		strings.TrimSuffix(path, ".mock"), strings.ToUpper(method))
+}
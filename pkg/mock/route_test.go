@@ -1,7 +1,9 @@
 package mock
 
 import (
+	"net/http"
 	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -65,6 +67,32 @@ func TestParseURL(t *testing.T) {
 				&VariableSubstitution{key: "setting", value: "locale"},
 			},
 		},
+		{
+			name: "with adjacent transforms",
+			route: &Route{
+				Host: "api.github.com",
+				Path: "/repos/:org/:repo",
+				Type: "http",
+			},
+			url:      "http://api.github.com/repos/hashicorp/mock-proxy",
+			wantPath: "api.github.com/repos/:org/:repo.mock",
+			wantTransformers: []Transformer{
+				&VariableSubstitution{key: "org", value: "hashicorp"},
+				&VariableSubstitution{key: "repo", value: "mock-proxy"},
+			},
+		},
+		{
+			name: "explicit mock file",
+			route: &Route{
+				Host: "example.com",
+				Path: "/graphql",
+				Type: "http",
+				File: "example.com/graphql/viewer.mock",
+			},
+			url:              "http://example.com/graphql",
+			wantPath:         "example.com/graphql/viewer.mock",
+			wantTransformers: []Transformer{},
+		},
 		{
 			name: "git",
 			route: &Route{
@@ -87,6 +115,20 @@ func TestParseURL(t *testing.T) {
 			wantPath:         "/git/gitlab.test/test/test-project/.git",
 			wantTransformers: []Transformer{},
 		},
+		{
+			name: "templated git",
+			route: &Route{
+				Host: "github.com",
+				Path: "/:org/:repo",
+				Type: "git",
+			},
+			url:      "http://github.com/hashicorp/mock-proxy/info/refs?service=git-upload-pack",
+			wantPath: "/git/github.com/:org/:repo/.git",
+			wantTransformers: []Transformer{
+				&VariableSubstitution{key: "org", value: "hashicorp"},
+				&VariableSubstitution{key: "repo", value: "mock-proxy"},
+			},
+		},
 	}
 
 	for _, tc := range tcs {
@@ -110,7 +152,10 @@ func TestMatchRoute(t *testing.T) {
 	tcs := []struct {
 		name        string
 		routeConfig RouteConfig
+		method      string
 		url         string
+		headers     map[string]string
+		body        string
 		want        *Route
 		wantErr     string
 	}{
@@ -177,6 +222,49 @@ func TestMatchRoute(t *testing.T) {
 			url:  "http://github.com/example-repo/otherinfo",
 			want: nil,
 		},
+		{
+			name: "git pushes match routes with a push policy",
+			routeConfig: []*Route{
+				{Host: "github.com", Path: "/example-repo", Type: "git", Push: PushApply},
+			},
+			method: http.MethodPost,
+			url:    "http://github.com/example-repo/git-receive-pack",
+			want: &Route{
+				Host: "github.com",
+				Path: "/example-repo",
+				Type: "git",
+				Push: PushApply,
+			},
+		},
+		{
+			name: "but not routes without one",
+			routeConfig: []*Route{
+				{Host: "github.com", Path: "/example-repo", Type: "git"},
+			},
+			url:  "http://github.com/example-repo/info/refs?service=git-receive-pack",
+			want: nil,
+		},
+		{
+			name: "templated git paths match any repo",
+			routeConfig: []*Route{
+				{Host: "github.com", Path: "/:org/:repo", Type: "git"},
+			},
+			method: http.MethodPost,
+			url:    "http://github.com/hashicorp/mock-proxy/git-upload-pack",
+			want: &Route{
+				Host: "github.com",
+				Path: "/:org/:repo",
+				Type: "git",
+			},
+		},
+		{
+			name: "but not unknown requests",
+			routeConfig: []*Route{
+				{Host: "github.com", Path: "/:org/:repo", Type: "git"},
+			},
+			url:  "http://github.com/hashicorp/mock-proxy/otherinfo",
+			want: nil,
+		},
 		{
 			name: "or the wrong repo",
 			routeConfig: []*Route{
@@ -211,6 +299,142 @@ func TestMatchRoute(t *testing.T) {
 				Type: "http",
 			},
 		},
+		{
+			name: "method mismatch",
+			routeConfig: []*Route{
+				{Host: "example.com", Path: "/repos", Type: "http", Method: "POST"},
+			},
+			method: http.MethodGet,
+			url:    "http://example.com/repos",
+			want:   nil,
+		},
+		{
+			name: "methods are case insensitive",
+			routeConfig: []*Route{
+				{Host: "example.com", Path: "/repos", Type: "http", Method: "post"},
+			},
+			method: http.MethodPost,
+			url:    "http://example.com/repos",
+			want: &Route{
+				Host: "example.com", Path: "/repos", Type: "http", Method: "post",
+			},
+		},
+		{
+			name: "method lists",
+			routeConfig: []*Route{
+				{Host: "example.com", Path: "/repos", Type: "http", Methods: []string{"PUT", "PATCH"}},
+			},
+			method: http.MethodPatch,
+			url:    "http://example.com/repos",
+			want: &Route{
+				Host: "example.com", Path: "/repos", Type: "http", Methods: []string{"PUT", "PATCH"},
+			},
+		},
+		{
+			name: "method specific routes beat method agnostic routes",
+			routeConfig: []*Route{
+				{Host: "example.com", Path: "/repos", Type: "http"},
+				{Host: "example.com", Path: "/repos", Type: "http", Method: "POST"},
+				{Host: "example.com", Path: "/repos", Type: "http", Method: "DELETE"},
+			},
+			method: http.MethodPost,
+			url:    "http://example.com/repos",
+			want: &Route{
+				Host: "example.com", Path: "/repos", Type: "http", Method: "POST",
+			},
+		},
+		{
+			name: "method agnostic routes catch other methods",
+			routeConfig: []*Route{
+				{Host: "example.com", Path: "/repos", Type: "http"},
+				{Host: "example.com", Path: "/repos", Type: "http", Method: "POST"},
+			},
+			method: http.MethodGet,
+			url:    "http://example.com/repos",
+			want: &Route{
+				Host: "example.com", Path: "/repos", Type: "http",
+			},
+		},
+		{
+			name: "path specificity outweighs methods",
+			routeConfig: []*Route{
+				{Host: "example.com", Path: "/repos/:repo", Type: "http", Method: "GET"},
+				{Host: "example.com", Path: "/repos/:repo/issues", Type: "http"},
+			},
+			method: http.MethodGet,
+			url:    "http://example.com/repos/mock-proxy/issues",
+			want: &Route{
+				Host: "example.com", Path: "/repos/:repo/issues", Type: "http",
+			},
+		},
+		{
+			name: "overlapping method specific routes",
+			routeConfig: []*Route{
+				{Host: "example.com", Path: "/repos", Type: "http", Method: "POST"},
+				{Host: "example.com", Path: "/repos", Type: "http", Methods: []string{"GET", "POST"}},
+			},
+			method:  http.MethodPost,
+			url:     "http://example.com/repos",
+			wantErr: "multiple routes matched input",
+		},
+		{
+			name: "matchers must all match",
+			routeConfig: []*Route{
+				{Host: "example.com", Path: "/hooks", Type: "http", Matchers: []*Matcher{
+					{Kind: MatchHeader, Name: "X-GitHub-Event", Equals: strPtr("push")},
+					{Kind: MatchQuery, Name: "secret"},
+				}},
+			},
+			url:     "http://example.com/hooks",
+			headers: map[string]string{"X-GitHub-Event": "push"},
+			want:    nil,
+		},
+		{
+			name: "the most constrained route wins",
+			routeConfig: []*Route{
+				{Host: "example.com", Path: "/graphql", Type: "http"},
+				{Host: "example.com", Path: "/graphql", Type: "http", Method: "POST", Matchers: []*Matcher{
+					{Kind: MatchJSON, Path: "operationName", Equals: strPtr("GetViewer")},
+				}},
+				{Host: "example.com", Path: "/graphql", Type: "http", Method: "POST"},
+			},
+			method: http.MethodPost,
+			url:    "http://example.com/graphql",
+			body:   `{"operationName": "GetViewer"}`,
+			want: &Route{
+				Host: "example.com", Path: "/graphql", Type: "http", Method: "POST", Matchers: []*Matcher{
+					{Kind: MatchJSON, Path: "operationName", Equals: strPtr("GetViewer")},
+				},
+			},
+		},
+		{
+			name: "less constrained routes catch the rest",
+			routeConfig: []*Route{
+				{Host: "example.com", Path: "/graphql", Type: "http", Method: "POST", Matchers: []*Matcher{
+					{Kind: MatchJSON, Path: "operationName", Equals: strPtr("GetViewer")},
+				}},
+				{Host: "example.com", Path: "/graphql", Type: "http", Method: "POST"},
+			},
+			method: http.MethodPost,
+			url:    "http://example.com/graphql",
+			body:   `{"operationName": "GetRepository"}`,
+			want: &Route{
+				Host: "example.com", Path: "/graphql", Type: "http", Method: "POST",
+			},
+		},
+		{
+			name: "equally constrained routes overlap",
+			routeConfig: []*Route{
+				{Host: "example.com", Path: "/graphql", Type: "http", Matchers: []*Matcher{
+					{Kind: MatchBody, Regex: "query"},
+				}},
+				{Host: "example.com", Path: "/graphql", Type: "http", Method: "POST"},
+			},
+			method:  http.MethodPost,
+			url:     "http://example.com/graphql",
+			body:    `{"query": "{ viewer { login } }"}`,
+			wantErr: "multiple routes matched input",
+		},
 	}
 
 	for _, tc := range tcs {
@@ -218,10 +442,17 @@ func TestMatchRoute(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			t.Parallel()
 
-			inURL, err := url.Parse(tc.url)
+			method := http.MethodGet
+			if tc.method != "" {
+				method = tc.method
+			}
+			req, err := http.NewRequest(method, tc.url, strings.NewReader(tc.body))
 			require.Nil(t, err)
+			for k, v := range tc.headers {
+				req.Header.Add(k, v)
+			}
 
-			got, err := tc.routeConfig.MatchRoute(inURL)
+			got, err := tc.routeConfig.MatchRoute(req)
 			if tc.wantErr == "" {
 				require.Nil(t, err)
 				assert.Equal(t, tc.want, got)
@@ -246,6 +477,43 @@ func TestParseRoutes(t *testing.T) {
 				{Host: "example.com", Path: "/simple", Type: "http"},
 				{Host: "example.com", Path: "/substitutions", Type: "http"},
 				{Host: "example.com", Path: "/users/:name", Type: "http"},
+				{Host: "example.com", Path: "/repos", Type: "http"},
+				{Host: "example.com", Path: "/repos", Type: "http", Method: "POST"},
+				{Host: "example.com", Path: "/created", Type: "http"},
+				{
+					Host: "example.com", Path: "/graphql", Type: "http", Method: "POST",
+					File: "example.com/graphql/viewer.mock",
+					Matchers: []*Matcher{
+						{Kind: MatchJSON, Path: "$.operationName", Equals: strPtr("GetViewer")},
+					},
+				},
+				{
+					Host: "example.com", Path: "/graphql", Type: "http", Method: "POST",
+					File: "example.com/graphql/issue.mock",
+					Matchers: []*Matcher{
+						{Kind: MatchBody, Regex: `mutation\s+CreateIssue`},
+						{Kind: MatchHeader, Name: "Authorization", Regex: "^Bearer "},
+					},
+				},
+				{
+					Host: "example.com", Path: "/orders", Type: "http", Method: "GET",
+					File: "example.com/orders/empty.mock",
+				},
+				{
+					Host: "example.com", Path: "/orders", Type: "http", Method: "POST",
+					Body: strPtr(`{"id": 1}`), Scenario: "orders", NextState: "ordered",
+				},
+				{
+					Host: "example.com", Path: "/orders", Type: "http", Method: "GET",
+					File: "example.com/orders/placed.mock", Scenario: "orders", State: "ordered",
+				},
+				{
+					Host: "example.com", Path: "/jobs/:id", Type: "http",
+					Responses: []string{
+						"example.com/jobs/pending.mock",
+						"example.com/jobs/done.mock",
+					},
+				},
 			},
 		},
 	}
@@ -255,6 +523,10 @@ func TestParseRoutes(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			t.Parallel()
 
+			for _, route := range tc.want {
+				require.Nil(t, route.Validate())
+			}
+
 			got, err := ParseRoutes(tc.input)
 			require.Nil(t, err)
 
@@ -262,3 +534,11 @@ func TestParseRoutes(t *testing.T) {
 		})
 	}
 }
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
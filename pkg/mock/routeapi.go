@@ -0,0 +1,219 @@
+package mock
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrRouteNotFound is returned when no runtime Route has a given ID.
+	ErrRouteNotFound = errors.New("route not found")
+
+	// ErrRouteExists is returned when adding a Route with an ID that is
+	// already in use.
+	ErrRouteExists = errors.New("route already exists")
+)
+
+// newRouteID generates a random ID for a Route added without one.
+func newRouteID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// AddRoute validates a Route and adds it to the runtime routes, which are
+// served alongside the routes file but never written to it. A Route without an
+// ID is given a random one.
+func (ms *MockServer) AddRoute(route *Route) error {
+	if err := route.Validate(); err != nil {
+		return err
+	}
+
+	if route.ID == "" {
+		id, err := newRouteID()
+		if err != nil {
+			return fmt.Errorf("error generating route ID: %w", err)
+		}
+		route.ID = id
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for _, rc := range []RouteConfig{ms.routeConfig, ms.runtimeRoutes} {
+		for _, existing := range rc {
+			if existing.ID == route.ID {
+				return fmt.Errorf("%w: %s", ErrRouteExists, route.ID)
+			}
+		}
+	}
+
+	// Copy rather than append in place, as readers may hold the old slice.
+	rc := make(RouteConfig, 0, len(ms.runtimeRoutes)+1)
+	rc = append(rc, ms.runtimeRoutes...)
+	ms.runtimeRoutes = append(rc, route)
+
+	return nil
+}
+
+// ReplaceRoute validates a Route and replaces the runtime Route with the same
+// ID, or adds it if there is no such runtime Route.
+func (ms *MockServer) ReplaceRoute(route *Route) error {
+	if route.ID == "" {
+		return fmt.Errorf("route requires an ID to be replaced")
+	}
+	if err := route.Validate(); err != nil {
+		return err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for _, existing := range ms.routeConfig {
+		if existing.ID == route.ID {
+			return fmt.Errorf("%w in the routes file: %s", ErrRouteExists, route.ID)
+		}
+	}
+
+	rc := make(RouteConfig, 0, len(ms.runtimeRoutes)+1)
+	var replaced bool
+	for _, existing := range ms.runtimeRoutes {
+		if existing.ID == route.ID {
+			rc = append(rc, route)
+			replaced = true
+		} else {
+			rc = append(rc, existing)
+		}
+	}
+	if !replaced {
+		rc = append(rc, route)
+	}
+	ms.runtimeRoutes = rc
+	ms.scenarios.prune(ms.routeConfig, ms.runtimeRoutes)
+
+	return nil
+}
+
+// DeleteRoute removes the runtime Route with a given ID.
+func (ms *MockServer) DeleteRoute(id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	rc := make(RouteConfig, 0, len(ms.runtimeRoutes))
+	for _, existing := range ms.runtimeRoutes {
+		if existing.ID != id {
+			rc = append(rc, existing)
+		}
+	}
+	if len(rc) == len(ms.runtimeRoutes) {
+		return fmt.Errorf("%w: %s", ErrRouteNotFound, id)
+	}
+	ms.runtimeRoutes = rc
+	ms.scenarios.prune(ms.routeConfig, ms.runtimeRoutes)
+
+	return nil
+}
+
+// ResetRoutes removes all runtime Routes.
+func (ms *MockServer) ResetRoutes() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.runtimeRoutes = nil
+	ms.scenarios.prune(ms.routeConfig)
+}
+
+// routesHandler manages runtime routes, using JSON representations of Routes.
+//   GET /routes) Returns every Route currently in use.
+//   POST /routes) Adds a new runtime Route.
+//   DELETE /routes) Removes every runtime Route.
+//   GET /routes/:id) Returns a single Route.
+//   PUT /routes/:id) Adds or replaces a runtime Route.
+//   DELETE /routes/:id) Removes a runtime Route.
+//     curl -X POST -d '{"host":"example.com","path":"/","type":"http","body":"hi"}' squid.proxy/routes
+func (ms *MockServer) routesHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/routes"), "/")
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, ms.Routes())
+	case id == "" && r.Method == http.MethodPost:
+		route := &Route{}
+		if err := json.NewDecoder(r.Body).Decode(route); err != nil {
+			http.Error(w, fmt.Sprintf("error parsing route: %s", err.Error()),
+				http.StatusBadRequest)
+			return
+		}
+
+		if err := ms.AddRoute(route); err != nil {
+			writeRouteError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, route)
+	case id == "" && r.Method == http.MethodDelete:
+		ms.ResetRoutes()
+		w.WriteHeader(http.StatusNoContent)
+	case id != "" && r.Method == http.MethodGet:
+		for _, route := range ms.Routes() {
+			if route.ID == id {
+				writeJSON(w, http.StatusOK, route)
+				return
+			}
+		}
+		writeRouteError(w, fmt.Errorf("%w: %s", ErrRouteNotFound, id))
+	case id != "" && r.Method == http.MethodPut:
+		route := &Route{}
+		if err := json.NewDecoder(r.Body).Decode(route); err != nil {
+			http.Error(w, fmt.Sprintf("error parsing route: %s", err.Error()),
+				http.StatusBadRequest)
+			return
+		}
+		route.ID = id
+
+		if err := ms.ReplaceRoute(route); err != nil {
+			writeRouteError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, route)
+	case id != "" && r.Method == http.MethodDelete:
+		if err := ms.DeleteRoute(id); err != nil {
+			writeRouteError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeRouteError converts an error managing routes into a response.
+func writeRouteError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrRouteNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrRouteExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// writeJSON writes a value as a JSON response.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(js)
+}
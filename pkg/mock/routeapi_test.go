@@ -0,0 +1,187 @@
+package mock
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// doAPI sends a request to an API handler, returning the recorded response.
+func doAPI(
+	t *testing.T,
+	handler http.HandlerFunc,
+	method, url, body string,
+) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.Nil(t, err)
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, req)
+	return recorder
+}
+
+func TestMockServerRoutesHandler(t *testing.T) {
+	t.Parallel()
+
+	ms, err := NewMockServer(WithMockRoot("testdata/"))
+	require.Nil(t, err)
+	fileRoutes := len(ms.Routes())
+
+	// Add a runtime route with an inline body and response.
+	res := doAPI(t, ms.routesHandler, http.MethodPost, "/routes", `{
+		"id": "teapot",
+		"host": "example.com",
+		"path": "/teapot/:name",
+		"type": "http",
+		"method": "GET",
+		"body": "I'm a teapot called {{ .name }}",
+		"response": {"status": 418, "headers": {"X-Short": "stout"}}
+	}`)
+	require.Equal(t, http.StatusCreated, res.Code, res.Body.String())
+
+	// It is listed alongside the routes file.
+	res = doAPI(t, ms.routesHandler, http.MethodGet, "/routes", "")
+	require.Equal(t, http.StatusOK, res.Code)
+	var got []*Route
+	require.Nil(t, json.Unmarshal(res.Body.Bytes(), &got))
+	require.Len(t, got, fileRoutes+1)
+	assert.Equal(t, "teapot", got[fileRoutes].ID)
+
+	res = doAPI(t, ms.routesHandler, http.MethodGet, "/routes/teapot", "")
+	require.Equal(t, http.StatusOK, res.Code)
+
+	// And served.
+	mockRes := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/teapot/earl", nil)
+	require.Nil(t, err)
+	ms.mockHandler(mockRes, req)
+	assert.Equal(t, 418, mockRes.Code)
+	assert.Equal(t, "stout", mockRes.Header().Get("X-Short"))
+	assert.Equal(t, "I'm a teapot called earl", mockRes.Body.String())
+
+	// Adding it again conflicts.
+	res = doAPI(t, ms.routesHandler, http.MethodPost, "/routes",
+		`{"id": "teapot", "host": "example.com", "path": "/", "type": "http"}`)
+	assert.Equal(t, http.StatusConflict, res.Code)
+
+	// Replace it.
+	res = doAPI(t, ms.routesHandler, http.MethodPut, "/routes/teapot",
+		`{"host": "example.com", "path": "/teapot/:name", "type": "http", "body": "replaced"}`)
+	require.Equal(t, http.StatusOK, res.Code, res.Body.String())
+
+	mockRes = httptest.NewRecorder()
+	ms.mockHandler(mockRes, req)
+	assert.Equal(t, http.StatusOK, mockRes.Code)
+	assert.Equal(t, "replaced", mockRes.Body.String())
+
+	// Delete it.
+	res = doAPI(t, ms.routesHandler, http.MethodDelete, "/routes/teapot", "")
+	assert.Equal(t, http.StatusNoContent, res.Code)
+	assert.Len(t, ms.Routes(), fileRoutes)
+
+	res = doAPI(t, ms.routesHandler, http.MethodDelete, "/routes/teapot", "")
+	assert.Equal(t, http.StatusNotFound, res.Code)
+	res = doAPI(t, ms.routesHandler, http.MethodGet, "/routes/teapot", "")
+	assert.Equal(t, http.StatusNotFound, res.Code)
+}
+
+func TestMockServerRoutesHandlerErrors(t *testing.T) {
+	tcs := []struct {
+		name     string
+		method   string
+		url      string
+		body     string
+		wantCode int
+	}{
+		{
+			name:     "invalid json",
+			method:   http.MethodPost,
+			url:      "/routes",
+			body:     `{"host":`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid route",
+			method:   http.MethodPost,
+			url:      "/routes",
+			body:     `{"host": "example.com", "path": "/", "type": "ftp"}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid matcher",
+			method:   http.MethodPut,
+			url:      "/routes/foo",
+			body:     `{"host": "example.com", "path": "/", "type": "http", "match": [{"kind": "header"}]}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "file outside the mock root",
+			method:   http.MethodPost,
+			url:      "/routes",
+			body:     `{"host": "example.com", "path": "/", "type": "http", "file": "../../../etc/passwd"}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "absolute file",
+			method:   http.MethodPut,
+			url:      "/routes/foo",
+			body:     `{"host": "example.com", "path": "/", "type": "http", "file": "/etc/passwd"}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "response outside the mock root",
+			method:   http.MethodPost,
+			url:      "/routes",
+			body:     `{"host": "example.com", "path": "/", "type": "http", "responses": ["ok.mock", "a/../../secret"]}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid method",
+			method:   http.MethodPatch,
+			url:      "/routes/foo",
+			wantCode: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ms, err := NewMockServer(WithMockRoot("testdata/"))
+			require.Nil(t, err)
+
+			res := doAPI(t, ms.routesHandler, tc.method, tc.url, tc.body)
+			assert.Equal(t, tc.wantCode, res.Code)
+		})
+	}
+}
+
+func TestMockServerRuntimeRoutesSurviveReload(t *testing.T) {
+	t.Parallel()
+
+	root := newReloadRoot(t, reloadRoutesBefore)
+	ms, err := NewMockServer(WithMockRoot(root))
+	require.Nil(t, err)
+
+	require.Nil(t, ms.AddRoute(&Route{Host: "example.com", Path: "/runtime", Type: "http"}))
+
+	writeRoutes(t, root, reloadRoutesAfter)
+	require.Nil(t, ms.Reload())
+
+	routes := ms.Routes()
+	require.Len(t, routes, 2)
+	assert.Equal(t, "/after", routes[0].Path)
+	assert.Equal(t, "/runtime", routes[1].Path)
+	assert.NotEmpty(t, routes[1].ID)
+
+	// Reset removes only the runtime routes.
+	res := doAPI(t, ms.routesHandler, http.MethodDelete, "/routes", "")
+	assert.Equal(t, http.StatusNoContent, res.Code)
+	assert.Len(t, ms.Routes(), 1)
+}
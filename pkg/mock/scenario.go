@@ -0,0 +1,250 @@
+package mock
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ScenarioStarted is the state every scenario begins in, and returns to when
+// it is reset.
+const ScenarioStarted = "started"
+
+// The ways a Route's Responses sequence can continue once exhausted.
+const (
+	// SequenceStick repeats the last response forever. This is the default.
+	SequenceStick = "stick"
+
+	// SequenceCycle starts again from the first response.
+	SequenceCycle = "cycle"
+)
+
+// scenarios tracks the current state of every scenario, and how far through
+// its Responses each Route with a sequence is.
+type scenarios struct {
+	mu       sync.Mutex
+	states   map[string]string
+	counters map[string]*sequence
+}
+
+// sequence is how far through its Responses a Route is.
+type sequence struct {
+	scenario string
+	count    int
+}
+
+// newScenarios creates a scenarios with every scenario in ScenarioStarted.
+func newScenarios() *scenarios {
+	return &scenarios{
+		states:   map[string]string{},
+		counters: map[string]*sequence{},
+	}
+}
+
+// sequenceKey identifies the sequence of a Route, which must survive reloads
+// and replacements, as they create new Routes. Routes are identified by their
+// ID, or else by what they match.
+func sequenceKey(route *Route) string {
+	if route.ID != "" {
+		return "id " + route.ID
+	}
+
+	key, _ := json.Marshal(struct {
+		Host     string
+		Path     string
+		Methods  []string
+		Matchers []*Matcher
+		Scenario string
+		State    string
+	}{route.Host, route.Path, route.methods(), route.Matchers, route.Scenario, route.State})
+	return string(key)
+}
+
+// state returns the current state of a scenario.
+func (s *scenarios) state(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if state, ok := s.states[name]; ok {
+		return state
+	}
+	return ScenarioStarted
+}
+
+// setState moves a scenario to a new state.
+func (s *scenarios) setState(name, state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.states[name] = state
+}
+
+// filter returns the Routes that are allowed to match in the current states,
+// which are any Routes that don't require their scenario to be in a state,
+// and those whose scenario is in the required state.
+func (s *scenarios) filter(rc RouteConfig) RouteConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	filtered := make(RouteConfig, 0, len(rc))
+	for _, route := range rc {
+		if route.State != "" {
+			current, ok := s.states[route.Scenario]
+			if !ok {
+				current = ScenarioStarted
+			}
+			if current != route.State {
+				continue
+			}
+		}
+		filtered = append(filtered, route)
+	}
+	return filtered
+}
+
+// next returns the index of the response a Route with a sequence should serve
+// next, and advances the sequence.
+func (s *scenarios) next(route *Route) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := sequenceKey(route)
+	seq, ok := s.counters[key]
+	if !ok {
+		seq = &sequence{scenario: route.Scenario}
+		s.counters[key] = seq
+	}
+	count := seq.count
+	seq.count++
+
+	if route.Sequence == SequenceCycle {
+		return count % len(route.Responses)
+	}
+	if count >= len(route.Responses) {
+		return len(route.Responses) - 1
+	}
+	return count
+}
+
+// reset returns one scenario, or every scenario if name is empty, to
+// ScenarioStarted, and restarts the sequences of its Routes.
+func (s *scenarios) reset(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if name == "" {
+		s.states = map[string]string{}
+		s.counters = map[string]*sequence{}
+		return
+	}
+
+	delete(s.states, name)
+	for key, seq := range s.counters {
+		if seq.scenario == name {
+			delete(s.counters, key)
+		}
+	}
+}
+
+// prune forgets the sequences of Routes that are no longer in use, once the
+// Routes have been reloaded or replaced. The sequences of the Routes that are
+// still in use carry on where they were.
+func (s *scenarios) prune(rcs ...RouteConfig) {
+	inUse := map[string]bool{}
+	for _, rc := range rcs {
+		for _, route := range rc {
+			inUse[sequenceKey(route)] = true
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range s.counters {
+		if !inUse[key] {
+			delete(s.counters, key)
+		}
+	}
+}
+
+// matchRoute finds the Route for a request, considering only the Routes that
+// are allowed to match in the current scenario states.
+func (ms *MockServer) matchRoute(r *http.Request) (*Route, error) {
+	return ms.scenarios.filter(ms.Routes()).MatchRoute(r)
+}
+
+// Scenarios returns the current state of every scenario used by a Route, or
+// that has been moved to a state.
+func (ms *MockServer) Scenarios() map[string]string {
+	states := map[string]string{}
+	for _, route := range ms.Routes() {
+		if route.Scenario != "" {
+			states[route.Scenario] = ms.scenarios.state(route.Scenario)
+		}
+	}
+
+	ms.scenarios.mu.Lock()
+	defer ms.scenarios.mu.Unlock()
+	for name, state := range ms.scenarios.states {
+		states[name] = state
+	}
+
+	return states
+}
+
+// SetScenarioState moves a scenario to a new state.
+func (ms *MockServer) SetScenarioState(name, state string) {
+	ms.scenarios.setState(name, state)
+}
+
+// ResetScenarios returns one scenario, or every scenario if name is empty, to
+// ScenarioStarted, and restarts the response sequences of their Routes.
+func (ms *MockServer) ResetScenarios(name string) {
+	ms.scenarios.reset(name)
+}
+
+// scenariosHandler inspects and changes the state of scenarios.
+//   GET /scenarios) Returns a JSON object of scenario names to states.
+//   DELETE /scenarios) Resets every scenario and response sequence.
+//   GET /scenarios/:name) Returns the state of one scenario.
+//   PUT /scenarios/:name) Moves one scenario to the given state.
+//     curl -X PUT -d '{"state":"created"}' squid.proxy/scenarios/repos
+//   DELETE /scenarios/:name) Resets one scenario and its response sequences.
+func (ms *MockServer) scenariosHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/scenarios"), "/")
+
+	type scenarioState struct {
+		State string `json:"state"`
+	}
+
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, ms.Scenarios())
+	case name == "" && r.Method == http.MethodDelete:
+		ms.ResetScenarios("")
+		w.WriteHeader(http.StatusNoContent)
+	case name != "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, scenarioState{State: ms.scenarios.state(name)})
+	case name != "" && r.Method == http.MethodPut:
+		state := scenarioState{}
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			http.Error(w, fmt.Sprintf("error parsing scenario state: %s", err.Error()),
+				http.StatusBadRequest)
+			return
+		}
+		if state.State == "" {
+			http.Error(w, "state must be supplied", http.StatusBadRequest)
+			return
+		}
+
+		ms.SetScenarioState(name, state.State)
+		writeJSON(w, http.StatusOK, state)
+	case name != "" && r.Method == http.MethodDelete:
+		ms.ResetScenarios(name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,177 @@
+package mock
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScenariosNext(t *testing.T) {
+	tcs := []struct {
+		name     string
+		sequence string
+		want     []int
+	}{
+		{name: "stick by default", sequence: "", want: []int{0, 1, 2, 2, 2}},
+		{name: "stick", sequence: SequenceStick, want: []int{0, 1, 2, 2, 2}},
+		{name: "cycle", sequence: SequenceCycle, want: []int{0, 1, 2, 0, 1}},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := newScenarios()
+			route := &Route{Sequence: tc.sequence, Responses: []string{"a", "b", "c"}}
+
+			got := []int{}
+			for range tc.want {
+				got = append(got, s.next(route))
+			}
+			assert.Equal(t, tc.want, got)
+
+			s.reset("")
+			assert.Equal(t, 0, s.next(route))
+		})
+	}
+}
+
+func TestMockServerScenarioStates(t *testing.T) {
+	t.Parallel()
+
+	ms, err := NewMockServer(WithMockRoot("testdata/"))
+	require.Nil(t, err)
+
+	do := func(method string) string {
+		req, err := http.NewRequest(method, "http://example.com/orders", nil)
+		require.Nil(t, err)
+		recorder := httptest.NewRecorder()
+		ms.mockHandler(recorder, req)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		return strings.TrimSpace(recorder.Body.String())
+	}
+
+	assert.Equal(t, map[string]string{"orders": ScenarioStarted}, ms.Scenarios())
+	assert.Equal(t, "[]", do(http.MethodGet))
+
+	// Placing an order moves the scenario on, so the order is then listed.
+	assert.Equal(t, `{"id": 1}`, do(http.MethodPost))
+	assert.Equal(t, map[string]string{"orders": "ordered"}, ms.Scenarios())
+	assert.Equal(t, `[{"id": 1}]`, do(http.MethodGet))
+
+	ms.ResetScenarios("orders")
+	assert.Equal(t, "[]", do(http.MethodGet))
+
+	ms.SetScenarioState("orders", "ordered")
+	assert.Equal(t, `[{"id": 1}]`, do(http.MethodGet))
+}
+
+func TestMockServerResponseSequence(t *testing.T) {
+	t.Parallel()
+
+	ms, err := NewMockServer(WithMockRoot("testdata/"))
+	require.Nil(t, err)
+
+	got := []string{}
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest(http.MethodGet, "http://example.com/jobs/42", nil)
+		require.Nil(t, err)
+		recorder := httptest.NewRecorder()
+		ms.mockHandler(recorder, req)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		got = append(got, strings.TrimSpace(recorder.Body.String()))
+	}
+
+	assert.Equal(t, []string{
+		`{"id": "42", "status": "pending"}`,
+		`{"id": "42", "status": "done"}`,
+		`{"id": "42", "status": "done"}`,
+	}, got)
+}
+
+func TestMockServerResponseSequenceReload(t *testing.T) {
+	t.Parallel()
+
+	routes := `
+route {
+  host      = "example.com"
+  path      = "/jobs"
+  type      = "http"
+  responses = ["pending.mock", "running.mock", "done.mock"]
+}
+`
+	root := newReloadRoot(t, routes)
+	writeMockFiles(t, root, map[string]string{
+		"pending.mock": "pending",
+		"running.mock": "running",
+		"done.mock":    "done",
+	})
+
+	ms, err := NewMockServer(WithMockRoot(root))
+	require.Nil(t, err)
+
+	do := func(url string) string {
+		recorder := httptest.NewRecorder()
+		ms.mockHandler(recorder, httptest.NewRequest(http.MethodGet, url, nil))
+		require.Equal(t, http.StatusOK, recorder.Code)
+		return recorder.Body.String()
+	}
+
+	// Sequences carry on across reloads and replacements, which create new
+	// Routes.
+	assert.Equal(t, "pending", do("http://example.com/jobs"))
+	require.Nil(t, ms.Reload())
+	assert.Equal(t, "running", do("http://example.com/jobs"))
+
+	runtime := func() *Route {
+		return &Route{ID: "builds", Host: "example.org", Path: "/builds", Type: "http",
+			Responses: []string{"pending.mock", "done.mock"}}
+	}
+	require.Nil(t, ms.AddRoute(runtime()))
+	assert.Equal(t, "pending", do("http://example.org/builds"))
+	require.Nil(t, ms.ReplaceRoute(runtime()))
+	assert.Equal(t, "done", do("http://example.org/builds"))
+
+	// The sequences of removed Routes are forgotten.
+	require.Nil(t, ms.DeleteRoute("builds"))
+	writeRoutes(t, root, "")
+	require.Nil(t, ms.Reload())
+	assert.Empty(t, ms.scenarios.counters)
+
+	writeRoutes(t, root, routes)
+	require.Nil(t, ms.Reload())
+	assert.Equal(t, "pending", do("http://example.com/jobs"))
+}
+
+func TestMockServerScenariosHandler(t *testing.T) {
+	t.Parallel()
+
+	ms, err := NewMockServer(WithMockRoot("testdata/"))
+	require.Nil(t, err)
+
+	resp := doAPI(t, ms.scenariosHandler, http.MethodPut, "/scenarios/orders",
+		`{"state": "ordered"}`)
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	resp = doAPI(t, ms.scenariosHandler, http.MethodGet, "/scenarios", "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.JSONEq(t, `{"orders": "ordered"}`, resp.Body.String())
+
+	resp = doAPI(t, ms.scenariosHandler, http.MethodPut, "/scenarios/orders", `{}`)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	resp = doAPI(t, ms.scenariosHandler, http.MethodDelete, "/scenarios", "")
+	require.Equal(t, http.StatusNoContent, resp.Code)
+
+	resp = doAPI(t, ms.scenariosHandler, http.MethodGet, "/scenarios/orders", "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.JSONEq(t, `{"state": "started"}`, resp.Body.String())
+
+	resp = doAPI(t, ms.scenariosHandler, http.MethodPost, "/scenarios", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.Code)
+}
@@ -0,0 +1,464 @@
+package mock
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	templateparse "text/template/parse"
+	"time"
+)
+
+// TemplateRequestKey is the key of the incoming request in the context that
+// mock bodies are rendered with. It takes precedence over any variable of the
+// same name.
+const TemplateRequestKey = "request"
+
+// TemplateRequest describes the incoming request to mock body templates.
+//   {{ .request.Method }} {{ .request.Path }}
+//   {{ .request.Header "Authorization" }}
+//   {{ .request.Query "page" }}
+//   {{ .request.Param "org" }}
+//   {{ .request.JSON.user.login }}
+type TemplateRequest struct {
+	Method   string
+	URL      string
+	Host     string
+	Path     string
+	RawQuery string
+	Headers  http.Header
+	Params   map[string]string
+	Body     string
+
+	// JSON is the decoded request body, if it is JSON.
+	JSON interface{}
+}
+
+// newTemplateRequest creates a TemplateRequest for a request, with the values
+// of the path parameters of the Route it matched.
+func newTemplateRequest(r *http.Request, params map[string]string) *TemplateRequest {
+	host := r.URL.Host
+	if host == "" {
+		host = r.Host
+	}
+
+	tr := &TemplateRequest{
+		Method:   r.Method,
+		URL:      r.URL.String(),
+		Host:     host,
+		Path:     r.URL.Path,
+		RawQuery: r.URL.RawQuery,
+		Headers:  r.Header,
+		Params:   params,
+	}
+
+	if body, err := readBody(r); err == nil {
+		tr.Body = string(body)
+
+		var doc interface{}
+		if err := json.Unmarshal(body, &doc); err == nil {
+			tr.JSON = doc
+		}
+	}
+
+	return tr
+}
+
+// Header returns the first value of a request header.
+func (tr *TemplateRequest) Header(name string) string {
+	return tr.Headers.Get(name)
+}
+
+// Query returns the first value of a query parameter.
+func (tr *TemplateRequest) Query(name string) string {
+	values, _ := url.ParseQuery(tr.RawQuery)
+	return values.Get(name)
+}
+
+// Param returns the value of a path parameter, such as :org.
+func (tr *TemplateRequest) Param(name string) string {
+	return tr.Params[name]
+}
+
+// templateTimeLayouts are the names of the time layouts understood by the
+// date template function, in addition to Go layouts.
+var templateTimeLayouts = map[string]string{
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"RFC1123":     time.RFC1123,
+	"RFC1123Z":    time.RFC1123Z,
+	"RFC822":      time.RFC822,
+	"Kitchen":     time.Kitchen,
+	"HTTP":        http.TimeFormat,
+}
+
+// templateFuncs are the helper functions available to mock body templates.
+var templateFuncs = template.FuncMap{
+	// uuid returns a random version 4 UUID.
+	"uuid": func() (string, error) {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		b[6] = (b[6] & 0x0f) | 0x40
+		b[8] = (b[8] & 0x3f) | 0x80
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+	},
+
+	// now returns the current time in UTC, and date formats a time with
+	// either a Go layout or the name of a standard layout, or as "unix"
+	// seconds.
+	//   {{ now | date "RFC3339" }}
+	//   {{ (now.Add (duration "1h")) | date "2006-01-02" }}
+	"now": func() time.Time {
+		return time.Now().UTC()
+	},
+	"date": func(layout string, t time.Time) string {
+		if layout == "unix" {
+			return fmt.Sprintf("%d", t.Unix())
+		}
+		if named, ok := templateTimeLayouts[layout]; ok {
+			layout = named
+		}
+		return t.Format(layout)
+	},
+	"duration": time.ParseDuration,
+
+	// randInt returns a random integer in [min, max).
+	"randInt": func(min, max int) (int, error) {
+		if max <= min {
+			return 0, fmt.Errorf("randInt requires max to be greater than min")
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(max-min)))
+		if err != nil {
+			return 0, err
+		}
+		return min + int(n.Int64()), nil
+	},
+
+	"base64Encode": func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	},
+	"base64Decode": func(s string) (string, error) {
+		b, err := base64.StdEncoding.DecodeString(s)
+		return string(b), err
+	},
+
+	// json encodes a value as JSON, which also escapes a string for use
+	// inside a JSON document.
+	//   {"login": {{ .request.Query "login" | json }}}
+	"json": func(v interface{}) (string, error) {
+		b, err := encodeJSON(v)
+		return string(b), err
+	},
+
+	// default returns a value, or the default if the value is empty.
+	//   {{ .request.Query "page" | default "1" }}
+	"default": func(def, v interface{}) interface{} {
+		if v == nil || v == "" {
+			return def
+		}
+		return v
+	},
+
+	// seq returns the integers from start to end inclusive, for ranging over.
+	//   {{ range seq 1 3 }}{"id": {{ . }}}{{ end }}
+	"seq": func(start, end int) []int {
+		s := []int{}
+		for i := start; i <= end; i++ {
+			s = append(s, i)
+		}
+		return s
+	},
+	"add": func(a, b int) int { return a + b },
+
+	templateVariableFunc: variableOr,
+
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"trim":  strings.TrimSpace,
+}
+
+// templateVariableFunc is the name of the template function that simple
+// actions referring to a variable are rewritten to call.
+const templateVariableFunc = "mockVariable"
+
+// variableOr returns the value of a variable, or the text of the action that
+// referred to it if it is missing, so that it is left as it is.
+func variableOr(data map[string]interface{}, key, text string) interface{} {
+	if v, ok := data[key]; ok {
+		return v
+	}
+	return text
+}
+
+// compileTemplate parses a mock body as a template. Each simple action that
+// refers to a variable, such as {{ .key }}, is rewritten so that it is left as
+// it is if the variable is missing, as it may be filled by a later
+// Transformer. The parsed template doesn't depend on the variables, so it can
+// be cached and executed many times.
+func compileTemplate(name string, body []byte) (*template.Template, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Parse(string(body))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing mock template: %w", err)
+	}
+
+	if tmpl.Tree != nil {
+		if err := rewriteVariables(tmpl.Root); err != nil {
+			return nil, fmt.Errorf("error parsing mock template: %w", err)
+		}
+	}
+	return tmpl, nil
+}
+
+// rewriteVariables rewrites each simple action that refers to a variable to
+// call templateVariableFunc instead. Actions inside range and with blocks are
+// left alone, as dot no longer refers to the variables there.
+func rewriteVariables(node templateparse.Node) error {
+	switch n := node.(type) {
+	case *templateparse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for i, child := range n.Nodes {
+			key, ok := simpleAction(child)
+			if !ok {
+				if err := rewriteVariables(child); err != nil {
+					return err
+				}
+				continue
+			}
+
+			call, err := template.New("").Funcs(templateFuncs).Parse(fmt.Sprintf(
+				"{{%s . %q %q}}", templateVariableFunc, key, child.String()))
+			if err != nil {
+				return err
+			}
+			n.Nodes[i] = call.Root.Nodes[0]
+		}
+	case *templateparse.IfNode:
+		if err := rewriteVariables(n.List); err != nil {
+			return err
+		}
+		return rewriteVariables(n.ElseList)
+	}
+	return nil
+}
+
+// simpleAction returns the variable of an action that only prints a single
+// top level variable, such as {{ .key }}.
+func simpleAction(node templateparse.Node) (string, bool) {
+	action, ok := node.(*templateparse.ActionNode)
+	if !ok || len(action.Pipe.Decl) != 0 || len(action.Pipe.Cmds) != 1 {
+		return "", false
+	}
+
+	args := action.Pipe.Cmds[0].Args
+	if len(args) != 1 {
+		return "", false
+	}
+	field, ok := args[0].(*templateparse.FieldNode)
+	if !ok || len(field.Ident) != 1 {
+		return "", false
+	}
+	return field.Ident[0], true
+}
+
+// executeTemplate renders a compiled mock template in a single pass, with the
+// given variables, and the request under TemplateRequestKey, if there is one.
+func executeTemplate(tmpl *template.Template, vars map[string]string, req *TemplateRequest) ([]byte, error) {
+	data := make(map[string]interface{}, len(vars)+1)
+	for k, v := range vars {
+		data[k] = v
+	}
+	if req != nil {
+		data[TemplateRequestKey] = req
+	}
+
+	b := &bytes.Buffer{}
+	if err := tmpl.Execute(b, data); err != nil {
+		return nil, fmt.Errorf("error rendering mock template: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
+// renderTemplate compiles and executes a mock body.
+func renderTemplate(name string, body []byte, vars map[string]string, req *TemplateRequest) ([]byte, error) {
+	tmpl, err := compileTemplate(name, body)
+	if err != nil {
+		return nil, err
+	}
+	return executeTemplate(tmpl, vars, req)
+}
+
+// maxCachedTemplates bounds the size of a templateCache, which is emptied
+// when it is full.
+const maxCachedTemplates = 1024
+
+// templateCache holds compiled mock templates, so that each mock is only
+// parsed once. Mock files are keyed by their path, and recompiled whenever
+// their modification time or size changes. Inline bodies are keyed by their
+// contents.
+type templateCache struct {
+	mu        sync.Mutex
+	templates map[string]*cachedTemplate
+}
+
+// cachedTemplate is a compiled template, along with the modification time and
+// size of the mock file it was compiled from.
+type cachedTemplate struct {
+	modTime time.Time
+	size    int64
+	tmpl    *template.Template
+}
+
+// newTemplateCache creates an empty templateCache.
+func newTemplateCache() *templateCache {
+	return &templateCache{templates: map[string]*cachedTemplate{}}
+}
+
+// get returns the compiled template for a mock, compiling it if it isn't
+// cached or has changed since it was cached.
+func (c *templateCache) get(name string, mock io.Reader) (*template.Template, error) {
+	var key string
+	var modTime time.Time
+	var size int64
+	var body []byte
+
+	if f, ok := mock.(*os.File); ok {
+		info, err := f.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("error reading mock: %w", err)
+		}
+		key, modTime, size = "file:"+f.Name(), info.ModTime(), info.Size()
+	} else {
+		b, err := ioutil.ReadAll(mock)
+		if err != nil {
+			return nil, fmt.Errorf("error reading mock: %w", err)
+		}
+		key, size, body = "body:"+string(b), int64(len(b)), b
+	}
+
+	c.mu.Lock()
+	cached, ok := c.templates[key]
+	c.mu.Unlock()
+	if ok && cached.modTime.Equal(modTime) && cached.size == size {
+		return cached.tmpl, nil
+	}
+
+	if body == nil {
+		b, err := ioutil.ReadAll(mock)
+		if err != nil {
+			return nil, fmt.Errorf("error reading mock: %w", err)
+		}
+		body = b
+	}
+
+	tmpl, err := compileTemplate(name, body)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.templates) >= maxCachedTemplates {
+		c.templates = map[string]*cachedTemplate{}
+	}
+	c.templates[key] = &cachedTemplate{modTime: modTime, size: size, tmpl: tmpl}
+	return tmpl, nil
+}
+
+// render renders a mock in a single pass, with the variable substitutions for
+// the request and the path parameters of its Route merged into one context,
+// along with the request. Any other Transformers are then applied in turn.
+//
+// Mocks often hold {{ that isn't meant for mock-proxy, like HTML, Handlebars
+// or Mustache fixtures, so a mock that fails to render is served as it is, as
+// is any mock whose MockResponse turns templating off.
+func (ms *MockServer) render(
+	name string,
+	mock io.Reader,
+	r *http.Request,
+	route *Route,
+	mr *MockResponse,
+	localTransformers []Transformer,
+) (io.Reader, error) {
+	// Mock files are cached by their modification time and size, and read
+	// again if they need to be served as they are. Anything else is read
+	// up front.
+	var raw []byte
+	if _, ok := mock.(*os.File); !ok || !mr.templated() {
+		b, err := ioutil.ReadAll(mock)
+		if err != nil {
+			return nil, fmt.Errorf("error reading mock: %w", err)
+		}
+		raw, mock = b, bytes.NewReader(b)
+	}
+
+	body := raw
+	if mr.templated() {
+		rendered, err := ms.execute(name, mock, r, route, localTransformers)
+		if err != nil {
+			ms.logger.Warn("serving mock that failed to render as it is", "mock", name, "error", err.Error())
+			if f, ok := mock.(*os.File); ok {
+				if _, err := f.Seek(0, io.SeekStart); err != nil {
+					return nil, fmt.Errorf("error reading mock: %w", err)
+				}
+				if raw, err = ioutil.ReadAll(f); err != nil {
+					return nil, fmt.Errorf("error reading mock: %w", err)
+				}
+			}
+			rendered = raw
+		}
+		body = rendered
+	}
+
+	var err error
+	var res io.Reader = bytes.NewReader(body)
+	for _, t := range localTransformers {
+		if _, ok := t.(*VariableSubstitution); ok {
+			continue
+		}
+		if res, err = t.Transform(res); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// execute compiles, or fetches from the cache, and executes the template of a
+// mock, with the variables of the request and the path parameters of its
+// Route.
+func (ms *MockServer) execute(
+	name string,
+	mock io.Reader,
+	r *http.Request,
+	route *Route,
+	localTransformers []Transformer,
+) ([]byte, error) {
+	tmpl, err := ms.templates.get(name, mock)
+	if err != nil {
+		return nil, err
+	}
+
+	vars := ms.requestVariables(r, route)
+	params := map[string]string{}
+	for _, t := range localTransformers {
+		if vs, ok := t.(*VariableSubstitution); ok {
+			vars[vs.key] = vs.value
+			params[vs.key] = vs.value
+		}
+	}
+
+	return executeTemplate(tmpl, vars, newTemplateRequest(r, params))
+}
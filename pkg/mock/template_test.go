@@ -0,0 +1,244 @@
+package mock
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	vars := map[string]string{"name": "world", "org": "hashicorp"}
+
+	tcs := []struct {
+		name      string
+		input     string
+		want      string
+		wantMatch string
+		wantErr   string
+	}{
+		{
+			name:  "variables",
+			input: "Hello, {{ .name }} from {{ .org }}!",
+			want:  "Hello, world from hashicorp!",
+		},
+		{
+			name:  "missing variables are preserved",
+			input: "Hello, {{ .name }} and {{ .missing }}{{ if .name }} and {{.other}}{{ end }}",
+			want:  "Hello, world and {{.missing}} and {{.other}}",
+		},
+		{
+			name:  "request",
+			input: `{{ .request.Method }} {{ .request.Host }}{{ .request.Path }} {{ .request.Param "id" }}`,
+			want:  "POST example.com/repos/42 42",
+		},
+		{
+			name:  "headers and query",
+			input: `{{ .request.Header "X-Team" }} page {{ .request.Query "page" }} of {{ .request.Query "pages" | default "1" }}`,
+			want:  "platform page 2 of 1",
+		},
+		{
+			name:  "json body",
+			input: `{"login": {{ .request.JSON.user.login | json }}, "count": {{ len .request.JSON.items }}}`,
+			want:  `{"login": "octo<cat>", "count": 2}`,
+		},
+		{
+			name:  "conditionals and loops",
+			input: `{{ range .request.JSON.items }}{{ .id }},{{ end }}{{ if eq .org "hashicorp" }}ok{{ else }}no{{ end }}`,
+			want:  "1,2,ok",
+		},
+		{
+			name:  "seq",
+			input: `[{{ range $i := seq 1 3 }}{{ if gt $i 1 }},{{ end }}{"id": {{ add $i 100 }}}{{ end }}]`,
+			want:  `[{"id": 101},{"id": 102},{"id": 103}]`,
+		},
+		{
+			name:  "base64 and strings",
+			input: `{{ base64Encode .name }} {{ base64Decode "aGk=" }} {{ upper .org }} {{ lower "A" }} {{ trim "  x " }}`,
+			want:  "d29ybGQ= hi HASHICORP a x",
+		},
+		{
+			name:      "uuid",
+			input:     "{{ uuid }}",
+			wantMatch: `\A[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}\z`,
+		},
+		{
+			name:      "random int",
+			input:     "{{ randInt 10 20 }}",
+			wantMatch: `\A1[0-9]\z`,
+		},
+		{
+			name:      "dates",
+			input:     `{{ now | date "2006" }} {{ (now.Add (duration "24h")) | date "unix" }}`,
+			wantMatch: `\A\d{4} \d+\z`,
+		},
+		{
+			name:    "invalid template",
+			input:   "{{ if }}",
+			wantErr: "error parsing mock template",
+		},
+		{
+			name:    "failing function",
+			input:   "{{ randInt 2 1 }}",
+			wantErr: "error rendering mock template",
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			r, err := http.NewRequest(http.MethodPost, "http://example.com/repos/42?page=2",
+				strings.NewReader(`{"user": {"login": "octo<cat>"}, "items": [{"id": 1}, {"id": 2}]}`))
+			require.Nil(t, err)
+			r.Header.Set("X-Team", "platform")
+
+			got, err := renderTemplate(tc.name, []byte(tc.input), vars,
+				newTemplateRequest(r, map[string]string{"id": "42"}))
+			if tc.wantErr != "" {
+				require.NotNil(t, err)
+				assert.Contains(t, err.Error(), tc.wantErr)
+				return
+			}
+
+			require.Nil(t, err)
+			if tc.wantMatch != "" {
+				assert.Regexp(t, regexp.MustCompile(tc.wantMatch), string(got))
+				return
+			}
+			assert.Equal(t, tc.want, string(got))
+		})
+	}
+}
+
+func TestTemplateCache(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "mock-proxy-templates")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hello.mock")
+	require.Nil(t, ioutil.WriteFile(path, []byte("Hello, {{ .name }}!"), 0644))
+
+	c := newTemplateCache()
+	get := func() *template.Template {
+		f, err := os.Open(path)
+		require.Nil(t, err)
+		defer f.Close()
+
+		tmpl, err := c.get("hello.mock", f)
+		require.Nil(t, err)
+		return tmpl
+	}
+
+	first := get()
+	assert.True(t, first == get(), "an unchanged file is only compiled once")
+
+	// Changing the file recompiles it.
+	require.Nil(t, ioutil.WriteFile(path, []byte("Goodbye, {{ .name }}!"), 0644))
+	later := time.Now().Add(time.Minute)
+	require.Nil(t, os.Chtimes(path, later, later))
+	changed := get()
+	assert.True(t, first != changed)
+
+	got, err := executeTemplate(changed, map[string]string{"name": "world"}, nil)
+	require.Nil(t, err)
+	assert.Equal(t, "Goodbye, world!", string(got))
+
+	// Inline bodies are cached by their contents.
+	body, err := c.get("inline", strings.NewReader("{{ .name }}"))
+	require.Nil(t, err)
+	again, err := c.get("inline", strings.NewReader("{{ .name }}"))
+	require.Nil(t, err)
+	assert.True(t, body == again)
+}
+
+func TestMockServerMockHandlerTemplate(t *testing.T) {
+	t.Parallel()
+
+	ms, err := NewMockServer(
+		WithMockRoot("testdata/"),
+		WithDefaultVariables(&VariableSubstitution{key: "greeting", value: "Hello"}),
+	)
+	require.Nil(t, err)
+
+	require.Nil(t, ms.AddRoute(&Route{
+		Host: "example.com",
+		Path: "/greet/:name",
+		Type: "http",
+		Body: strPtr(`{{ .greeting }}, {{ .name }}! You sent {{ .request.JSON.count }} at {{ now | date "2006" }}.`),
+	}))
+
+	req, err := http.NewRequest(http.MethodPost, "http://example.com/greet/russell",
+		strings.NewReader(`{"count": 3}`))
+	require.Nil(t, err)
+
+	rr := httptest.NewRecorder()
+	ms.mockHandler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "Hello, russell! You sent 3 at "+time.Now().UTC().Format("2006")+".",
+		rr.Body.String())
+}
+
+func TestMockServerMockHandlerRawFallback(t *testing.T) {
+	t.Parallel()
+
+	root := newRecordingRoot(t)
+	page := `<ul>{{#each items}}<li>{{ name }}</li>{{/each}}</ul>`
+	require.Nil(t, os.MkdirAll(filepath.Join(root, "example.com"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(root, "example.com", "page.mock"), []byte(page), 0644))
+
+	ms, err := NewMockServer(WithMockRoot(root))
+	require.Nil(t, err)
+	require.Nil(t, ms.AddRoute(&Route{
+		Host: "example.com",
+		Path: "/page",
+		Type: "http",
+		File: "example.com/page.mock",
+	}))
+	require.Nil(t, ms.AddRoute(&Route{
+		Host: "example.com",
+		Path: "/stray",
+		Type: "http",
+		Body: strPtr(`{"pattern": "{{"}`),
+	}))
+
+	tcs := []struct {
+		name     string
+		path     string
+		expected string
+	}{
+		{name: "file that fails to parse", path: "/page", expected: page},
+		{name: "body with a stray delimiter", path: "/stray", expected: `{"pattern": "{{"}`},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Twice, so that a mock read from the cache is served raw too.
+			for i := 0; i < 2; i++ {
+				req, err := http.NewRequest(http.MethodGet, "http://example.com"+tc.path, nil)
+				require.Nil(t, err)
+
+				rr := httptest.NewRecorder()
+				ms.mockHandler(rr, req)
+
+				require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+				assert.Equal(t, tc.expected, rr.Body.String())
+			}
+		})
+	}
+}
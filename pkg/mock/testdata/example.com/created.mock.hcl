@@ -0,0 +1,7 @@
+status       = 201
+content_type = "application/json"
+delay        = "10ms"
+
+headers = {
+  "Location" = "/created/1"
+}
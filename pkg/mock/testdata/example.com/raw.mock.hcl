@@ -0,0 +1 @@
+template = false
@@ -15,3 +15,90 @@ route {
     path = "/users/:name"
     type = "http"
 }
+
+route {
+    host = "example.com"
+    path = "/repos"
+    type = "http"
+}
+
+route {
+    host   = "example.com"
+    path   = "/repos"
+    type   = "http"
+    method = "POST"
+}
+
+route {
+    host = "example.com"
+    path = "/created"
+    type = "http"
+}
+
+route {
+    host   = "example.com"
+    path   = "/graphql"
+    type   = "http"
+    method = "POST"
+    file   = "example.com/graphql/viewer.mock"
+
+    match "json" {
+        path   = "$.operationName"
+        equals = "GetViewer"
+    }
+}
+
+route {
+    host   = "example.com"
+    path   = "/graphql"
+    type   = "http"
+    method = "POST"
+    file   = "example.com/graphql/issue.mock"
+
+    match "body" {
+        regex = "mutation\\s+CreateIssue"
+    }
+
+    match "header" {
+        name   = "Authorization"
+        regex  = "^Bearer "
+    }
+}
+
+route {
+    host   = "example.com"
+    path   = "/orders"
+    type   = "http"
+    method = "GET"
+    file   = "example.com/orders/empty.mock"
+}
+
+route {
+    host       = "example.com"
+    path       = "/orders"
+    type       = "http"
+    method     = "POST"
+    body       = "{\"id\": 1}"
+    scenario   = "orders"
+    next_state = "ordered"
+}
+
+route {
+    host     = "example.com"
+    path     = "/orders"
+    type     = "http"
+    method   = "GET"
+    file     = "example.com/orders/placed.mock"
+    scenario = "orders"
+    state    = "ordered"
+}
+
+route {
+    host      = "example.com"
+    path      = "/jobs/:id"
+    type      = "http"
+    responses = [
+        "example.com/jobs/pending.mock",
+        "example.com/jobs/done.mock",
+    ]
+}
@@ -1,11 +1,9 @@
 package mock
 
 import (
+	"bytes"
 	"io"
 	"io/ioutil"
-	"strings"
-	"text/template"
-	templateparse "text/template/parse"
 )
 
 // VariableSubstitution represents a single Golang type template value to be
@@ -22,42 +20,18 @@ func NewVariableSubstitution(key, value string) (*VariableSubstitution, error) {
 
 // Transform is used to implement the Transformer interface. It takes an input
 // Reader, substitutes the "key" with the "value" using Golang templates and
-// returns a Reader that has that substitution performed.
+// returns a Reader that has that substitution performed. Other variables are
+// left as they are, allowing these transforms to be chained together, though
+// MockServer merges every VariableSubstitution into a single render instead.
 func (vs *VariableSubstitution) Transform(in io.Reader) (io.Reader, error) {
-	subMap := map[string]string{
-		vs.key: vs.value,
-	}
-
 	b, err := ioutil.ReadAll(in)
 	if err != nil {
 		return nil, err
 	}
 
-	tmpl, err := template.New("var-substitution").Option("missingkey=error").Parse(string(b))
+	out, err := renderTemplate("var-substitution", b, map[string]string{vs.key: vs.value}, nil)
 	if err != nil {
 		return nil, err
 	}
-
-	// I'm pretty surprised this isn't a template option by default, but:
-	// If the template has a substitution that is not in the map, just output
-	// the original substitution string, allowing these transforms to be
-	// chained together.
-	for _, n := range tmpl.Root.Nodes {
-		if n.Type() == templateparse.NodeAction {
-			key := strings.TrimFunc(n.String(), func(r rune) bool {
-				return r == '{' || r == '}' || r == ' ' || r == '.'
-			})
-
-			_, ok := subMap[key]
-			if !ok {
-				subMap[key] = n.String()
-			}
-		}
-	}
-
-	pr, pw := io.Pipe()
-	go func() {
-		_ = pw.CloseWithError(tmpl.Execute(pw, subMap))
-	}()
-	return pr, nil
+	return bytes.NewReader(out), nil
 }
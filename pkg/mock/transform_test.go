@@ -87,6 +87,14 @@ func TestVariableSubstitutionTransform(t *testing.T) {
 			input: "transform {{ .a }} and {{ .c }}",
 			want:  "transform b and d",
 		},
+		{
+			name: "nested actions",
+			vs: []*VariableSubstitution{
+				{key: "a", value: "b"},
+			},
+			input: "{{ if .a }}transform {{ .a }} but not {{ .c }}{{ else }}{{ .c }}{{ end }}",
+			want:  "transform b but not {{.c}}",
+		},
 	}
 
 	for _, tc := range tcs {
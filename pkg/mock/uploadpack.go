@@ -0,0 +1,528 @@
+package mock
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	gitpackfile "gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	gitpktline "gopkg.in/src-d/go-git.v4/plumbing/format/pktline"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	gitpackp "gopkg.in/src-d/go-git.v4/plumbing/protocol/packp"
+	gitcapability "gopkg.in/src-d/go-git.v4/plumbing/protocol/packp/capability"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	gittransport "gopkg.in/src-d/go-git.v4/plumbing/transport"
+	gitserver "gopkg.in/src-d/go-git.v4/plumbing/transport/server"
+)
+
+// errUnsupportedDeepen is the error for a request to deepen a shallow clone
+// other than by a number of commits.
+var errUnsupportedDeepen = errors.New("only deepen by a number of commits is supported")
+
+// uploadPack serves the two requests of a git clone or fetch from a git Route,
+// the reference advertisement and the git-upload-pack request, which is
+// negotiated statelessly, as git does over HTTP, without the git binary.
+//
+// Only the advertisement comes from a go-git upload-pack session. The
+// git-upload-pack request is negotiated by negotiateUpload instead, as the
+// session's UploadPack can't serve fetches: it fails any request from a
+// shallow clone, ignores the depth of a shallow clone while claiming to be
+// shallow, never ACKs haves, sends a packfile before the client is done, and
+// supports neither sideband, filters nor include-tag. Don't replace it with
+// the session's UploadPack unless go-git grows all of that.
+func (ms *MockServer) uploadPack(
+	w http.ResponseWriter,
+	r *http.Request,
+	loader gitserver.Loader,
+	path string,
+	successCode int,
+) {
+	ms.logger.Info("detected a git clone attempt")
+
+	ep := gitEndpoint(path)
+
+	// Pushes applied to a repository built in memory aren't safe to read
+	// while they are written.
+	ms.pushMu.RLock()
+	defer ms.pushMu.RUnlock()
+
+	switch {
+	case strings.HasSuffix(r.URL.String(), "info/refs?service=git-upload-pack"):
+		if isProtocolV2(r) {
+			ms.advertiseV2(w, loader, ep, successCode)
+			return
+		}
+		ms.logger.Info("detected a reference advertisement request")
+
+		sess, err := gitserver.NewServer(loader).NewUploadPackSession(ep, nil)
+		if err != nil {
+			ms.logger.Error("failed creating git-upload-pack session", "error", err.Error())
+			http.Error(w, fmt.Sprintf("failed creating git-upload-pack session: %s",
+				err.Error()), http.StatusInternalServerError)
+			return
+		}
+		defer sess.Close()
+
+		refs, err := sess.AdvertisedReferences()
+		if err != nil {
+			ms.logger.Error("failed to load reference advertisement", "error", err.Error())
+			http.Error(w, fmt.Sprintf("failed to load reference advertisement: %s",
+				err.Error()), http.StatusInternalServerError)
+			return
+		}
+
+		// Add the Shallow capability
+		if err := refs.Capabilities.Add(gitcapability.Shallow); err != nil {
+			ms.logger.Error("failed to add shallow capability", "error", err.Error())
+			http.Error(w, fmt.Sprintf("failed to add shallow capability: %s",
+				err.Error()), http.StatusInternalServerError)
+			return
+		}
+
+		// To successfully interact with smart git clone, we must set a
+		// prefix saying which service this is.
+		refs.Prefix = [][]byte{
+			[]byte(
+				fmt.Sprintf("# service=%s", gittransport.UploadPackServiceName),
+			),
+			// Note: This is a semantically significant flush, and I don't
+			// really know why, but do not touch.
+			gitpktline.Flush,
+		}
+		w.Header().Add("Content-Type", "application/x-git-upload-pack-advertisement")
+		w.Header().Add("Cache-Control", "no-cache")
+
+		w.WriteHeader(successCode)
+		if err := refs.Encode(w); err != nil {
+			ms.logger.Error("failed writing response", "error", err.Error())
+		}
+		return
+	case !strings.HasSuffix(r.URL.String(), "git-upload-pack"):
+		ms.logger.Error("detected an unknown git request type", "url", r.URL.String())
+		http.Error(w, fmt.Sprintf("detected an unknown git request type: %s",
+			r.URL.String()), http.StatusNotFound)
+		return
+	}
+
+	ms.logger.Info("detected a git-upload-pack request")
+
+	sto, err := loader.Load(ep)
+	if err != nil {
+		ms.logger.Error("failed loading git repo", "error", err.Error())
+		http.Error(w, fmt.Sprintf("failed loading git repo: %s",
+			err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed decompressing git-upload-pack request: %s",
+				err.Error()), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	if isProtocolV2(r) {
+		ms.serveV2(w, body, sto, successCode)
+		return
+	}
+
+	req, err := decodeUploadRequest(body)
+	if err != nil {
+		ms.logger.Error("failed decoding git-upload-pack request", "error", err.Error())
+		http.Error(w, fmt.Sprintf("failed decoding git-upload-pack request: %s",
+			err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/x-git-upload-pack-result")
+	w.Header().Add("Cache-Control", "no-cache")
+
+	res, err := negotiateUpload(sto, req)
+	if err != nil {
+		// Errors in the request are reported to git, which shows them as a
+		// remote error.
+		ms.logger.Error("failed negotiating git-upload-pack", "error", err.Error())
+		w.WriteHeader(successCode)
+		_ = gitpktline.NewEncoder(w).Encodef("ERR upload-pack: %s\n", err.Error())
+		return
+	}
+
+	w.WriteHeader(successCode)
+	if err := res.encode(w, sto); err != nil {
+		ms.logger.Error("failed writing git-upload-pack response", "error", err.Error())
+	}
+}
+
+// uploadRequest is a stateless git-upload-pack request. Each request repeats
+// the wants, shallows and depth, followed by the haves of every round of
+// negotiation so far, and ends with done once the client wants its packfile.
+// The first request of a shallow fetch has no rounds of negotiation at all,
+// and only asks for the shallow update. Protocol v2 requests can also filter
+// the objects sent, and ask for the tags of the commits sent.
+type uploadRequest struct {
+	*gitpackp.UploadRequest
+	haves       []plumbing.Hash
+	negotiating bool
+	done        bool
+	filter      *objectFilter
+	includeTag  bool
+}
+
+// decodeUploadRequest decodes a stateless git-upload-pack request.
+func decodeUploadRequest(r io.Reader) (*uploadRequest, error) {
+	req := &uploadRequest{UploadRequest: gitpackp.NewUploadRequest()}
+	if err := req.UploadRequest.Decode(r); err != nil {
+		return nil, err
+	}
+
+	s := gitpktline.NewScanner(r)
+	for s.Scan() {
+		req.negotiating = true
+		line := bytes.TrimSuffix(s.Bytes(), []byte("\n"))
+		switch {
+		case len(line) == 0:
+			// A flush ends each round of haves.
+		case bytes.Equal(line, []byte("done")):
+			req.done = true
+			return req, nil
+		case bytes.HasPrefix(line, []byte("have ")):
+			h := bytes.TrimPrefix(line, []byte("have "))
+			if len(h) != 40 {
+				return nil, fmt.Errorf("invalid have %q", h)
+			}
+			req.haves = append(req.haves, plumbing.NewHash(string(h)))
+		default:
+			return nil, fmt.Errorf("unexpected line %q", line)
+		}
+	}
+	return req, s.Err()
+}
+
+// uploadResult is the response to a git-upload-pack request.
+type uploadResult struct {
+	deepen      bool
+	shallows    []plumbing.Hash
+	unshallows  []plumbing.Hash
+	negotiating bool
+	common      []plumbing.Hash
+	done        bool
+	objects     []plumbing.Hash
+}
+
+// negotiateUpload works out the response to a git-upload-pack request: the
+// changes to the shallow commits of the client, the common commits found so
+// far, and once the client is done, the objects it needs.
+func negotiateUpload(s storer.Storer, req *uploadRequest) (*uploadResult, error) {
+	if len(req.Wants) == 0 {
+		return nil, fmt.Errorf("no wants")
+	}
+
+	depth := 0
+	switch d := req.Depth.(type) {
+	case gitpackp.DepthCommits:
+		depth = int(d)
+	default:
+		if !req.Depth.IsZero() {
+			return nil, errUnsupportedDeepen
+		}
+	}
+
+	for _, h := range req.Wants {
+		if err := s.HasEncodedObject(h); err != nil {
+			return nil, fmt.Errorf("not our ref %s", h)
+		}
+	}
+
+	res := &uploadResult{deepen: depth > 0, negotiating: req.negotiating, done: req.done}
+	for _, h := range req.haves {
+		if s.HasEncodedObject(h) == nil {
+			res.common = append(res.common, h)
+		}
+	}
+
+	clientShallows := map[plumbing.Hash]bool{}
+	for _, h := range req.Shallows {
+		clientShallows[h] = true
+	}
+
+	// The client has every object reachable from the common commits, except
+	// for the history behind its own shallow commits.
+	have := newObjectWalker(s, nil, nil)
+	if _, _, err := have.walkCommits(res.common, 0, clientShallows); err != nil {
+		return nil, err
+	}
+
+	walker := newObjectWalker(s, have.seen, req.filter)
+	roots := []plumbing.Hash{}
+	for _, h := range req.Wants {
+		target, kind, tags, err := peel(s, h)
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range tags {
+			walker.add(tag)
+		}
+		switch kind {
+		case plumbing.CommitObject:
+			roots = append(roots, target)
+		case plumbing.TreeObject:
+			err = walker.walkTree(target, 0)
+		default:
+			walker.add(target)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	boundary, walked, err := walker.walkCommits(roots, depth, nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.deepen {
+		for _, h := range boundary {
+			if !clientShallows[h] {
+				res.shallows = append(res.shallows, h)
+			}
+		}
+		for _, h := range req.Shallows {
+			if walked[h] {
+				res.unshallows = append(res.unshallows, h)
+			}
+		}
+	}
+
+	if req.includeTag {
+		if err := includeTags(s, walker); err != nil {
+			return nil, err
+		}
+	}
+	res.objects = walker.objs
+
+	return res, nil
+}
+
+// encode writes an uploadResult, as git-upload-pack would without multi_ack:
+// the shallow update when the client asked to deepen, then, if the client is
+// negotiating, an ACK of the first common commit, or a NAK when there is none,
+// then the packfile once the client is done.
+func (res *uploadResult) encode(w io.Writer, s storer.EncodedObjectStorer) error {
+	e := gitpktline.NewEncoder(w)
+
+	if res.deepen {
+		for _, h := range res.shallows {
+			if err := e.Encodef("shallow %s\n", h); err != nil {
+				return err
+			}
+		}
+		for _, h := range res.unshallows {
+			if err := e.Encodef("unshallow %s\n", h); err != nil {
+				return err
+			}
+		}
+		if err := e.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if !res.negotiating {
+		return nil
+	}
+
+	var err error
+	if len(res.common) != 0 {
+		err = e.Encodef("ACK %s\n", res.common[0])
+	} else {
+		err = e.Encodef("NAK\n")
+	}
+	if err != nil || !res.done {
+		return err
+	}
+
+	_, err = gitpackfile.NewEncoder(w, s, false).Encode(res.objects, 10)
+	return err
+}
+
+// objectWalker collects the hashes of the git objects reachable from commits,
+// tags and trees, once each, skipping those in ignore, and those left out by
+// its filter, if it has one.
+type objectWalker struct {
+	s      storer.EncodedObjectStorer
+	ignore map[plumbing.Hash]bool
+	filter *objectFilter
+	seen   map[plumbing.Hash]bool
+	objs   []plumbing.Hash
+}
+
+// newObjectWalker returns an objectWalker over the objects of a repository.
+func newObjectWalker(
+	s storer.EncodedObjectStorer,
+	ignore map[plumbing.Hash]bool,
+	filter *objectFilter,
+) *objectWalker {
+	return &objectWalker{s: s, ignore: ignore, filter: filter, seen: map[plumbing.Hash]bool{}}
+}
+
+// add collects an object, returning false if it was already seen or is
+// ignored.
+func (w *objectWalker) add(h plumbing.Hash) bool {
+	if w.seen[h] || w.ignore[h] {
+		return false
+	}
+	w.seen[h] = true
+	w.objs = append(w.objs, h)
+	return true
+}
+
+// peel follows a chain of annotated tags starting at an object, returning the
+// object at the end of the chain, its type, and the tags along the way.
+func peel(
+	s storer.EncodedObjectStorer,
+	h plumbing.Hash,
+) (plumbing.Hash, plumbing.ObjectType, []plumbing.Hash, error) {
+	tags := []plumbing.Hash{}
+	for {
+		o, err := s.EncodedObject(plumbing.AnyObject, h)
+		if err != nil {
+			return h, plumbing.InvalidObject, nil, fmt.Errorf("error reading object %s: %w", h, err)
+		}
+		if o.Type() != plumbing.TagObject {
+			return h, o.Type(), tags, nil
+		}
+
+		tag, err := object.DecodeTag(s, o)
+		if err != nil {
+			return h, plumbing.InvalidObject, nil, fmt.Errorf("error reading tag %s: %w", h, err)
+		}
+		tags = append(tags, h)
+		h = tag.Target
+	}
+}
+
+// includeTags collects the annotated tags of a repository that point at
+// objects a walker collected.
+func includeTags(s storer.Storer, w *objectWalker) error {
+	refs, err := s.IterReferences()
+	if err != nil {
+		return fmt.Errorf("error reading references: %w", err)
+	}
+
+	return refs.ForEach(func(ref *plumbing.Reference) error {
+		if !ref.Name().IsTag() || ref.Type() != plumbing.HashReference {
+			return nil
+		}
+
+		target, _, tags, err := peel(s, ref.Hash())
+		if err != nil {
+			return err
+		}
+		if w.seen[target] {
+			for _, tag := range tags {
+				w.add(tag)
+			}
+		}
+		return nil
+	})
+}
+
+// walkTree collects a tree and everything in it, other than submodules. The
+// depth of the tree, which is 0 for the root tree of a commit, is used by tree
+// filters.
+func (w *objectWalker) walkTree(h plumbing.Hash, depth int) error {
+	if w.filter.omitsTree(depth) || !w.add(h) {
+		return nil
+	}
+
+	tree, err := object.GetTree(w.s, h)
+	if err != nil {
+		return fmt.Errorf("error reading tree %s: %w", h, err)
+	}
+	for _, entry := range tree.Entries {
+		switch entry.Mode {
+		case filemode.Submodule:
+		case filemode.Dir:
+			if err := w.walkTree(entry.Hash, depth+1); err != nil {
+				return err
+			}
+		default:
+			omit, err := w.filter.omitsBlob(w.s, entry.Hash, depth+1)
+			if err != nil {
+				return err
+			}
+			if !omit {
+				w.add(entry.Hash)
+			}
+		}
+	}
+	return nil
+}
+
+// walkCommits collects the commits reachable from roots, along with their
+// trees, breadth first. It doesn't walk past the commits in stop. When depth
+// is above zero, it doesn't walk past commits that many commits deep either,
+// returning those with parents as the shallow boundary. Otherwise, it doesn't
+// walk past ignored commits, whose history is ignored too. It also returns the
+// commits whose parents it walked.
+func (w *objectWalker) walkCommits(
+	roots []plumbing.Hash,
+	depth int,
+	stop map[plumbing.Hash]bool,
+) ([]plumbing.Hash, map[plumbing.Hash]bool, error) {
+	type queued struct {
+		h     plumbing.Hash
+		level int
+	}
+
+	queue := make([]queued, 0, len(roots))
+	for _, h := range roots {
+		queue = append(queue, queued{h: h, level: 1})
+	}
+
+	visited := map[plumbing.Hash]bool{}
+	walked := map[plumbing.Hash]bool{}
+	boundary := []plumbing.Hash{}
+	for len(queue) != 0 {
+		next := queue[0]
+		queue = queue[1:]
+		if visited[next.h] || (depth == 0 && w.ignore[next.h]) {
+			continue
+		}
+		visited[next.h] = true
+
+		commit, err := object.GetCommit(w.s, next.h)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading commit %s: %w", next.h, err)
+		}
+		w.add(next.h)
+		if err := w.walkTree(commit.TreeHash, 0); err != nil {
+			return nil, nil, err
+		}
+
+		switch {
+		case stop[next.h]:
+			continue
+		case depth > 0 && next.level >= depth:
+			if commit.NumParents() != 0 {
+				boundary = append(boundary, next.h)
+			}
+			continue
+		}
+
+		walked[next.h] = true
+		for _, parent := range commit.ParentHashes {
+			queue = append(queue, queued{h: parent, level: next.level + 1})
+		}
+	}
+	return boundary, walked, nil
+}
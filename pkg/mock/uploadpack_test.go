@@ -0,0 +1,127 @@
+package mock
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// commitFile commits a file to a git working directory.
+func commitFile(t *testing.T, dir, name, content string) {
+	require.Nil(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	mustGit(t, dir, "add", name)
+	mustGit(t, dir, "commit", "-q", "-m", "Add "+name)
+}
+
+func TestProxyServerGitUploadPack(t *testing.T) {
+	t.Parallel()
+
+	root, gitDir := newMockRepo(t, "example.com", "/repo")
+	work := filepath.Dir(gitDir)
+	for i := 1; i <= 3; i++ {
+		commitFile(t, work, fmt.Sprintf("%d.txt", i), fmt.Sprintf("%d\n", i))
+	}
+	mustGit(t, work, "tag", "-a", "v1.0.0", "-m", "Release 1.0.0")
+
+	ps, err := NewProxyServer(WithMockRoot(root))
+	require.Nil(t, err)
+	defer ps.Close()
+	require.Nil(t, ps.AddRoute(&Route{Host: "example.com", Path: "/repo", Type: "git"}))
+
+	proxy := "http.proxy=" + ps.URL
+	url := "http://example.com/repo"
+	tmp := newReloadRoot(t, "")
+
+	t.Run("clone", func(t *testing.T) {
+		dir := filepath.Join(tmp, "full")
+		mustGit(t, tmp, "-c", proxy, "clone", "-q", url, dir)
+
+		assert.Equal(t, mustGit(t, work, "rev-parse", "HEAD"), mustGit(t, dir, "rev-parse", "HEAD"))
+		assert.Equal(t, "4", mustGit(t, dir, "rev-list", "--count", "HEAD"))
+		assert.Equal(t, "v1.0.0", mustGit(t, dir, "describe"))
+		mustGit(t, dir, "fsck", "--strict")
+
+		// Fetching again only sends the new commit.
+		commitFile(t, work, "4.txt", "4\n")
+		defer mustGit(t, work, "reset", "-q", "--hard", "HEAD~1")
+		mustGit(t, dir, "-c", proxy, "pull", "-q", "--ff-only")
+		assert.FileExists(t, filepath.Join(dir, "4.txt"))
+		mustGit(t, dir, "fsck", "--strict")
+	})
+
+	t.Run("shallow clone", func(t *testing.T) {
+		dir := filepath.Join(tmp, "shallow")
+		mustGit(t, tmp, "-c", proxy, "clone", "-q", "--no-local", "--depth", "1", url, dir)
+
+		assert.Equal(t, "1", mustGit(t, dir, "rev-list", "--count", "HEAD"))
+		assert.Equal(t, "true", mustGit(t, dir, "rev-parse", "--is-shallow-repository"))
+		assert.FileExists(t, filepath.Join(dir, "3.txt"))
+
+		mustGit(t, dir, "-c", proxy, "fetch", "-q", "--depth", "3")
+		assert.Equal(t, "3", mustGit(t, dir, "rev-list", "--count", "HEAD"))
+
+		mustGit(t, dir, "-c", proxy, "fetch", "-q", "--unshallow")
+		assert.Equal(t, "4", mustGit(t, dir, "rev-list", "--count", "HEAD"))
+		assert.Equal(t, "false", mustGit(t, dir, "rev-parse", "--is-shallow-repository"))
+		mustGit(t, dir, "fsck", "--strict")
+	})
+}
+
+func TestMockServerGitUploadPackErrors(t *testing.T) {
+	root, gitDir := newMockRepo(t, "example.com", "/repo")
+	head := mustGit(t, gitDir, "--git-dir", gitDir, "rev-parse", "HEAD")
+
+	ms, err := NewMockServer(WithMockRoot(root))
+	require.Nil(t, err)
+	require.Nil(t, ms.AddRoute(&Route{Host: "example.com", Path: "/repo", Type: "git"}))
+
+	tcs := []struct {
+		name     string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "unknown want",
+			body:     "0032want 0123456789012345678901234567890123456789\n00000009done\n",
+			wantCode: http.StatusOK,
+			wantBody: "ERR upload-pack: not our ref 0123456789012345678901234567890123456789",
+		},
+		{
+			name:     "deepen since",
+			body:     "0032want " + head + "\n001bdeepen-since 946684800\n00000009done\n",
+			wantCode: http.StatusOK,
+			wantBody: "ERR upload-pack: only deepen by a number of commits is supported",
+		},
+		{
+			name:     "malformed",
+			body:     "hello",
+			wantCode: http.StatusBadRequest,
+			wantBody: "failed decoding git-upload-pack request",
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodPost, "http://example.com/repo/git-upload-pack",
+				strings.NewReader(tc.body))
+			recorder := httptest.NewRecorder()
+			ms.mockHandler(recorder, req)
+
+			assert.Equal(t, tc.wantCode, recorder.Code)
+			assert.Contains(t, recorder.Body.String(), tc.wantBody)
+		})
+	}
+}
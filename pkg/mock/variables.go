@@ -0,0 +1,370 @@
+package mock
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// SessionHeader identifies the client of a request for client scoped
+// variables, in place of its IP address, so that test suites sharing a host
+// or a proxy can still be told apart.
+const SessionHeader = "X-Mock-Proxy-Session"
+
+// The kinds of VariableScope.
+const (
+	ScopeGlobal = "global"
+	ScopeHost   = "host"
+	ScopeRoute  = "route"
+	ScopeClient = "client"
+)
+
+// VariableScope narrows variable substitutions to the requests to a host, the
+// requests matching the Route with an ID, or the requests from a client,
+// identified by its SessionHeader or IP address. The zero VariableScope is
+// global. When a variable is set in several scopes, client scoped values take
+// precedence over route scoped values, which take precedence over host scoped
+// values, which take precedence over global values. Path parameters take
+// precedence over every scope.
+type VariableScope struct {
+	Kind string `json:"scope,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// scopedVariable is the JSON representation of a variable substitution in a
+// scope, as returned by the substitution variables API.
+type scopedVariable struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	VariableScope
+}
+
+// scopeKinds are the kinds of non global VariableScope, from least to most
+// specific.
+var scopeKinds = []string{ScopeHost, ScopeRoute, ScopeClient}
+
+// Validate checks that a VariableScope is well formed, and normalizes a
+// global scope to the zero VariableScope.
+func (s *VariableScope) Validate() error {
+	switch s.Kind {
+	case "", ScopeGlobal:
+		if s.Name != "" {
+			return fmt.Errorf("global scope cannot have a name")
+		}
+		s.Kind = ""
+	case ScopeHost, ScopeRoute, ScopeClient:
+		if s.Name == "" {
+			return fmt.Errorf("%s scope requires a name", s.Kind)
+		}
+		if s.Kind == ScopeHost {
+			s.Name = strings.ToLower(s.Name)
+		}
+	default:
+		return fmt.Errorf("unknown variable scope %q", s.Kind)
+	}
+	return nil
+}
+
+// scopeFromQuery reads a VariableScope from the scope and name parameters of
+// a query or form.
+func scopeFromQuery(q url.Values) (VariableScope, error) {
+	scope := VariableScope{Kind: q.Get("scope"), Name: q.Get("name")}
+	return scope, scope.Validate()
+}
+
+// requestScopes returns the scopes that apply to a request which matched a
+// Route, from least to most specific, excluding the global scope.
+func requestScopes(r *http.Request, route *Route) []VariableScope {
+	host := r.URL.Host
+	if host == "" {
+		host = r.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	scopes := []VariableScope{}
+	for _, kind := range scopeKinds {
+		switch kind {
+		case ScopeHost:
+			scopes = append(scopes, VariableScope{Kind: kind, Name: strings.ToLower(host)})
+		case ScopeRoute:
+			if route != nil && route.ID != "" {
+				scopes = append(scopes, VariableScope{Kind: kind, Name: route.ID})
+			}
+		case ScopeClient:
+			scopes = append(scopes, VariableScope{Kind: kind, Name: clientID(r)})
+		}
+	}
+	return scopes
+}
+
+// clientID identifies the client of a request, by its SessionHeader, or
+// otherwise by its IP address.
+func clientID(r *http.Request) string {
+	if session := r.Header.Get(SessionHeader); session != "" {
+		return session
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// variableStore holds the variable substitutions of every scope, keyed by
+// scope, where the zero VariableScope holds the global variables. It is copy
+// on write: writers are serialized by mu and publish a new map, which is never
+// modified once published, so mock requests can read the variables without
+// locking, and always see a consistent set of them.
+type variableStore struct {
+	mu   sync.Mutex
+	vars atomic.Value // map[VariableScope][]*VariableSubstitution
+}
+
+// newVariableStore returns an empty variableStore.
+func newVariableStore() *variableStore {
+	s := &variableStore{}
+	s.vars.Store(map[VariableScope][]*VariableSubstitution{})
+	return s
+}
+
+// load returns the current variable substitutions, which must not be
+// modified.
+func (s *variableStore) load() map[VariableScope][]*VariableSubstitution {
+	return s.vars.Load().(map[VariableScope][]*VariableSubstitution)
+}
+
+// update publishes the variable substitutions returned by fn, which is given a
+// copy of the current ones to change. The slices in the copy are still shared
+// with readers, so fn must replace them rather than modify them in place.
+func (s *variableStore) update(fn func(vars map[VariableScope][]*VariableSubstitution)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := s.load()
+	vars := make(map[VariableScope][]*VariableSubstitution, len(current))
+	for scope, vs := range current {
+		vars[scope] = vs
+	}
+	fn(vars)
+	for scope, vs := range vars {
+		if len(vs) == 0 {
+			delete(vars, scope)
+		}
+	}
+	s.vars.Store(vars)
+}
+
+// withVariable returns a copy of vars with a variable substitution set,
+// replacing any existing value for its key.
+func withVariable(vars []*VariableSubstitution, vs *VariableSubstitution) []*VariableSubstitution {
+	out := make([]*VariableSubstitution, 0, len(vars)+1)
+	var replaced bool
+	for _, existing := range vars {
+		if existing.key == vs.key {
+			out = append(out, vs)
+			replaced = true
+		} else {
+			out = append(out, existing)
+		}
+	}
+	if !replaced {
+		out = append(out, vs)
+	}
+	return out
+}
+
+// withoutVariable returns a copy of vars without the variable substitution
+// for a key.
+func withoutVariable(vars []*VariableSubstitution, key string) []*VariableSubstitution {
+	out := make([]*VariableSubstitution, 0, len(vars))
+	for _, existing := range vars {
+		if existing.key != key {
+			out = append(out, existing)
+		}
+	}
+	return out
+}
+
+// setVariable sets a variable substitution in a scope, replacing any existing
+// value for its key in that scope.
+func (ms *MockServer) setVariable(scope VariableScope, vs *VariableSubstitution) {
+	ms.vars.update(func(vars map[VariableScope][]*VariableSubstitution) {
+		vars[scope] = withVariable(vars[scope], vs)
+	})
+}
+
+// deleteVariable removes the variable substitution for a key from a scope, if
+// there is one.
+func (ms *MockServer) deleteVariable(scope VariableScope, key string) {
+	ms.vars.update(func(vars map[VariableScope][]*VariableSubstitution) {
+		vars[scope] = withoutVariable(vars[scope], key)
+	})
+}
+
+// deleteVariables removes every variable substitution from a scope.
+func (ms *MockServer) deleteVariables(scope VariableScope) {
+	ms.vars.update(func(vars map[VariableScope][]*VariableSubstitution) {
+		delete(vars, scope)
+	})
+}
+
+// replaceVariables replaces every variable substitution in a scope, or in
+// every scope when all is set, with those in byScope, in a single update.
+func (ms *MockServer) replaceVariables(
+	scope VariableScope,
+	all bool,
+	byScope map[VariableScope][]*VariableSubstitution,
+) {
+	ms.vars.update(func(vars map[VariableScope][]*VariableSubstitution) {
+		if all {
+			for s := range vars {
+				delete(vars, s)
+			}
+		} else {
+			delete(vars, scope)
+		}
+		for s, vs := range byScope {
+			for _, v := range vs {
+				vars[s] = withVariable(vars[s], v)
+			}
+		}
+	})
+}
+
+// clearVariables removes every variable substitution, in every scope.
+func (ms *MockServer) clearVariables() {
+	ms.replaceVariables(VariableScope{}, true, nil)
+}
+
+// resetVariables restores the global variables given by WithDefaultVariables,
+// removing every other variable substitution.
+func (ms *MockServer) resetVariables() {
+	ms.replaceVariables(VariableScope{}, true, map[VariableScope][]*VariableSubstitution{
+		{}: ms.defaultVariables,
+	})
+}
+
+// variables returns the variable substitutions set in a scope, which must not
+// be modified.
+func (ms *MockServer) variables(scope VariableScope) []*VariableSubstitution {
+	if vars := ms.vars.load()[scope]; vars != nil {
+		return vars
+	}
+	return []*VariableSubstitution{}
+}
+
+// scopes returns every scope with variables set in it, global first, then
+// ordered from least to most specific, then by name. The global scope is
+// always included.
+func (ms *MockServer) scopes() []VariableScope {
+	rank := map[string]int{}
+	for i, kind := range scopeKinds {
+		rank[kind] = i
+	}
+
+	scopes := []VariableScope{}
+	for scope := range ms.vars.load() {
+		if scope != (VariableScope{}) {
+			scopes = append(scopes, scope)
+		}
+	}
+	sort.Slice(scopes, func(i, j int) bool {
+		if scopes[i].Kind != scopes[j].Kind {
+			return rank[scopes[i].Kind] < rank[scopes[j].Kind]
+		}
+		return scopes[i].Name < scopes[j].Name
+	})
+
+	return append([]VariableScope{{}}, scopes...)
+}
+
+// requestVariables returns the effective variable substitutions for a request
+// which matched a Route, merging the global variables with those of every
+// scope that applies to it, all from the same snapshot.
+func (ms *MockServer) requestVariables(r *http.Request, route *Route) map[string]string {
+	all := ms.vars.load()
+
+	vars := map[string]string{}
+	for _, scope := range append([]VariableScope{{}}, requestScopes(r, route)...) {
+		for _, vs := range all[scope] {
+			vars[vs.key] = vs.value
+		}
+	}
+	return vars
+}
+
+// postedVariable reads a variable substitution and its scope from a POST
+// request, with either a JSON or a multi-part form body. When the body has no
+// scope, the variable is set in the given scope. It returns the status code
+// to fail the request with alongside any error.
+func postedVariable(r *http.Request, scope VariableScope) (scopedVariable, int, error) {
+	v := scopedVariable{}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			return v, http.StatusBadRequest, fmt.Errorf("error parsing variable: %w", err)
+		}
+	} else {
+		if err := r.ParseMultipartForm(4096); err != nil {
+			return v, http.StatusInternalServerError, fmt.Errorf("error parsing input form: %w", err)
+		}
+		v.Key = r.PostForm.Get("key")
+		v.Value = r.PostForm.Get("value")
+		v.Kind = r.PostForm.Get("scope")
+		v.Name = r.PostForm.Get("name")
+	}
+
+	if v.Key == "" || v.Value == "" {
+		return v, http.StatusBadRequest, fmt.Errorf("both key and value must be supplied")
+	}
+	if v.VariableScope == (VariableScope{}) {
+		v.VariableScope = scope
+	}
+	if err := v.VariableScope.Validate(); err != nil {
+		return v, http.StatusBadRequest, err
+	}
+	return v, http.StatusOK, nil
+}
+
+// groupVariables validates the variable substitutions in a PUT request and
+// groups them by scope. Unless every scope is being replaced, each must be in
+// the scope being replaced, or have no scope of its own.
+func groupVariables(
+	vars []scopedVariable,
+	scope VariableScope,
+	all bool,
+) (map[VariableScope][]*VariableSubstitution, error) {
+	byScope := map[VariableScope][]*VariableSubstitution{}
+	for _, v := range vars {
+		if v.Key == "" || v.Value == "" {
+			return nil, fmt.Errorf("both key and value must be supplied")
+		}
+
+		s := v.VariableScope
+		if err := s.Validate(); err != nil {
+			return nil, err
+		}
+		if !all {
+			if v.VariableScope != (VariableScope{}) && s != scope {
+				return nil, fmt.Errorf("variable %q is not in the scope being replaced", v.Key)
+			}
+			s = scope
+		}
+
+		vs, err := NewVariableSubstitution(v.Key, v.Value)
+		if err != nil {
+			return nil, err
+		}
+		byScope[s] = append(byScope[s], vs)
+	}
+	return byScope, nil
+}
@@ -0,0 +1,275 @@
+package mock
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-icap/icap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// postVariable sets a variable substitution through the API, in the scope
+// given by the extra form fields.
+func postVariable(t *testing.T, ms *MockServer, fields ...string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for i := 0; i+1 < len(fields); i += 2 {
+		require.Nil(t, mw.WriteField(fields[i], fields[i+1]))
+	}
+	require.Nil(t, mw.Close())
+
+	req, err := http.NewRequest(http.MethodPost, "/substitution-variables", &body)
+	require.Nil(t, err)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	recorder := httptest.NewRecorder()
+	ms.substitutionVariableHandler(recorder, req)
+	return recorder
+}
+
+func TestVariableScopeValidate(t *testing.T) {
+	tcs := []struct {
+		name    string
+		scope   VariableScope
+		want    VariableScope
+		wantErr string
+	}{
+		{name: "zero", scope: VariableScope{}, want: VariableScope{}},
+		{name: "global", scope: VariableScope{Kind: ScopeGlobal}, want: VariableScope{}},
+		{
+			name:  "host",
+			scope: VariableScope{Kind: ScopeHost, Name: "API.Example.com"},
+			want:  VariableScope{Kind: ScopeHost, Name: "api.example.com"},
+		},
+		{
+			name:  "client",
+			scope: VariableScope{Kind: ScopeClient, Name: "Suite-A"},
+			want:  VariableScope{Kind: ScopeClient, Name: "Suite-A"},
+		},
+		{name: "global with name", scope: VariableScope{Name: "x"}, wantErr: "cannot have a name"},
+		{name: "route without name", scope: VariableScope{Kind: ScopeRoute}, wantErr: "requires a name"},
+		{name: "unknown", scope: VariableScope{Kind: "planet", Name: "x"}, wantErr: "unknown variable scope"},
+	}
+
+	for _, tc := range tcs {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := tc.scope.Validate()
+			if tc.wantErr != "" {
+				require.NotNil(t, err)
+				assert.Contains(t, err.Error(), tc.wantErr)
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, tc.want, tc.scope)
+		})
+	}
+}
+
+func TestMockServerScopedVariables(t *testing.T) {
+	t.Parallel()
+
+	ms, err := NewMockServer(
+		WithMockRoot("testdata/"),
+		WithDefaultVariables(&VariableSubstitution{key: "name", value: "global"}),
+	)
+	require.Nil(t, err)
+	require.Nil(t, ms.AddRoute(&Route{
+		ID:   "hello",
+		Host: "example.com",
+		Path: "/hello",
+		Type: "http",
+		Body: strPtr("Hello, {{ .name }}!"),
+	}))
+
+	serve := func(session, remoteAddr string) string {
+		req, err := http.NewRequest(http.MethodGet, "http://example.com/hello", nil)
+		require.Nil(t, err)
+		req.RemoteAddr = remoteAddr
+		if session != "" {
+			req.Header.Set(SessionHeader, session)
+		}
+
+		recorder := httptest.NewRecorder()
+		ms.mockHandler(recorder, req)
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		return recorder.Body.String()
+	}
+	assert.Equal(t, "Hello, global!", serve("", "10.0.0.1:1234"))
+
+	// More specific scopes take precedence.
+	res := postVariable(t, ms, "key", "name", "value", "host", "scope", "host", "name", "Example.com")
+	require.Equal(t, http.StatusOK, res.Code, res.Body.String())
+	assert.Equal(t, "Hello, host!", serve("", "10.0.0.1:1234"))
+
+	res = postVariable(t, ms, "key", "name", "value", "route", "scope", "route", "name", "hello")
+	require.Equal(t, http.StatusOK, res.Code, res.Body.String())
+	assert.Equal(t, "Hello, route!", serve("", "10.0.0.1:1234"))
+
+	res = postVariable(t, ms, "key", "name", "value", "suite-a", "scope", "client", "name", "suite-a")
+	require.Equal(t, http.StatusOK, res.Code, res.Body.String())
+	res = postVariable(t, ms, "key", "name", "value", "ip", "scope", "client", "name", "10.0.0.2")
+	require.Equal(t, http.StatusOK, res.Code, res.Body.String())
+
+	// Clients are told apart by their session header, or their IP address.
+	assert.Equal(t, "Hello, suite-a!", serve("suite-a", "10.0.0.1:1234"))
+	assert.Equal(t, "Hello, ip!", serve("", "10.0.0.2:1234"))
+	assert.Equal(t, "Hello, route!", serve("suite-b", "10.0.0.2:1234"))
+
+	// The global variables are listed as they always were.
+	res = doAPI(t, ms.substitutionVariableHandler, http.MethodGet, "/substitution-variables", "")
+	require.Equal(t, http.StatusOK, res.Code)
+	assert.JSONEq(t, `[{"key": "name", "value": "global"}]`, res.Body.String())
+
+	res = doAPI(t, ms.substitutionVariableHandler, http.MethodGet,
+		"/substitution-variables?scope=client&name=suite-a", "")
+	require.Equal(t, http.StatusOK, res.Code)
+	assert.JSONEq(t, `[{"key": "name", "value": "suite-a", "scope": "client", "name": "suite-a"}]`,
+		res.Body.String())
+
+	res = doAPI(t, ms.substitutionVariableHandler, http.MethodGet, "/substitution-variables?scope=all", "")
+	require.Equal(t, http.StatusOK, res.Code)
+	got := []scopedVariable{}
+	require.Nil(t, json.Unmarshal(res.Body.Bytes(), &got))
+	assert.Equal(t, []scopedVariable{
+		{Key: "name", Value: "global"},
+		{Key: "name", Value: "host", VariableScope: VariableScope{Kind: ScopeHost, Name: "example.com"}},
+		{Key: "name", Value: "route", VariableScope: VariableScope{Kind: ScopeRoute, Name: "hello"}},
+		{Key: "name", Value: "ip", VariableScope: VariableScope{Kind: ScopeClient, Name: "10.0.0.2"}},
+		{Key: "name", Value: "suite-a", VariableScope: VariableScope{Kind: ScopeClient, Name: "suite-a"}},
+	}, got)
+
+	// Deleting a scoped variable falls back to the next scope.
+	res = doAPI(t, ms.substitutionVariableHandler, http.MethodDelete,
+		"/substitution-variables?key=name&scope=route&name=hello", "")
+	require.Equal(t, http.StatusNoContent, res.Code)
+	assert.Equal(t, "Hello, host!", serve("", "10.0.0.1:1234"))
+
+	// Errors.
+	res = postVariable(t, ms, "key", "name", "value", "x", "scope", "planet", "name", "mars")
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	res = doAPI(t, ms.substitutionVariableHandler, http.MethodGet, "/substitution-variables?scope=host", "")
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+}
+
+func TestMockServerInterceptionClientIP(t *testing.T) {
+	t.Parallel()
+
+	ms, err := NewMockServer(WithMockRoot("testdata/"))
+	require.Nil(t, err)
+	require.Nil(t, ms.AddRoute(&Route{
+		Host: "example.com",
+		Path: "/hello",
+		Type: "http",
+		Body: strPtr("Hello, {{ .name }}!"),
+	}))
+	res := postVariable(t, ms, "key", "name", "value", "squid client", "scope", "client", "name", "192.0.2.7")
+	require.Equal(t, http.StatusOK, res.Code, res.Body.String())
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/hello", nil)
+	require.Nil(t, err)
+	recorder := newICAPRecorder()
+	ms.interception(recorder, &icap.Request{
+		Method:  "REQMOD",
+		Header:  map[string][]string{"X-Client-Ip": {"192.0.2.7"}},
+		Request: req,
+	})
+
+	require.Equal(t, http.StatusOK, recorder.code)
+	assert.Equal(t, "Hello, squid client!", recorder.body.String())
+}
+
+func TestMockServerBulkVariables(t *testing.T) {
+	t.Parallel()
+
+	ms, err := NewMockServer(
+		WithMockRoot("testdata/"),
+		WithDefaultVariables(
+			&VariableSubstitution{key: "name", value: "Davenport"},
+			&VariableSubstitution{key: "org", value: "hashicorp"},
+		),
+	)
+	require.Nil(t, err)
+
+	list := func(query string) string {
+		res := doAPI(t, ms.substitutionVariableHandler, http.MethodGet, "/substitution-variables"+query, "")
+		require.Equal(t, http.StatusOK, res.Code, res.Body.String())
+		return res.Body.String()
+	}
+
+	// Variables can be posted as JSON, defaulting to the scope of the query.
+	req, err := http.NewRequest(http.MethodPost, "/substitution-variables?scope=host&name=example.com",
+		bytes.NewBufferString(`{"key": "name", "value": "host"}`))
+	require.Nil(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	res := httptest.NewRecorder()
+	ms.substitutionVariableHandler(res, req)
+	require.Equal(t, http.StatusOK, res.Code, res.Body.String())
+	assert.JSONEq(t, `[{"key": "name", "value": "host", "scope": "host", "name": "example.com"}]`,
+		list("?scope=host&name=example.com"))
+
+	// PUT replaces every variable in a scope.
+	res = doAPI(t, ms.substitutionVariableHandler, http.MethodPut, "/substitution-variables",
+		`[{"key": "name", "value": "Barry"}, {"key": "team", "value": "platform"}]`)
+	require.Equal(t, http.StatusNoContent, res.Code, res.Body.String())
+	assert.JSONEq(t, `[{"key": "name", "value": "Barry"}, {"key": "team", "value": "platform"}]`, list(""))
+	assert.JSONEq(t, `[{"key": "name", "value": "host", "scope": "host", "name": "example.com"}]`,
+		list("?scope=host&name=example.com"))
+
+	// What GET returns for every scope can be PUT back.
+	all := list("?scope=all")
+	res = doAPI(t, ms.substitutionVariableHandler, http.MethodDelete, "/substitution-variables?scope=all", "")
+	require.Equal(t, http.StatusNoContent, res.Code)
+	assert.JSONEq(t, `[]`, list("?scope=all"))
+	res = doAPI(t, ms.substitutionVariableHandler, http.MethodPut, "/substitution-variables?scope=all", all)
+	require.Equal(t, http.StatusNoContent, res.Code, res.Body.String())
+	assert.JSONEq(t, all, list("?scope=all"))
+
+	// DELETE without a key removes every variable in a scope.
+	res = doAPI(t, ms.substitutionVariableHandler, http.MethodDelete, "/substitution-variables", "")
+	require.Equal(t, http.StatusNoContent, res.Code)
+	assert.JSONEq(t, `[]`, list(""))
+	assert.JSONEq(t, `[{"key": "name", "value": "host", "scope": "host", "name": "example.com"}]`,
+		list("?scope=all"))
+
+	// Resetting restores the defaults, and removes scoped variables.
+	res = doAPI(t, ms.substitutionVariableHandler, http.MethodPost, "/substitution-variables/reset", "")
+	require.Equal(t, http.StatusNoContent, res.Code)
+	assert.JSONEq(t, `[{"key": "name", "value": "Davenport"}, {"key": "org", "value": "hashicorp"}]`,
+		list("?scope=all"))
+
+	// Errors.
+	tcs := []struct {
+		name     string
+		method   string
+		url      string
+		body     string
+		wantCode int
+	}{
+		{"put invalid json", http.MethodPut, "/substitution-variables", `{`, http.StatusBadRequest},
+		{"put missing value", http.MethodPut, "/substitution-variables", `[{"key": "a"}]`, http.StatusBadRequest},
+		{
+			"put other scope",
+			http.MethodPut,
+			"/substitution-variables?scope=host&name=example.com",
+			`[{"key": "a", "value": "b", "scope": "client", "name": "x"}]`,
+			http.StatusBadRequest,
+		},
+		{"delete key in every scope", http.MethodDelete, "/substitution-variables?scope=all&key=a", "", http.StatusBadRequest},
+		{"post to every scope", http.MethodPost, "/substitution-variables?scope=all", "", http.StatusBadRequest},
+		{"reset with get", http.MethodGet, "/substitution-variables/reset", "", http.StatusMethodNotAllowed},
+		{"unknown action", http.MethodPost, "/substitution-variables/other", "", http.StatusNotFound},
+	}
+
+	for _, tc := range tcs {
+		res := doAPI(t, ms.substitutionVariableHandler, tc.method, tc.url, tc.body)
+		assert.Equal(t, tc.wantCode, res.Code, tc.name)
+	}
+}